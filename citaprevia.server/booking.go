@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcard/sqler"
+)
+
+const (
+	bookingsPerIP           = 10
+	bookingsPerIPWindow     = time.Hour
+	maxOpenBookingsPerPhone = 3
+	bookingDaysAhead        = 60
+)
+
+var slugRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,39}$`)
+
+func (srv server) serveBookingPage(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+	slug := strings.TrimPrefix(req.URL.Path, "/b/")
+
+	var page struct {
+		Slug     string
+		Business struct {
+			ID      string
+			Name    string
+			Address *string
+		}
+		Services  []Service
+		ServiceID string
+		Day       time.Time
+		MinDay    time.Time
+		MaxDay    time.Time
+		Slots     []Slot
+
+		Name  string
+		Phone string
+		Email string
+		Error string
+		// OnWaitlist is whether the customer just joined the waitlist for
+		// Day.
+		OnWaitlist bool
+		Locale     locale
+	}
+	page.Slug = slug
+
+	var timeZone string
+	var fallback locale
+	err := srv.db.QueryRow(ctx, `
+		SELECT id, name, address, time_zone, locale
+		FROM businesses
+		WHERE
+			slug = $1 AND self_booking
+		;
+	`, slug).Scan(&page.Business.ID, &page.Business.Name, &page.Business.Address, &timeZone, &fallback)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Redirect(w, req, "https://tengocita.app", http.StatusSeeOther)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching business for slug=%q: %w", slug, err)
+	}
+	businessID := page.Business.ID
+	loc, err := loadTimeZone(timeZone)
+	if err != nil {
+		return err
+	}
+	page.Locale = pageLocale(req, nil, fallback)
+
+	ss, err := listServicesAction{}.serveAction(ctx, srv, businessID)
+	if err != nil {
+		return err
+	}
+	page.Services = ss.(services)
+
+	req.ParseForm()
+	page.ServiceID = req.Form.Get("service")
+	if page.ServiceID == "" && len(page.Services) > 0 {
+		page.ServiceID = page.Services[0].ID
+	}
+
+	y, m, d := now().In(loc).Date()
+	page.MinDay = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	page.MaxDay = page.MinDay.AddDate(0, 0, bookingDaysAhead)
+	page.Day, err = time.ParseInLocation(dayFormat, req.Form.Get("day"), loc)
+	if err != nil || page.Day.Before(page.MinDay) || page.Day.After(page.MaxDay) {
+		page.Day = page.MinDay
+	}
+
+	if req.Method == "POST" {
+		page.Name = strings.TrimSpace(req.Form.Get("name"))
+		page.Phone = trimPhone(req.Form.Get("phone"))
+		page.Email = strings.TrimSpace(req.Form.Get("email"))
+
+		if req.Form.Get("action") == "waitlist" {
+			problem, err := srv.joinWaitlist(req, page.Locale, businessID, page.ServiceID, page.Day, page.Name, page.Phone, page.Email)
+			if err != nil {
+				return err
+			}
+			page.OnWaitlist = problem == ""
+			page.Error = problem
+		} else {
+			customerLink, problem, err := srv.selfBook(req, page.Locale, businessID, page.ServiceID, page.Name, page.Phone, page.Email)
+			if err != nil {
+				return err
+			}
+			if problem == "" {
+				http.Redirect(w, req, "https://tengocita.app/c/"+customerLink, http.StatusSeeOther)
+				return nil
+			}
+			page.Error = problem
+		}
+	}
+
+	duration := defaultAppointmentDuration
+	for _, s := range page.Services {
+		if s.ID == page.ServiceID {
+			duration = s.Duration
+		}
+	}
+	resourceIDs, err := bookableResources(ctx, srv.db, businessID)
+	if err != nil {
+		return err
+	}
+	// A time is free if any resource is free then.
+	seen := map[int64]bool{}
+	for _, resourceID := range resourceIDs {
+		ss, err := availableSlots(ctx, srv.db, businessID, resourceID, Slot{
+			Start: page.Day,
+			End:   page.Day.AddDate(0, 0, 1),
+		}, duration, "")
+		if err != nil {
+			return err
+		}
+		for _, s := range ss {
+			if !seen[s.Start.Unix()] {
+				seen[s.Start.Unix()] = true
+				page.Slots = append(page.Slots, s)
+			}
+		}
+	}
+	sort.Slice(page.Slots, func(i, j int) bool {
+		return page.Slots[i].Start.Before(page.Slots[j].Start)
+	})
+
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return bookingTpl.Execute(w, page)
+}
+
+// selfBook creates an appointment requested from the public booking page, with
+// messages in l. If the appointment can't be created, problem explains why to
+// the customer.
+func (srv server) selfBook(req *http.Request, l locale, businessID, serviceID, name, phone, email string) (customerLink, problem string, err error) {
+	ctx := req.Context()
+
+	if !srv.bookingLimiter.allow(clientIP(req)) {
+		return "", l.sprintf("booking.tooManyBookings"), nil
+	}
+
+	start, err := time.Parse(time.RFC3339, req.Form.Get("start"))
+	if err != nil || start.Before(now()) {
+		return "", l.sprintf("booking.badStart"), nil
+	}
+	if name == "" {
+		return "", l.sprintf("booking.missingName"), nil
+	}
+
+	resourceIDs, err := bookableResources(ctx, srv.db, businessID)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Book with the first resource that's free.
+	var result interface{}
+	for _, resourceID := range resourceIDs {
+		result, err = newAppointmentAction{
+			Start:      start,
+			Phone:      phone,
+			Email:      email,
+			Name:       name,
+			ServiceID:  serviceID,
+			ResourceID: resourceID,
+			Locale:     l,
+
+			maxOpenBookings: maxOpenBookingsPerPhone,
+		}.serveAction(ctx, srv, businessID)
+		if err != nil {
+			return "", "", err
+		}
+		if _, taken := result.(slotTaken); !taken {
+			break
+		}
+	}
+
+	log(ctx).Printf("Self booking businessID=%s result=%T", businessID, result)
+
+	switch result := result.(type) {
+	case created:
+		return result.CustomerLink, "", nil
+	case missingEmailOrPhone:
+		return "", l.sprintf("booking.missingEmailOrPhone"), nil
+	case tooManyOpenBookings:
+		return "", l.sprintf("booking.tooManyOpen"), nil
+	case outsideOpeningHours, slotTaken:
+		return "", l.sprintf("booking.slotTaken"), nil
+	default:
+		return "", l.sprintf("booking.failed"), nil
+	}
+}
+
+// bookableResources returns the resources that self-bookings can take up. If
+// the business doesn't have any, self-bookings take up no resource, so it's
+// just "".
+func bookableResources(ctx context.Context, db sqler.Queryer, businessID string) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id
+		FROM resources
+		WHERE
+			business_id = $1 AND deleted_at IS NULL
+		ORDER BY name
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching resources: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+	return ids, nil
+}
+
+// joinWaitlist adds the customer to the waitlist for day, from the public
+// booking page, with offers in l. If they can't be added, problem explains
+// why.
+func (srv server) joinWaitlist(req *http.Request, l locale, businessID, serviceID string, day time.Time, name, phone, email string) (problem string, err error) {
+	ctx := req.Context()
+
+	if !srv.bookingLimiter.allow(clientIP(req)) {
+		return l.sprintf("booking.tooManyBookings"), nil
+	}
+	if name == "" {
+		return l.sprintf("booking.missingName"), nil
+	}
+
+	result, err := addToWaitlistAction{
+		Name:      name,
+		Phone:     phone,
+		Email:     email,
+		ServiceID: serviceID,
+		From:      day,
+		To:        day.AddDate(0, 0, 1),
+		Locale:    l,
+	}.serveAction(ctx, srv, businessID)
+	if err != nil {
+		return "", err
+	}
+
+	log(ctx).Printf("Waitlist join businessID=%s result=%T", businessID, result)
+
+	switch result.(type) {
+	case waitlistEntry:
+		return "", nil
+	case missingEmailOrPhone:
+		return l.sprintf("booking.missingEmailOrPhone"), nil
+	default:
+		return l.sprintf("waitlist.failed"), nil
+	}
+}
+
+// clientIP returns the address of the client. Behind the reverse proxy, that's
+// the last entry in X-Forwarded-For, which is the one the proxy added. Anyone
+// else could send any X-Forwarded-For, so it's only trusted from
+// trustedProxies.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" && isTrustedProxy(host) {
+		ips := strings.Split(fwd, ",")
+		return strings.TrimSpace(ips[len(ips)-1])
+	}
+	return host
+}
+
+func isTrustedProxy(host string) bool {
+	for _, p := range strings.Split(trustedProxies, ",") {
+		if strings.TrimSpace(p) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter allows up to limit events per key within a fixed window.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mtx  sync.Mutex
+	hits map[string]*rateLimiterHits
+}
+
+type rateLimiterHits struct {
+	since time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   map[string]*rateLimiterHits{},
+	}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	t := time.Now()
+
+	h, ok := l.hits[key]
+	if !ok || t.Sub(h.since) > l.window {
+		if len(l.hits) > 10000 {
+			for k, h := range l.hits {
+				if t.Sub(h.since) > l.window {
+					delete(l.hits, k)
+				}
+			}
+		}
+		h = &rateLimiterHits{since: t}
+		l.hits[key] = h
+	}
+
+	if h.count >= l.limit {
+		return false
+	}
+	h.count++
+	return true
+}
+
+var bookingTpl = template.Must(template.New("").Funcs(localeFuncs).Funcs(template.FuncMap{
+	"price": formatPrice,
+}).Parse(`
+<html lang="{{.Locale}}">
+
+<head>
+<title>{{t .Locale "booking.title" .Business.Name}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style type="text/css">
+body {
+	font-family: sans-serif;
+	text-align: center;
+}
+
+.alert {
+	background-color: #ffffaa;
+	padding: 20px;
+}
+
+.slots label {
+	display: inline-block;
+	padding: 5px;
+}
+
+button, input[type=submit] {
+	padding: 10;
+	font-weight: bold;
+	font-size: 1em;
+}
+</style>
+</head>
+
+<body>
+
+<h1>{{t .Locale "booking.title" .Business.Name}}</h1>
+
+{{with .Business.Address}}
+<p>🌍 <a href="http://maps.google.com/maps?q={{.}}">{{.}}</a></p>
+{{end}}
+
+{{with .Error}}
+<p class="alert">⚠️ {{.}}</p>
+{{end}}
+
+<form method="get" action="">
+{{if .Services}}
+<p>
+<select name="service" onchange="this.form.submit()">
+{{range .Services}}
+<option value="{{.ID}}"{{if eq .ID $.ServiceID}} selected{{end}}>{{.Name}}{{with .PriceCents}} ({{price .}}){{end}}</option>
+{{end}}
+</select>
+</p>
+{{end}}
+<p>
+<input type="date" name="day" value="{{.Day.Format "2006-01-02"}}" min="{{.MinDay.Format "2006-01-02"}}" max="{{.MaxDay.Format "2006-01-02"}}" onchange="this.form.submit()">
+</p>
+</form>
+
+{{if .Slots}}
+
+<form method="post" action="">
+<input type="hidden" name="service" value="{{.ServiceID}}">
+<input type="hidden" name="day" value="{{.Day.Format "2006-01-02"}}">
+
+<h3>{{t .Locale "booking.chooseTime"}}</h3>
+
+<p class="slots">
+{{range .Slots}}
+<label><input type="radio" name="start" value="{{.Start.Format "2006-01-02T15:04:05Z07:00"}}" required> {{.Start.Format "15:04"}}</label>
+{{end}}
+</p>
+
+<h3>{{t .Locale "booking.yourDetails"}}</h3>
+
+<p><input type="text" name="name" placeholder="{{t .Locale "name"}}" value="{{.Name}}" required></p>
+<p><input type="tel" name="phone" placeholder="{{t .Locale "phone"}}" value="{{.Phone}}"></p>
+<p><input type="email" name="email" placeholder="{{t .Locale "email"}}" value="{{.Email}}"></p>
+
+<p><input type="submit" value="{{t .Locale "booking.submit"}}"></p>
+</form>
+
+{{else if .OnWaitlist}}
+
+<p>{{t .Locale "waitlist.joined"}}</p>
+
+{{else}}
+
+<p>{{t .Locale "booking.noSlots"}}</p>
+
+<form method="post" action="">
+<input type="hidden" name="action" value="waitlist">
+<input type="hidden" name="service" value="{{.ServiceID}}">
+<input type="hidden" name="day" value="{{.Day.Format "2006-01-02"}}">
+
+<h3>{{t .Locale "waitlist.join"}}</h3>
+
+<p>{{t .Locale "waitlist.explain"}}</p>
+
+<p><input type="text" name="name" placeholder="{{t .Locale "name"}}" value="{{.Name}}" required></p>
+<p><input type="tel" name="phone" placeholder="{{t .Locale "phone"}}" value="{{.Phone}}"></p>
+<p><input type="email" name="email" placeholder="{{t .Locale "email"}}" value="{{.Email}}"></p>
+
+<p><input type="submit" value="{{t .Locale "waitlist.submit"}}"></p>
+</form>
+
+{{end}}
+
+</body>
+
+</html>
+`))
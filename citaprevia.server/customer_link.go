@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/skip2/go-qrcode"
+	"github.com/tcard/sqler"
 )
 
 func (srv server) serveCustomerAppointment(w http.ResponseWriter, req *http.Request) error {
@@ -30,20 +32,27 @@ func (srv server) serveCustomerAppointment(w http.ResponseWriter, req *http.Requ
 		return nil
 	}
 
+	l, err := customerLocale(ctx, srv.db, req, key)
+	if err != nil {
+		return err
+	}
+
+	var problem string
 	if req.Method == "POST" {
-		_, err := srv.db.Exec(ctx, `
-			UPDATE appointments SET
-				canceled_at = now() at time zone 'utc',
-				cancel_reason = $2
-			WHERE
-				customer_link = $1
-				AND started_at IS NULL
-				AND canceled_at IS NULL
-				AND finished_at IS NULL
-			;
-		`, key, nilIfEmpty(strings.TrimSpace(req.Form.Get("comments"))))
+		var err error
+		switch req.Form.Get("action") {
+		case "confirm":
+			err = srv.confirmByCustomer(ctx, key)
+		case "reschedule":
+			problem, err = srv.requestReschedule(ctx, l, key, req.Form["start"], strings.TrimSpace(req.Form.Get("comments")))
+		case "cancel":
+			err = srv.cancelByCustomer(ctx, key, strings.TrimSpace(req.Form.Get("comments")))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return nil
+		}
 		if err != nil {
-			return fmt.Errorf("cancel appointment customerLink=%v: %w", key, err)
+			return err
 		}
 	}
 
@@ -56,39 +65,77 @@ func (srv server) serveCustomerAppointment(w http.ResponseWriter, req *http.Requ
 			Photo   *string
 		}
 
+		Service struct {
+			Name       *string
+			PriceCents *int
+		}
+
+		BusinessID   string
+		ResourceID   string
 		ID           string
 		Start        time.Time
+		End          time.Time
 		CustomerCode int
 		CustomerLink string
 		StartedAt    *time.Time
+		NoShowAt     *time.Time
+		ConfirmedAt  *time.Time
 		CanceledAt   *time.Time
 		CancelReason *string
 		FinishedAt   *time.Time
 		Comments     *string
+		Number       int
+		WalkIn       bool
 
 		LastDelay *time.Duration
+		// Queue is where a walk-in waits to be served.
+		Queue *queuePosition
+
+		// Reschedule is the last request to move the appointment, if any.
+		Reschedule *struct {
+			Status rescheduleStatus
+			Reason *string
+		}
+		RescheduleOptions  []rescheduleDay
+		MaxRescheduleSlots int
+		Problem            string
+		Locale             locale
 	}
+	app.MaxRescheduleSlots = maxRescheduleSlots
+	app.Problem = problem
+	app.Locale = l
 
 	var lastDelaySecs sql.NullFloat64
-	err := srv.db.QueryRow(ctx, `
+	var timeZone string
+	err = srv.db.QueryRow(ctx, `
 		SELECT
 			b.email, b.phone, b.name, b.address, b.photo,
-			a.id, a.start, a.customer_code, a.customer_link,
-			a.started_at, a.canceled_at, a.cancel_reason, a.finished_at, a.comments,
+			a.business_id, COALESCE(a.resource_id, ''), a.id, a.start, a."end", a.customer_code, a.customer_link,
+			a.started_at, a.no_show_at, a.confirmed_at, a.canceled_at, a.cancel_reason, a.finished_at, a.comments,
+			a.number, a.walk_in,
+			b.time_zone,
+			s.name, s.price_cents,
 			extract(epoch from da.last_delay)
 		FROM
 			businesses b
 			JOIN appointments a ON b.id = a.business_id
+			LEFT JOIN services s
+				ON a.business_id = s.business_id
+				AND a.service_id = s.id
 			LEFT JOIN delay_alerts da
 				ON b.id = da.business_id
+				AND da.resource_id = COALESCE(a.resource_id, '')
 				AND da.last_delay IS NOT NULL
 		WHERE
 			a.customer_link = $1
 		;
 	`, key).Scan(
 		&app.Business.Email, &app.Business.Phone, &app.Business.Name, &app.Business.Address, &app.Business.Photo,
-		&app.ID, &app.Start, &app.CustomerCode, &app.CustomerLink,
-		&app.StartedAt, &app.CanceledAt, &app.CancelReason, &app.FinishedAt, &app.Comments,
+		&app.BusinessID, &app.ResourceID, &app.ID, &app.Start, &app.End, &app.CustomerCode, &app.CustomerLink,
+		&app.StartedAt, &app.NoShowAt, &app.ConfirmedAt, &app.CanceledAt, &app.CancelReason, &app.FinishedAt, &app.Comments,
+		&app.Number, &app.WalkIn,
+		&timeZone,
+		&app.Service.Name, &app.Service.PriceCents,
 		&lastDelaySecs,
 	)
 	if err != nil {
@@ -98,15 +145,149 @@ func (srv server) serveCustomerAppointment(w http.ResponseWriter, req *http.Requ
 		}
 		return err
 	}
+	loc, err := loadTimeZone(timeZone)
+	if err != nil {
+		return err
+	}
+	app.Start, app.End = app.Start.In(loc), app.End.In(loc)
+
 	if lastDelaySecs.Valid {
 		d := time.Second * time.Duration(lastDelaySecs.Float64)
 		app.LastDelay = &d
 	}
 
+	if app.WalkIn {
+		// The position is computed on every load, so that it follows the
+		// business starting and finishing appointments.
+		p, ok, err := walkInPosition(ctx, srv.db, app.BusinessID, app.ID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			app.Queue = &p
+		}
+	} else if app.StartedAt == nil && app.CanceledAt == nil && app.FinishedAt == nil && app.NoShowAt == nil {
+		var status rescheduleStatus
+		var reason *string
+		err := srv.db.QueryRow(ctx, `
+			SELECT status, reason
+			FROM reschedule_requests
+			WHERE
+				business_id = $1 AND appointment_id = $2 AND status IN ('pending', 'rejected')
+			ORDER BY created_at DESC
+			LIMIT 1
+			;
+		`, app.BusinessID, app.ID).Scan(&status, &reason)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("fetching reschedule request: %w", err)
+		}
+		if err == nil {
+			app.Reschedule = &struct {
+				Status rescheduleStatus
+				Reason *string
+			}{status, reason}
+		}
+
+		app.RescheduleOptions, err = rescheduleOptions(ctx, srv.db, app.BusinessID, app.ResourceID, app.ID, app.End.Sub(app.Start))
+		if err != nil {
+			return err
+		}
+	}
+
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
 	return customerLinkTpl.Execute(w, app)
 }
 
+// confirmByCustomer records that the customer says they'll attend.
+func (srv server) confirmByCustomer(ctx context.Context, customerLink string) error {
+	_, err := srv.db.Exec(ctx, `
+		UPDATE appointments SET
+			confirmed_at = COALESCE(confirmed_at, now() at time zone 'utc')
+		WHERE
+			customer_link = $1
+			AND started_at IS NULL
+			AND canceled_at IS NULL
+			AND finished_at IS NULL
+			AND no_show_at IS NULL
+		;
+	`, customerLink)
+	if err != nil {
+		return fmt.Errorf("confirm appointment customerLink=%v: %w", customerLink, err)
+	}
+	return nil
+}
+
+// cancelByCustomer cancels the appointment from its customer page, and lets
+// the business know by email.
+func (srv server) cancelByCustomer(ctx context.Context, customerLink, reason string) error {
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	return useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		var businessID, appointmentID string
+		var start time.Time
+		var name sql.NullString
+		var businessEmail sql.NullString
+		var timeZone string
+		err = tx.QueryRow(ctx, `
+			UPDATE appointments a SET
+				canceled_at = now() at time zone 'utc',
+				cancel_reason = $2
+			FROM businesses b
+			WHERE
+				a.customer_link = $1
+				AND b.id = a.business_id
+				AND a.started_at IS NULL
+				AND a.canceled_at IS NULL
+				AND a.finished_at IS NULL
+				AND a.no_show_at IS NULL
+			RETURNING
+				a.business_id, a.id, a.start, a.name, b.email, b.time_zone
+			;
+		`, customerLink, nilIfEmpty(reason)).Scan(&businessID, &appointmentID, &start, &name, &businessEmail, &timeZone)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("cancel appointment customerLink=%v: %w", customerLink, err)
+		}
+
+		err = offerFreedSlot(ctx, tx, businessID, appointmentID)
+		if err != nil {
+			return false, err
+		}
+
+		loc, err := loadTimeZone(timeZone)
+		if err != nil {
+			return false, err
+		}
+		start = start.In(loc)
+
+		customer := "Un cliente"
+		if name.Valid {
+			customer = name.String
+		}
+		paragraphs := []string{fmt.Sprintf(
+			"%s ha anulado su cita del %s a las %d:%02d.",
+			customer, start.Format("2/1"), start.Hour(), start.Minute(),
+		)}
+		if reason != "" {
+			paragraphs = append(paragraphs, "Motivo: "+reason)
+		}
+		err = enqueueEmail(ctx, tx, businessID, appointmentID, nullStringPtr(businessEmail), appointmentEmail{
+			Subject:      "🚫📆 Cita anulada por el cliente",
+			Paragraphs:   paragraphs,
+			CustomerLink: customerLink,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+}
+
 func (srv server) registerWebPush(w http.ResponseWriter, req *http.Request) error {
 	defer req.Body.Close()
 
@@ -141,17 +322,22 @@ func customerCodeWithChecksum(code int) int {
 	return code*100 + (code / 1000) + 2*(code/100%10) + 3*(code/10%10) + 4*(code%10)
 }
 
-var customerLinkTpl = template.Must(template.New("").Funcs(template.FuncMap{
+var customerLinkTpl = template.Must(template.New("").Funcs(localeFuncs).Funcs(template.FuncMap{
 	"qrPNGBase64":      qrPNGBase64,
 	"codeWithChecksum": customerCodeWithChecksum,
+	"calendarURL":      appointmentCalendarURL,
+	"price":            formatPrice,
+	"minutes": func(d time.Duration) int {
+		return int(d / time.Minute)
+	},
 	"nl2br": func(s string) template.HTML {
 		return template.HTML(strings.ReplaceAll(html.EscapeString(s), "\n", "<br>"))
 	},
 }).Parse(`
-<html>
+<html lang="{{.Locale}}">
 
 <head>
-<title>Tu cita con {{.Business.Name}}</title>
+<title>{{t .Locale "page.title" .Business.Name}}</title>
 <meta name="viewport" content="width=device-width, initial-scale=1">
 <style type="text/css">
 body {
@@ -174,18 +360,24 @@ button, input[type=submit] {
 
 <body>
 
+<div id="status">
+
 {{ if .CanceledAt }}
 
-<h1>Cita cancelada</h1>
+<h1>{{t .Locale "page.canceled"}}</h1>
 
 {{ with .CancelReason }}
-<p><string>Motivo:</string></p>
+<p><string>{{t $.Locale "page.reason"}}</string></p>
 <p>{{nl2br .}}</p>
 {{ end }}
 
 {{ else if .FinishedAt }}
 
-<h1>Cita finalizada</h1>
+<h1>{{t .Locale "page.finished"}}</h1>
+
+{{ else if .NoShowAt }}
+
+<h1>{{t .Locale "page.noShow"}}</h1>
 
 {{ else }}
 
@@ -220,11 +412,11 @@ function registerPush() {
 			var div = document.createElement('div');
 			div.id = 'activate-push';
 			div.class = 'alert';
-			div.innerHTML = '<h3>¿Quieres recibir avisos sobre tu cita? (Retrasos, anulación...)</h3>';
+			div.innerHTML = '<h3>{{t .Locale "page.askPush"}}</h3>';
 
 			var button = document.createElement('button');
 			button.setAttribute('onclick', 'registerPush()');
-			button.innerText = 'Sí, recibir';
+			button.innerText = '{{t .Locale "page.acceptPush"}}';
 			div.appendChild(button);
 
 			document.body.insertBefore(div, document.body.firstChild);
@@ -265,7 +457,7 @@ function registerPush() {
 			return;
 		}
 		console.error(err);
-		alert('Error al suscribirse a avisos sobre la cita. Actualiza la página para reintentarlo.');
+		alert('{{t .Locale "page.pushError"}}');
 	});
 }
 
@@ -273,32 +465,131 @@ registerPush();
 
 function toggleCancelForm() {
 	var form = document.getElementById('cancel-form');
-	form.innerHTML = '<h5>¿Seguro que quieres anular la cita?</h5>' +
+	form.innerHTML = '<h5>{{t .Locale "page.confirmCancel"}}</h5>' +
 		'<form method="post" action="">' +
 		'<input type="hidden" name="customerLink" value="{{.CustomerLink}}">' +
-		'<p><textarea name="comments" cols="40" rows="10" placeholder="Comentario sobre la anulación (motivo, solicitar nueva hora, etc.)"></textarea></p>' +
-		'<p><input type="submit" style="background-color: red; color: white;" value="Sí, anular"></p>' +
+		'<input type="hidden" name="action" value="cancel">' +
+		'<p><textarea name="comments" cols="40" rows="10" placeholder="{{t .Locale "page.cancelComments"}}"></textarea></p>' +
+		'<p><input type="submit" style="background-color: red; color: white;" value="{{t .Locale "page.yesCancel"}}"></p>' +
 		'</form>';
 };
+
+function toggleRescheduleForm() {
+	var form = document.getElementById('reschedule-form');
+	form.style.display = form.style.display === 'none' ? 'block' : 'none';
+};
+
+function show(id, visible) {
+	var el = document.getElementById(id);
+	if (el) {
+		el.style.display = visible ? '' : 'none';
+	}
+}
+
+function setText(id, text) {
+	var el = document.getElementById(id);
+	if (el) {
+		el.innerText = text;
+	}
+}
+
+var endedTitles = {
+	canceled: {{t .Locale "page.canceled"}},
+	finished: {{t .Locale "page.finished"}},
+	noShow: {{t .Locale "page.noShow"}},
+};
+
+function updateState(state) {
+	if (endedTitles[state.status]) {
+		var status = document.getElementById('status');
+		status.innerHTML = '';
+		var title = document.createElement('h1');
+		title.innerText = endedTitles[state.status];
+		status.appendChild(title);
+		if (state.cancelReason) {
+			var reason = document.createElement('p');
+			reason.innerText = {{t .Locale "page.reason"}} + ' ' + state.cancelReason;
+			status.appendChild(reason);
+		}
+		var actions = document.getElementById('actions');
+		if (actions) {
+			actions.parentNode.removeChild(actions);
+		}
+		events.close();
+		return;
+	}
+
+	if (state.status === 'started') {
+		show('pending-actions', false);
+	}
+
+	show('delay', state.delayMinutes);
+	setText('delay-minutes', state.delayMinutes + ' min');
+	show('next', state.next);
+
+	show('queue', state.queue);
+	if (state.queue) {
+		show('queue-next', state.queue.position === 1);
+		show('queue-position', state.queue.position !== 1);
+		setText('queue-position-number', state.queue.position);
+		show('queue-wait', state.queue.estimatedWait);
+		setText('queue-wait-minutes', Math.round(state.queue.estimatedWait / 60e9) + ' min');
+	}
+}
+
+if (window.EventSource) {
+	var events = new EventSource('/customerAppointmentEvents?key={{.CustomerLink}}');
+	events.addEventListener('state', function(e) {
+		updateState(JSON.parse(e.data));
+	});
+}
 </script>
 
-{{ with .LastDelay }}
-<p class="alert">⚠️ Tu cita va con un retraso aproximado de <strong>{{.}}</strong>.</p>
+{{ with .Problem }}
+<p class="alert">⚠️ {{.}}</p>
+{{ end }}
+
+{{ with .Reschedule }}
+{{ if eq .Status "pending" }}
+<p class="alert">{{t $.Locale "page.reschedulePending" $.Business.Name}}</p>
+{{ else }}
+<p class="alert">{{t $.Locale "page.rescheduleRejected" $.Business.Name}}{{with .Reason}} {{t $.Locale "reason" .}}{{end}}</p>
+{{ end }}
+{{ end }}
+
+{{ with .Queue }}
+<div id="queue">
+<h1>{{t $.Locale "page.yourTurn" $.Number}}</h1>
+
+<p class="alert" id="queue-next"{{ if ne .Position 1 }} style="display: none;"{{ end }}>{{t $.Locale "page.next"}}</p>
+<p class="alert" id="queue-position"{{ if eq .Position 1 }} style="display: none;"{{ end }}>{{tHTML $.Locale "page.queuePositionHTML" .Position}}</p>
+
+<p id="queue-wait"{{ if not .EstimatedWait }} style="display: none;"{{ end }}>{{tHTML $.Locale "page.queueWaitHTML" (printf "%d min" (minutes .EstimatedWait))}}</p>
+</div>
+{{ end }}
+
+{{ if not .WalkIn }}
+{{ $delay := "" }}{{ with .LastDelay }}{{ $delay = printf "%d min" (minutes .) }}{{ end }}
+<p class="alert" id="delay"{{ if not .LastDelay }} style="display: none;"{{ end }}>{{tHTML .Locale "page.delayHTML" $delay}}</p>
+
+<p class="alert" id="next" style="display: none;">{{t .Locale "page.next"}}</p>
 {{ end }}
 
-<h1>Tu cita</h1>
+<h1>{{t .Locale "page.yourAppointment"}}</h1>
 
-<p>Enseña este código al llegar:</p>
+<p>{{t .Locale "page.showCode"}}</p>
 
 <img style="width: 90%;" src="data:image/png;base64, {{qrPNGBase64 .ID}}">
 
-<p>O di tu código numérico:</p>
+<p>{{t .Locale "page.sayCode"}}</p>
 
 <h1 style="letter-spacing: 10px;">{{codeWithChecksum .CustomerCode}}</h1>
 
 {{ end }}
 
-<h3>Detalle de la cita</h3>
+</div>
+
+<h3>{{t .Locale "page.details"}}</h3>
 
 <table style="margin: 0 auto;">
 
@@ -308,8 +599,15 @@ function toggleCancelForm() {
 
 <tr>
 <td>🕑</td>
-<td>{{.Start.Format "2 / 1 / 2006 a las 3:04" }}</td>
+<td>{{ if .WalkIn }}{{t .Locale "page.arrival" (.Start.Format "2 / 1 / 2006") (.Start.Format "15:04")}}{{ else }}{{t .Locale "page.start" (.Start.Format "2 / 1 / 2006") (.Start.Format "15:04")}}{{ end }}</td>
+</tr>
+
+{{with .Service.Name}}
+<tr>
+<td>📋</td>
+<td>{{.}}{{with $.Service.PriceCents}} ({{price .}}){{end}}</td>
 </tr>
+{{end}}
 
 {{with .Business.Phone}}
 <tr>
@@ -332,20 +630,68 @@ function toggleCancelForm() {
 </tr>
 {{end}}
 
+{{ if not .WalkIn }}
+<tr>
+<td>📅</td>
+<td><a href="{{calendarURL .CustomerLink}}">{{t .Locale "page.addToCalendar"}}</a></td>
+</tr>
+{{ end }}
+
 </table>
 
 {{with .Comments}}
-<h4>Comentarios</h4>
+<h4>{{t $.Locale "comments"}}</h4>
 
 <p>{{nl2br .}}</p>
 {{end}}
 
-{{ if and (not .FinishedAt) (not .CanceledAt) }}
+<div id="actions">
+
+<div id="pending-actions">
+
+{{ if and (not .WalkIn) (not .StartedAt) (not .FinishedAt) (not .CanceledAt) (not .NoShowAt) }}
+{{ if .ConfirmedAt }}
+<p>{{t .Locale "page.confirmed"}}</p>
+{{ else }}
+<form method="post" action="">
+<input type="hidden" name="customerLink" value="{{.CustomerLink}}">
+<input type="hidden" name="action" value="confirm">
+<p><input type="submit" style="background-color: green; color: white;" value="{{t .Locale "page.confirm"}}"></p>
+</form>
+{{ end }}
+{{ end }}
+
+{{ if .RescheduleOptions }}
+<p><button onclick="toggleRescheduleForm()">{{t .Locale "page.askReschedule"}}</button></p>
+<form id="reschedule-form" method="post" action="" style="display: none;">
+<input type="hidden" name="customerLink" value="{{.CustomerLink}}">
+<input type="hidden" name="action" value="reschedule">
+<h5>{{t .Locale "page.chooseRescheduleSlots" .MaxRescheduleSlots}}</h5>
+{{ range .RescheduleOptions }}
+<details>
+<summary>{{.Day.Format "2 / 1"}}</summary>
+<p>
+{{ range .Slots }}
+<label style="display: inline-block; padding: 5px;"><input type="checkbox" name="start" value="{{.Start.Format "2006-01-02T15:04:05Z07:00"}}"> {{.Start.Format "15:04"}}</label>
+{{ end }}
+</p>
+</details>
+{{ end }}
+<p><textarea name="comments" cols="40" rows="4" placeholder="{{t .Locale "page.optionalComment"}}"></textarea></p>
+<p><input type="submit" value="{{t .Locale "page.requestReschedule"}}"></p>
+</form>
+{{ end }}
+
+</div>
+
+{{ if and (not .FinishedAt) (not .CanceledAt) (not .NoShowAt) }}
 <div id="cancel-form">
-<button style="background-color: red; color: white;" onclick="toggleCancelForm()">Anular la cita</button>
+<button style="background-color: red; color: white;" onclick="toggleCancelForm()">{{t .Locale "page.cancel"}}</button>
 </div>
 {{ end }}
 
+</div>
+
 </body>
 
 </html>
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/tcard/sqler"
+)
+
+// customerStateRefresh is how often the customer page's state is checked
+// without any appointment event, to follow the delay and the estimated wait.
+const customerStateRefresh = 30 * time.Second
+
+// customerAppointmentState is what the customer page updates live.
+type customerAppointmentState struct {
+	Status       appointmentStatus `json:"status"`
+	CancelReason *string           `json:"cancelReason,omitempty"`
+	DelayMinutes *int              `json:"delayMinutes,omitempty"`
+	// Next is whether no one with an appointment is before this one today.
+	Next  bool           `json:"next"`
+	Queue *queuePosition `json:"queue,omitempty"`
+}
+
+func fetchCustomerAppointmentState(ctx context.Context, db sqler.Queryer, customerLink string) (s customerAppointmentState, businessID string, ok bool, err error) {
+	var appointmentID string
+	var walkIn bool
+	var startedAt, finishedAt, canceledAt, noShowAt *time.Time
+	var lastDelaySecs sql.NullFloat64
+	err = db.QueryRow(ctx, `
+		SELECT
+			a.business_id, a.id, a.walk_in,
+			a.started_at, a.finished_at, a.canceled_at, a.no_show_at, a.cancel_reason,
+			extract(epoch from da.last_delay),
+			a.day = business_day(a.business_id, now()) AND NOT EXISTS (
+				SELECT 1
+				FROM appointments o
+				WHERE
+					o.business_id = a.business_id AND COALESCE(o.resource_id, '') = COALESCE(a.resource_id, '')
+					AND NOT o.walk_in AND (o.start, o.id) < (a.start, a.id)
+					AND o.day = a.day
+					AND o.started_at IS NULL AND o.canceled_at IS NULL AND o.no_show_at IS NULL
+			)
+		FROM
+			appointments a
+			LEFT JOIN delay_alerts da
+				ON a.business_id = da.business_id
+				AND da.resource_id = COALESCE(a.resource_id, '')
+				AND da.last_delay IS NOT NULL
+		WHERE
+			a.customer_link = $1
+		;
+	`, customerLink).Scan(
+		&businessID, &appointmentID, &walkIn,
+		&startedAt, &finishedAt, &canceledAt, &noShowAt, &s.CancelReason,
+		&lastDelaySecs,
+		&s.Next,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, "", false, nil
+	}
+	if err != nil {
+		return s, "", false, fmt.Errorf("fetching appointment state: %w", err)
+	}
+
+	switch {
+	case canceledAt != nil:
+		s.Status = statusCanceled
+	case finishedAt != nil:
+		s.Status = statusFinished
+	case noShowAt != nil:
+		s.Status = statusNoShow
+	case startedAt != nil:
+		s.Status = statusStarted
+	default:
+		s.Status = statusPending
+	}
+	if s.Status != statusPending {
+		s.Next = false
+		return s, businessID, true, nil
+	}
+
+	if walkIn {
+		// Walk-ins have their place in the queue instead.
+		s.Next = false
+		p, ok, err := walkInPosition(ctx, db, businessID, appointmentID)
+		if err != nil {
+			return s, "", false, err
+		}
+		if ok {
+			s.Queue = &p
+		}
+	} else if lastDelaySecs.Valid {
+		m := int(lastDelaySecs.Float64 / 60)
+		s.DelayMinutes = &m
+	}
+
+	return s, businessID, true, nil
+}
+
+// serveCustomerAppointmentEvents streams the state of the appointment with
+// the customer link in the key query parameter, as state Server-Sent Events.
+// The state is sent when connecting and every time it changes.
+func (s server) serveCustomerAppointmentEvents(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+	key := req.URL.Query().Get("key")
+
+	state, businessID, ok, err := fetchCustomerAppointmentState(ctx, s.db, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		http.NotFound(w, req)
+		return nil
+	}
+
+	appointmentEvents, unsubscribe := s.events.subscribe(businessID)
+	defer unsubscribe()
+
+	states := make(chan streamEvent, 1)
+	states <- streamEvent{Name: "state", Data: state}
+	go func() {
+		defer close(states)
+
+		refresh := time.NewTicker(customerStateRefresh)
+		defer refresh.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-appointmentEvents:
+				if !ok {
+					// Fell behind; the client will reconnect.
+					return
+				}
+			case <-refresh.C:
+			}
+
+			newState, _, ok, err := fetchCustomerAppointmentState(ctx, s.db, key)
+			if err != nil {
+				log(ctx).Printf("%s", err)
+				continue
+			}
+			if !ok || reflect.DeepEqual(newState, state) {
+				continue
+			}
+			state = newState
+
+			select {
+			case states <- streamEvent{Name: "state", Data: state}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return streamEvents(ctx, w, states)
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/lib/pq"
+	"github.com/tcard/sqler"
+)
+
+const (
+	maxCustomerTags   = 20
+	maxCustomerTagLen = 50
+)
+
+// A Customer groups the appointments of the same person at a business. They're
+// created from appointments, and matched by phone or email.
+type Customer struct {
+	ID    string   `json:"id"`
+	Name  *string  `json:"name,omitempty"`
+	Phone *string  `json:"phone,omitempty"`
+	Email *string  `json:"email,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+	Tags  []string `json:"tags"`
+	// MarketingConsentAt is when the customer agreed to receive marketing,
+	// or nil if they haven't.
+	MarketingConsentAt *time.Time `json:"marketingConsentAt,omitempty"`
+	CreatedAt          time.Time  `json:"createdAt"`
+}
+
+const customerColumns = `
+	id,
+	name,
+	phone,
+	email,
+	notes,
+	tags,
+	marketing_consent_at,
+	created_at
+`
+
+func scanCustomer(row sqler.Row, c *Customer) error {
+	c.Tags = []string{}
+	return row.Scan(
+		&c.ID,
+		&c.Name,
+		&c.Phone,
+		&c.Email,
+		&c.Notes,
+		pq.Array(&c.Tags),
+		&c.MarketingConsentAt,
+		&c.CreatedAt,
+	)
+}
+
+// normalizeCustomerPhone makes phones comparable regardless of how they were
+// typed.
+func normalizeCustomerPhone(phone string) string {
+	if phone = trimPhone(phone); phone == "" {
+		return ""
+	}
+	return internationalPhone(phone)
+}
+
+func normalizeCustomerEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeTags trims, deduplicates and sorts tags. ok is false if any is too
+// long.
+func normalizeTags(tags []string) (normalized []string, ok bool) {
+	normalized = []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[strings.ToLower(t)] {
+			continue
+		}
+		if len([]rune(t)) > maxCustomerTagLen {
+			return nil, false
+		}
+		seen[strings.ToLower(t)] = true
+		normalized = append(normalized, t)
+	}
+	sort.Strings(normalized)
+	return normalized, true
+}
+
+func fetchCustomer(ctx context.Context, db sqler.Queryer, businessID, customerID string) (Customer, bool, error) {
+	var c Customer
+	row := db.QueryRow(ctx, `
+		SELECT `+customerColumns+`
+		FROM customers
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, customerID)
+	err := scanCustomer(row, &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, fmt.Errorf("fetching customerID=%v: %w", customerID, err)
+	}
+	return c, true, nil
+}
+
+// matchCustomer returns the ID of the business' customer with phone or
+// email, creating it if there's none. Phone takes precedence if they belong
+// to different customers. Missing contact details are filled in on the
+// existing customer, as long as they don't belong to someone else.
+func matchCustomer(ctx context.Context, tx sqler.Tx, businessID, name, phone, email string) (string, error) {
+	phone = normalizeCustomerPhone(phone)
+	email = normalizeCustomerEmail(email)
+
+	customerID, found, err := findCustomer(ctx, tx, businessID, phone, email)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		err := tx.QueryRow(ctx, `
+			INSERT INTO customers
+				(business_id, id, name, phone, email)
+			VALUES
+				($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING
+			RETURNING id
+			;
+		`, businessID, ulidx.New(), nilIfEmpty(name), nilIfEmpty(phone), nilIfEmpty(email)).Scan(&customerID)
+		if err == nil {
+			return customerID, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("inserting customer: %w", err)
+		}
+
+		// Someone else created it meanwhile.
+		customerID, found, err = findCustomer(ctx, tx, businessID, phone, email)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", fmt.Errorf("customer conflicted on insert but wasn't found")
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE customers c SET
+			name = COALESCE(c.name, $3),
+			phone = COALESCE(c.phone, CASE WHEN NOT EXISTS (
+				SELECT 1 FROM customers o WHERE o.business_id = $1 AND o.phone = $4
+			) THEN $4 END),
+			email = COALESCE(c.email, CASE WHEN NOT EXISTS (
+				SELECT 1 FROM customers o WHERE o.business_id = $1 AND o.email = $5
+			) THEN $5 END)
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, customerID, nilIfEmpty(name), nilIfEmpty(phone), nilIfEmpty(email))
+	if err != nil {
+		return "", fmt.Errorf("completing customerID=%v: %w", customerID, err)
+	}
+	return customerID, nil
+}
+
+func findCustomer(ctx context.Context, tx sqler.Tx, businessID, phone, email string) (customerID string, found bool, err error) {
+	err = tx.QueryRow(ctx, `
+		SELECT id
+		FROM customers
+		WHERE
+			business_id = $1 AND (phone = $2 OR email = $3)
+		ORDER BY (phone = $2) IS TRUE DESC
+		LIMIT 1
+		;
+	`, businessID, nilIfEmpty(phone), nilIfEmpty(email)).Scan(&customerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("matching customer: %w", err)
+	}
+	return customerID, true, nil
+}
+
+const customersBackfillBatch = 100
+
+// backfillCustomers links the appointments booked before customers existed
+// to their customers, creating them as needed. Once they're all linked, it
+// does nothing.
+func backfillCustomers(ctx context.Context, db sqler.DB) error {
+	for {
+		linked, err := backfillCustomersBatch(ctx, db)
+		if err != nil {
+			return err
+		}
+		if linked == 0 {
+			return nil
+		}
+		log(ctx).Printf("Linked %d appointments to customers", linked)
+	}
+}
+
+func backfillCustomersBatch(ctx context.Context, db sqler.DB) (linked int, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		type unlinked struct {
+			businessID, id     string
+			name, phone, email string
+		}
+		var apps []unlinked
+		rows, err := tx.Query(ctx, `
+			SELECT business_id, id, COALESCE(name, ''), COALESCE(phone, ''), COALESCE(email, '')
+			FROM appointments
+			WHERE
+				customer_id IS NULL AND (phone IS NOT NULL OR email IS NOT NULL)
+			ORDER BY start
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+			;
+		`, customersBackfillBatch)
+		if err != nil {
+			return false, fmt.Errorf("fetching appointments without customer: %w", err)
+		}
+		for rows.Next() {
+			var a unlinked
+			err := rows.Scan(&a.businessID, &a.id, &a.name, &a.phone, &a.email)
+			if err != nil {
+				rows.Close()
+				return false, fmt.Errorf("scanning row: %w", err)
+			}
+			apps = append(apps, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return false, fmt.Errorf("scanning rows: %w", err)
+		}
+
+		for _, a := range apps {
+			customerID, err := matchCustomer(ctx, tx, a.businessID, a.name, a.phone, a.email)
+			if err != nil {
+				return false, err
+			}
+			_, err = tx.Exec(ctx, `
+				UPDATE appointments SET
+					customer_id = $3
+				WHERE
+					business_id = $1 AND id = $2
+				;
+			`, a.businessID, a.id, customerID)
+			if err != nil {
+				return false, fmt.Errorf("linking appointmentID=%v to customer: %w", a.id, err)
+			}
+		}
+		linked = len(apps)
+		return true, nil
+	})
+	return linked, err
+}
+
+type listCustomersAction struct {
+	// Query matches substrings of the name, phone or email.
+	Query string `json:"query,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	// Cursor is the NextCursor from a previous listing with the same
+	// filters.
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type (
+	// badCursor
+	customers struct {
+		// Customers are sorted by name.
+		Customers  []Customer `json:"customers"`
+		NextCursor string     `json:"nextCursor,omitempty"`
+	}
+)
+
+type customersCursor struct {
+	Name string `json:"n"`
+	ID   string `json:"i"`
+}
+
+func (a listCustomersAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if a.Limit <= 0 {
+		a.Limit = defaultSearchLimit
+	}
+	if a.Limit > maxSearchLimit {
+		a.Limit = maxSearchLimit
+	}
+
+	params := []interface{}{businessID}
+	param := func(v interface{}) string {
+		params = append(params, v)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	where := []string{"business_id = $1"}
+
+	if q := strings.TrimSpace(a.Query); q != "" {
+		cond := "name ILIKE " + param(likeSubstring(q)) + " OR email ILIKE " + param(likeSubstring(q))
+		if phone := trimPhone(q); phone != "" {
+			cond += " OR phone LIKE " + param(likeSubstring(phone))
+		}
+		where = append(where, "("+cond+")")
+	}
+	if a.Tag != "" {
+		where = append(where, param(strings.TrimSpace(a.Tag))+" = ANY(tags)")
+	}
+	if a.Cursor != "" {
+		var cursor customersCursor
+		js, err := base64.RawURLEncoding.DecodeString(a.Cursor)
+		if err == nil {
+			err = json.Unmarshal(js, &cursor)
+		}
+		if err != nil || cursor.ID == "" {
+			return badCursor{}, nil
+		}
+		where = append(where, fmt.Sprintf("(COALESCE(name, ''), id) > (%s, %s)", param(cursor.Name), param(cursor.ID)))
+	}
+
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+customerColumns+`
+		FROM customers
+		WHERE
+			`+strings.Join(where, "\n\t\t\tAND ")+`
+		ORDER BY COALESCE(name, ''), id
+		LIMIT `+param(a.Limit+1)+`
+		;
+	`, params...)
+	if err != nil {
+		return nil, fmt.Errorf("listing customers for businessID=%v: %w", businessID, err)
+	}
+	defer rows.Close()
+
+	result := customers{Customers: []Customer{}}
+	for rows.Next() {
+		var c Customer
+		err := scanCustomer(rows, &c)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		result.Customers = append(result.Customers, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	if len(result.Customers) > a.Limit {
+		result.Customers = result.Customers[:a.Limit]
+		last := result.Customers[a.Limit-1]
+		cursor := customersCursor{ID: last.ID}
+		if last.Name != nil {
+			cursor.Name = *last.Name
+		}
+		js, err := json.Marshal(cursor)
+		if err != nil {
+			panic(err)
+		}
+		result.NextCursor = base64.RawURLEncoding.EncodeToString(js)
+	}
+
+	return result, nil
+}
+
+type customerHistoryAction struct {
+	ID string `json:"id"`
+	// Cursor is the NextCursor from a previous call for the same customer.
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type (
+	// notFound
+	// badCursor
+	customerHistory struct {
+		Customer Customer    `json:"customer"`
+		NoShows  noShowCount `json:"noShows"`
+		// Appointments are sorted by start, latest first.
+		Appointments appointments `json:"appointments"`
+		NextCursor   string       `json:"nextCursor,omitempty"`
+	}
+)
+
+func (a customerHistoryAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	c, ok, err := fetchCustomer(ctx, srv.db, businessID, a.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return notFound{}, nil
+	}
+
+	found, err := searchAppointmentsAction{
+		CustomerID: a.ID,
+		Cursor:     a.Cursor,
+		Limit:      a.Limit,
+	}.serveAction(ctx, srv, businessID)
+	if err != nil {
+		return nil, err
+	}
+	results, ok := found.(searchResults)
+	if !ok {
+		return found, nil
+	}
+
+	var noShows noShowCount
+	err = srv.db.QueryRow(ctx, `
+		SELECT count(*), max(start)
+		FROM appointments
+		WHERE
+			business_id = $1 AND customer_id = $2 AND no_show_at IS NOT NULL
+		;
+	`, businessID, a.ID).Scan(&noShows.Count, &noShows.Last)
+	if err != nil {
+		return nil, fmt.Errorf("counting no-shows for customerID=%v: %w", a.ID, err)
+	}
+
+	return customerHistory{
+		Customer:     c,
+		NoShows:      noShows,
+		Appointments: results.Appointments,
+		NextCursor:   results.NextCursor,
+	}, nil
+}
+
+type updateCustomerAction struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name,omitempty"`
+	Phone string   `json:"phone,omitempty"`
+	Email string   `json:"email,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+	Tags  []string `json:"tags"`
+	// MarketingConsent records whether the customer agrees to receive
+	// marketing. Nil leaves it as it was.
+	MarketingConsent *bool `json:"marketingConsent,omitempty"`
+}
+
+type (
+	// notFound
+	// missingEmailOrPhone
+	badTags          struct{}
+	customerConflict struct {
+		// CustomerID is the other customer with the same phone or email.
+		// They can be merged.
+		CustomerID string `json:"customerId"`
+	}
+	customer Customer
+)
+
+func (a updateCustomerAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Phone = normalizeCustomerPhone(a.Phone)
+	a.Email = normalizeCustomerEmail(a.Email)
+	a.Notes = strings.TrimSpace(a.Notes)
+	if a.Phone == "" && a.Email == "" {
+		return missingEmailOrPhone{}, nil
+	}
+	tags, ok := normalizeTags(a.Tags)
+	if !ok || len(tags) > maxCustomerTags {
+		return badTags{}, nil
+	}
+
+	var conflictID string
+	err := srv.db.QueryRow(ctx, `
+		SELECT id
+		FROM customers
+		WHERE
+			business_id = $1 AND id <> $2 AND (phone = $3 OR email = $4)
+		LIMIT 1
+		;
+	`, businessID, a.ID, nilIfEmpty(a.Phone), nilIfEmpty(a.Email)).Scan(&conflictID)
+	if err == nil {
+		return customerConflict{CustomerID: conflictID}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("checking conflicts for customerID=%v: %w", a.ID, err)
+	}
+
+	var c Customer
+	row := srv.db.QueryRow(ctx, `
+		UPDATE customers SET
+			name = $3,
+			phone = $4,
+			email = $5,
+			notes = $6,
+			tags = $7,
+			marketing_consent_at = CASE
+				WHEN $8 :: boolean IS NULL THEN marketing_consent_at
+				WHEN $8 THEN COALESCE(marketing_consent_at, now())
+			END
+		WHERE
+			business_id = $1 AND id = $2
+		RETURNING `+customerColumns+`
+		;
+	`,
+		businessID, a.ID,
+		nilIfEmpty(a.Name), nilIfEmpty(a.Phone), nilIfEmpty(a.Email),
+		a.Notes, pq.Array(tags),
+		a.MarketingConsent,
+	)
+	err = scanCustomer(row, &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if isUniqueViolation(err) {
+		// Raced with another update; let the client retry to find out with
+		// whom.
+		return customerConflict{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("updating customerID=%v: %w", a.ID, err)
+	}
+
+	return customer(c), nil
+}
+
+type mergeCustomersAction struct {
+	// IntoID is the customer that remains.
+	IntoID string `json:"intoId"`
+	// IDs are the duplicates, which are deleted after moving their
+	// appointments to IntoID.
+	IDs []string `json:"ids"`
+}
+
+type (
+// notFound
+// customer
+)
+
+func (a mergeCustomersAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var ids []string
+	for _, id := range a.IDs {
+		if id != a.IntoID {
+			ids = append(ids, id)
+		}
+	}
+
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	var result interface{}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		into, ok, err := fetchCustomer(ctx, tx, businessID, a.IntoID)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			result = notFound{}
+			return false, nil
+		}
+		if len(ids) == 0 {
+			result = customer(into)
+			return false, nil
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE appointments SET
+				customer_id = $2
+			WHERE
+				business_id = $1 AND customer_id = ANY($3)
+			;
+		`, businessID, a.IntoID, pq.Array(ids))
+		if err != nil {
+			return false, fmt.Errorf("moving appointments: %w", err)
+		}
+
+		rows, err := tx.Query(ctx, `
+			DELETE FROM customers
+			WHERE
+				business_id = $1 AND id = ANY($2)
+			RETURNING `+customerColumns+`
+			;
+		`, businessID, pq.Array(ids))
+		if err != nil {
+			return false, fmt.Errorf("deleting merged customers: %w", err)
+		}
+		var merged []Customer
+		for rows.Next() {
+			var c Customer
+			err := scanCustomer(rows, &c)
+			if err != nil {
+				rows.Close()
+				return false, fmt.Errorf("scanning row: %w", err)
+			}
+			merged = append(merged, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return false, fmt.Errorf("scanning rows: %w", err)
+		}
+		if len(merged) != len(ids) {
+			result = notFound{}
+			return false, nil
+		}
+
+		// Marketing consent isn't carried over; it must have been given
+		// for the customer that remains.
+		tags := into.Tags
+		notes := []string{}
+		if into.Notes != "" {
+			notes = append(notes, into.Notes)
+		}
+		for _, c := range merged {
+			if into.Name == nil {
+				into.Name = c.Name
+			}
+			if into.Phone == nil {
+				into.Phone = c.Phone
+			}
+			if into.Email == nil {
+				into.Email = c.Email
+			}
+			if c.Notes != "" {
+				notes = append(notes, c.Notes)
+			}
+			tags = append(tags, c.Tags...)
+		}
+		tags, _ = normalizeTags(tags)
+		if len(tags) > maxCustomerTags {
+			tags = tags[:maxCustomerTags]
+		}
+
+		row := tx.QueryRow(ctx, `
+			UPDATE customers SET
+				name = $3,
+				phone = $4,
+				email = $5,
+				notes = $6,
+				tags = $7
+			WHERE
+				business_id = $1 AND id = $2
+			RETURNING `+customerColumns+`
+			;
+		`,
+			businessID, a.IntoID,
+			into.Name, into.Phone, into.Email,
+			strings.Join(notes, "\n\n"), pq.Array(tags),
+		)
+		var c Customer
+		err = scanCustomer(row, &c)
+		if err != nil {
+			return false, fmt.Errorf("updating customerID=%v: %w", a.IntoID, err)
+		}
+
+		result = customer(c)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
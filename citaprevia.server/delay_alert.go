@@ -3,23 +3,18 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"sync"
 	"time"
 
-	"github.com/SherClockHolmes/webpush-go"
 	"github.com/tcard/gock"
 	"github.com/tcard/sqler"
 )
 
 func now() time.Time {
-	// return time.Now().UTC()
-	return time.Date(2020, 5, 13,
-		14, 05,
-		0, 0, time.UTC)
+	return time.Now().UTC()
 }
 
 const (
@@ -27,7 +22,10 @@ const (
 	delayAlertThreshold = 5 * time.Minute
 )
 
-func meanDelay(ctx context.Context, db sqler.Queryer, businessID string, sample int) (time.Duration, bool, error) {
+// meanDelay computes the delay of the last sample started appointments for a
+// resource. An empty resourceID stands for appointments without resource.
+// Walk-ins are left out, as they have no scheduled start to be late for.
+func meanDelay(ctx context.Context, db sqler.Queryer, businessID, resourceID string, sample int) (time.Duration, bool, error) {
 	var meanDelaySecs sql.NullFloat64
 	err := db.QueryRow(ctx, `
 		SELECT
@@ -36,31 +34,45 @@ func meanDelay(ctx context.Context, db sqler.Queryer, businessID string, sample
 			SELECT *
 			FROM appointments
 			WHERE
-				business_id = $2 AND started_at IS NOT NULL
-				AND "end" >= ($3 :: date) AND start < ($3 :: date + interval '1' day)
+				business_id = $2 AND started_at IS NOT NULL AND NOT walk_in
+				AND day = business_day($2, $3)
+				AND COALESCE(resource_id, '') = $4
 			ORDER BY started_at DESC
 			LIMIT $1
 		) q
 		;
-	`, sample, businessID, now()).Scan(&meanDelaySecs)
+	`, sample, businessID, now(), resourceID).Scan(&meanDelaySecs)
 	return time.Second * time.Duration(meanDelaySecs.Float64), meanDelaySecs.Valid, err
 }
 
-type delayAlertAction struct{}
+type delayAlertAction struct {
+	ResourceID string `json:"resourceId,omitempty"`
+}
 
 type (
+	// unknownResource
 	ok struct{}
 )
 
 func (a delayAlertAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if a.ResourceID != "" {
+		ok, err := resourceExists(ctx, srv.db, businessID, a.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownResource{}, nil
+		}
+	}
+
 	_, err := srv.db.Exec(ctx, fmt.Sprintf(`
 		INSERT INTO delay_alerts (
-			business_id
+			business_id, resource_id
 		) VALUES (
-			$1
+			$1, $2
 		)
-		ON CONFLICT (business_id) DO NOTHING;
-	`), businessID)
+		ON CONFLICT (business_id, resource_id) DO NOTHING;
+	`), businessID, a.ResourceID)
 	if err != nil {
 		return nil, fmt.Errorf("inserting delay alert: %w", err)
 	}
@@ -100,7 +112,7 @@ func (l *delayAlertLoop) fetch(ctx context.Context) ([]delayState, error) {
 
 	rows, err := l.db.Query(ctx, `
 		SELECT
-			business_id, b.name, checking_started, extract(epoch from last_delay), last_start_cutoff
+			business_id, resource_id, b.name, checking_started, extract(epoch from last_delay), last_start_cutoff
 		FROM delay_alerts da
 		JOIN businesses b ON da.business_id = b.id;
 	`)
@@ -113,7 +125,7 @@ func (l *delayAlertLoop) fetch(ctx context.Context) ([]delayState, error) {
 	for rows.Next() {
 		var s delayState
 		var lastDelaySecs sql.NullFloat64
-		err := rows.Scan(&s.businessID, &s.businessName, &s.checkingStarted, &lastDelaySecs, &s.lastStartCutoff)
+		err := rows.Scan(&s.businessID, &s.resourceID, &s.businessName, &s.checkingStarted, &lastDelaySecs, &s.lastStartCutoff)
 		if err != nil {
 			return nil, fmt.Errorf("scanning alert: %w", err)
 		}
@@ -136,15 +148,17 @@ func (l *delayAlertLoop) runAlerts(ctx context.Context, states []delayState) {
 
 	for _, state := range states {
 		ctx := scope(ctx, "businessID", state.businessID)
+		ctx = scope(ctx, "resourceID", state.resourceID)
 
 		state := state
-		q, ok := l.queues[state.businessID]
+		key := state.queueKey()
+		q, ok := l.queues[key]
 		if ok {
-			l.queues[state.businessID] = append(q, state)
-			return
+			l.queues[key] = append(q, state)
+			continue
 		}
 
-		l.queues[state.businessID] = []delayState{}
+		l.queues[key] = []delayState{}
 
 		go func() {
 			for {
@@ -162,12 +176,12 @@ func (l *delayAlertLoop) runAlerts(ctx context.Context, states []delayState) {
 
 				l.queuesMtx.Lock()
 				defer l.queuesMtx.Unlock()
-				q := l.queues[state.businessID]
+				q := l.queues[key]
 				if len(q) == 0 {
-					delete(l.queues, state.businessID)
+					delete(l.queues, key)
 					return
 				}
-				state, l.queues[state.businessID] = q[0], q[1:]
+				state, l.queues[key] = q[0], q[1:]
 				time.Sleep(1 * time.Minute)
 			}
 		}()
@@ -183,7 +197,7 @@ func (l *delayAlertLoop) runAlert(ctx context.Context, state delayState) error {
 		defer cancel()
 
 		var err error
-		delay, hasDelay, err = meanDelay(ctx, l.db, state.businessID, 1)
+		delay, hasDelay, err = meanDelay(ctx, l.db, state.businessID, state.resourceID, 1)
 		if err != nil {
 			return fmt.Errorf("fetching delay: %w", err)
 		}
@@ -229,15 +243,21 @@ func (l *delayAlertLoop) runAlert(ctx context.Context, state delayState) error {
 		var err error
 		rows, err = l.db.Query(ctx, `
 			SELECT
-				email, phone, push_subscription
-			FROM appointments a
+				a.id, a.customer_link, a.customer_code, a.start, b.time_zone,
+				CASE WHEN a.can_send_emails THEN a.email END, a.phone, a.push_subscription,
+				COALESCE(a.locale, b.locale)
+			FROM
+				appointments a
+				JOIN businesses b ON b.id = a.business_id
 			WHERE
-				business_id = $1
-				AND started_at IS NULL AND finished_at IS NULL and canceled_at IS NULL
-				AND start >= ($2 :: timestamptz)
-				AND start <= ($3 :: timestamptz)
+				a.business_id = $1
+				AND a.started_at IS NULL AND a.finished_at IS NULL and a.canceled_at IS NULL
+				AND a.no_show_at IS NULL AND NOT a.walk_in
+				AND a.start >= ($2 :: timestamptz)
+				AND a.start <= ($3 :: timestamptz)
+				AND COALESCE(a.resource_id, '') = $4
 			;
-		`, state.businessID, start, end)
+		`, state.businessID, start, end, state.resourceID)
 		if err != nil {
 			return fmt.Errorf("selecting appointments: %w", err)
 		}
@@ -251,71 +271,75 @@ func (l *delayAlertLoop) runAlert(ctx context.Context, state delayState) error {
 	var errs error
 
 	for rows.Next() {
+		var appointmentID, customerLink, timeZone string
+		var customerCode int
+		var appointmentStart time.Time
 		var email, phone sql.NullString
 		var pushSubJS []byte
+		var lang locale
 
-		err := rows.Scan(&email, &phone, &pushSubJS)
+		err := rows.Scan(&appointmentID, &customerLink, &customerCode, &appointmentStart, &timeZone, &email, &phone, &pushSubJS, &lang)
 		if err != nil {
 			return fmt.Errorf("scanning appointment: %w", err)
 		}
-		var pushSub *webpush.Subscription
-		if len(pushSubJS) > 0 {
-			json.Unmarshal(pushSubJS, &pushSub)
+		loc, err := loadTimeZone(timeZone)
+		if err != nil {
+			return err
 		}
+		vars := newMessageVars(state.businessName, appointmentStart.In(loc), customerLink, customerCode).withDelay(delay)
 
 		errs = gock.AddConcurrentError(errs, func() error {
-			if pushSub == nil {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			if len(pushSubJS) == 0 {
+				if email.Valid {
+					return enqueueEmail(ctx, l.db, state.businessID, appointmentID, &email.String, delayEmail(lang, state.businessName, hasDelay, delay, customerLink))
+				}
 				// TODO
 				_ = phone
-				_ = email
 				return nil
 			}
 
 			var notif PushNotif
 			if hasDelay {
+				body, err := renderMessage(ctx, l.db, state.businessID, messageDelayPush, lang, vars)
+				if err != nil {
+					return err
+				}
 				notif = PushNotif{
-					Title: fmt.Sprintf(
-						"%s Retraso en tu cita",
+					Title: lang.sprintf(
+						"delay.title",
 						clockEmojiForDelay(delay),
 					),
 					Options: PushOptions{
-						Body: fmt.Sprintf(
-							"Tu cita con %s va con %v de retraso aproximado.",
-							state.businessName, delay.Truncate(time.Minute),
-						),
+						Body: body,
 						Actions: []PushAction{{
 							Action: "go",
-							Title:  "Ver cita",
+							Title:  lang.sprintf("viewAppointment"),
 						}, {
 							Action: "cancel",
-							Title:  "Anular cita",
+							Title:  lang.sprintf("cancelAppointment"),
 						}},
 					},
 				}
 			} else {
 				notif = PushNotif{
-					Title: fmt.Sprintf(
-						"✅ Cita en su hora",
-					),
+					Title: lang.sprintf("onTime.title"),
 					Options: PushOptions{
-						Body: fmt.Sprintf(
-							"Tu cita con %s ya no va con retraso.",
+						Body: lang.sprintf(
+							"onTime.body",
 							state.businessName,
 						),
 						Actions: []PushAction{{
 							Action: "go",
-							Title:  "Ver cita",
+							Title:  lang.sprintf("viewAppointment"),
 						}},
 					},
 				}
 			}
 
-			err := sendPush(pushSub, notif)
-			if err != nil {
-				return fmt.Errorf("sending push notification to %s: %w", pushSub.Endpoint, err)
-			}
-
-			return nil
+			return enqueuePush(ctx, l.db, state.businessID, appointmentID, pushSubJS, notif)
 		}())
 	}
 	if err := rows.Err(); err != nil {
@@ -327,8 +351,8 @@ func (l *delayAlertLoop) runAlert(ctx context.Context, state delayState) error {
 		defer cancel()
 		_, err := l.db.Exec(ctx, `
 				DELETE FROM delay_alerts
-				WHERE business_id = $1;
-			`, state.businessID)
+				WHERE business_id = $1 AND resource_id = $2;
+			`, state.businessID, state.resourceID)
 		if err != nil {
 			return gock.AddConcurrentError(errs, fmt.Errorf("deleting alert: %w", err))
 		}
@@ -342,8 +366,8 @@ func (l *delayAlertLoop) runAlert(ctx context.Context, state delayState) error {
 			checking_started = COALESCE(checking_started, $3),
 			last_delay = $2,
 			last_start_cutoff = $4
-		WHERE business_id = $1;
-	`, state.businessID, delay/time.Second, now(), now().Add(alertWindow))
+		WHERE business_id = $1 AND resource_id = $5;
+	`, state.businessID, delay/time.Second, now(), now().Add(alertWindow), state.resourceID)
 	if err != nil {
 		return gock.AddConcurrentError(errs, fmt.Errorf("updating alert: %w", err))
 	}
@@ -372,8 +396,44 @@ func clockEmojiForDelay(delay time.Duration) string {
 
 type delayState struct {
 	businessID      string
+	resourceID      string
 	businessName    string
 	checkingStarted *time.Time
 	lastDelay       *time.Duration
 	lastStartCutoff *time.Time
 }
+
+func (s delayState) queueKey() string {
+	return s.businessID + "/" + s.resourceID
+}
+
+func delayEmail(l locale, businessName string, hasDelay bool, delay time.Duration, customerLink string) appointmentEmail {
+	if !hasDelay {
+		return appointmentEmail{
+			Subject: l.sprintf("onTime.title"),
+			Paragraphs: []string{l.sprintf(
+				"onTime.body",
+				businessName,
+			)},
+			CustomerLink:   customerLink,
+			Unsubscribable: true,
+			Locale:         l,
+		}
+	}
+	return appointmentEmail{
+		Subject: l.sprintf(
+			"delay.title",
+			clockEmojiForDelay(delay),
+		),
+		Paragraphs: []string{
+			l.sprintf(
+				"delay.body",
+				businessName, delay.Truncate(time.Minute),
+			),
+			l.sprintf("delay.cancelIfCantWait"),
+		},
+		CustomerLink:   customerLink,
+		Unsubscribable: true,
+		Locale:         l,
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// Emails are sent through the SMTP server at CITAPREVIA_SMTP_ADDR. STARTTLS
+// and authentication are used only if the server supports them, so any local
+// SMTP stand-in (MailHog, smtp4dev...) works for testing.
+
+const emailUnsubscribeURL = "https://tengocita.app/unsubscribeEmails?id="
+
+type emailPayload struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+	// UnsubscribeURL, if set, is advertised in the List-Unsubscribe header.
+	UnsubscribeURL string `json:"unsubscribeUrl,omitempty"`
+}
+
+// appointmentEmail is a notification about an appointment, rendered both as
+// plain text and HTML.
+type appointmentEmail struct {
+	Subject      string
+	Paragraphs   []string
+	CustomerLink string
+	// Unsubscribable is whether the email is sent to the customer, who can
+	// opt out of further emails about the appointment.
+	Unsubscribable bool
+	// Link and LinkText, if set, replace the link to the customer page.
+	Link, LinkText string
+	Locale         locale
+}
+
+func (e appointmentEmail) payload() emailPayload {
+	data := struct {
+		appointmentEmail
+		AppointmentURL string
+		UnsubscribeURL string
+	}{
+		appointmentEmail: e,
+		AppointmentURL:   "https://tengocita.app/c/" + e.CustomerLink,
+	}
+	if e.Link != "" {
+		data.AppointmentURL = e.Link
+	}
+	if data.LinkText == "" {
+		data.LinkText = e.Locale.sprintf("viewAppointment")
+	}
+	if e.Unsubscribable {
+		data.UnsubscribeURL = emailUnsubscribeURL + e.CustomerLink
+	}
+
+	var text, html strings.Builder
+	err := emailTextTpl.Execute(&text, data)
+	if err != nil {
+		panic(err)
+	}
+	err = emailHTMLTpl.Execute(&html, data)
+	if err != nil {
+		panic(err)
+	}
+
+	return emailPayload{
+		Subject:        e.Subject,
+		Text:           text.String(),
+		HTML:           html.String(),
+		UnsubscribeURL: data.UnsubscribeURL,
+	}
+}
+
+// enqueueEmail enqueues e to the customer's address, if any.
+func enqueueEmail(ctx context.Context, tx sqler.Queryer, businessID, appointmentID string, email *string, e appointmentEmail) error {
+	if email == nil || *email == "" {
+		return nil
+	}
+	return enqueueNotification(ctx, tx, outboxMessage{
+		BusinessID:    businessID,
+		AppointmentID: appointmentID,
+		Channel:       channelEmail,
+		Recipient:     *email,
+		Payload:       e.payload(),
+	})
+}
+
+var emailTextTpl = texttemplate.Must(texttemplate.New("").Funcs(texttemplate.FuncMap(localeFuncs)).Parse(`{{range .Paragraphs}}{{.}}
+
+{{end}}{{.LinkText}}: {{.AppointmentURL}}
+{{with .UnsubscribeURL}}
+--
+{{t $.Locale "email.unsubscribeText" .}}
+{{end}}`))
+
+var emailHTMLTpl = template.Must(template.New("").Funcs(localeFuncs).Parse(`<!DOCTYPE html>
+<html{{with .Locale}} lang="{{.}}"{{end}}>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Subject}}</title>
+</head>
+<body style="font-family: sans-serif; text-align: center;">
+{{range .Paragraphs}}
+<p>{{.}}</p>
+{{end}}
+<p><a href="{{.AppointmentURL}}" style="display: inline-block; padding: 10px; font-weight: bold;">{{.LinkText}}</a></p>
+{{with .UnsubscribeURL}}
+<p style="font-size: 0.8em; color: #888888;"><a href="{{.}}">{{t $.Locale "email.unsubscribeLink"}}</a></p>
+{{end}}
+</body>
+</html>
+`))
+
+func sendEmail(ctx context.Context, to string, p emailPayload) error {
+	if smtpAddr == "" {
+		log(ctx).Printf("Skipping email to %s: %s", to, p.Subject)
+		return nil
+	}
+
+	msg, err := buildEmail(emailFrom, to, p, time.Now())
+	if err != nil {
+		return permanentError{err}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", smtpAddr)
+	if err != nil {
+		return fmt.Errorf("connecting to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(smtpAddr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return smtpError(err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err := c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return smtpError(err)
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && smtpUsername != "" {
+		err := c.Auth(smtp.PlainAuth("", smtpUsername, smtpPassword, host))
+		if err != nil {
+			return smtpError(err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(emailFrom)
+	err = c.Mail(from.Address)
+	if err != nil {
+		return smtpError(err)
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return smtpError(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return smtpError(err)
+	}
+	return c.Quit()
+}
+
+// smtpError makes permanent SMTP failures (5xx replies, like an unknown
+// recipient) not be retried.
+func smtpError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// buildEmail renders p as a multipart/alternative message.
+func buildEmail(from, to string, p emailPayload, date time.Time) ([]byte, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sender %q: %w", from, err)
+	}
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, fmt.Errorf("parsing recipient %q: %w", to, err)
+	}
+	domain := fromAddr.Address[strings.LastIndex(fromAddr.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+
+	header := [][2]string{
+		{"From", fromAddr.String()},
+		{"To", toAddr.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", p.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", ulidx.New(), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+		{"Auto-Submitted", "auto-generated"},
+	}
+	if p.UnsubscribeURL != "" {
+		header = append(header,
+			[2]string{"List-Unsubscribe", fmt.Sprintf("<%s>, <mailto:%s?subject=unsubscribe>", p.UnsubscribeURL, fromAddr.Address)},
+			[2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+		)
+	}
+
+	var msg bytes.Buffer
+	for _, h := range header {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", p.Text},
+		{"text/html; charset=utf-8", p.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		_, err = qp.Write([]byte(part.body))
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = parts.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Write(buf.Bytes())
+	return msg.Bytes(), nil
+}
+
+func sendOutboxEmail(ctx context.Context, m claimedOutboxMessage) error {
+	var payload emailPayload
+	err := json.Unmarshal(m.Payload, &payload)
+	if err != nil {
+		return permanentError{fmt.Errorf("decoding email payload: %w", err)}
+	}
+	return sendEmail(ctx, m.Recipient, payload)
+}
+
+// unsubscribeEmails stops emails about the appointment whose customer link
+// is the id parameter. Only a POST does, either the one-click one from
+// List-Unsubscribe-Post (RFC 8058) or the one from the confirmation page that
+// a visit shows; link checkers and prefetchers visit links in emails too.
+func (srv server) unsubscribeEmails(w http.ResponseWriter, req *http.Request) error {
+	link := req.URL.Query().Get("id")
+	done := req.Method == http.MethodPost
+	var chosen *locale
+	var fallback locale
+	var err error
+	if done {
+		err = srv.db.QueryRow(req.Context(), `
+			UPDATE appointments a SET
+				can_send_emails = false
+			FROM businesses b
+			WHERE a.customer_link = $1 AND b.id = a.business_id
+			RETURNING a.locale, b.locale
+			;
+		`, link).Scan(&chosen, &fallback)
+	} else {
+		err = srv.db.QueryRow(req.Context(), `
+			SELECT a.locale, b.locale
+			FROM
+				appointments a
+				JOIN businesses b ON b.id = a.business_id
+			WHERE a.customer_link = $1
+			;
+		`, link).Scan(&chosen, &fallback)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, pageLocale(req, nil, defaultLocale).sprintf("badLink"))
+		return nil
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, pageLocale(req, nil, defaultLocale).sprintf("unexpectedError"))
+		return fmt.Errorf("unsubscribing %q from emails: %w", link, err)
+	}
+
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	unsubscribeEmailsTpl.Execute(w, struct {
+		Link   string
+		Done   bool
+		Locale locale
+	}{
+		Link:   link,
+		Done:   done,
+		Locale: pageLocale(req, chosen, fallback),
+	})
+
+	return nil
+}
+
+var unsubscribeEmailsTpl = template.Must(template.New("").Funcs(localeFuncs).Parse(`
+{{if .Done}}
+<p>{{t .Locale "email.unsubscribed"}}</p>
+{{else}}
+<form method="post" action="">
+<p>{{t .Locale "email.unsubscribeConfirm"}}</p>
+<p><input type="submit" value="{{t .Locale "email.unsubscribeSubmit"}}"></p>
+</form>
+{{end}}
+<p><a href="https://tengocita.app/c/{{.Link}}">{{t .Locale "viewAppointment"}}</a></p>
+`))
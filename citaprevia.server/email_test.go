@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts a single message over SMTP, without extensions, and
+// sends it to the returned channel.
+func fakeSMTPServer(t *testing.T) (addr string, received <-chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	msgs := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+
+		c.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				c.PrintfLine("250 OK")
+			case "DATA":
+				c.PrintfLine("354 Go ahead")
+				msg, err := c.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				msgs <- msg
+				c.PrintfLine("250 OK")
+			case "QUIT":
+				c.PrintfLine("221 Bye")
+				return
+			default:
+				c.PrintfLine("502 Unknown command %s", cmd)
+			}
+		}
+	}()
+
+	return l.Addr().String(), msgs
+}
+
+func TestSendEmail(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	defer func(addr, from string) { smtpAddr, emailFrom = addr, from }(smtpAddr, emailFrom)
+	smtpAddr, emailFrom = addr, "TengoCita <noreply@tengocita.app>"
+
+	p := appointmentEmail{
+		Subject:        "Tu cita",
+		Paragraphs:     []string{"Tienes cita el lunes."},
+		CustomerLink:   "abc123",
+		Unsubscribable: true,
+		Locale:         localeES,
+	}.payload()
+
+	err := sendEmail(context.Background(), "customer@example.com", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []byte
+	select {
+	case raw = <-received:
+	default:
+		t.Fatal("the SMTP server didn't receive a message")
+	}
+
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(raw))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantUnsubscribe := "<" + emailUnsubscribeURL + "abc123>, <mailto:noreply@tengocita.app?subject=unsubscribe>"
+	if got := msg.Header.Get("List-Unsubscribe"); got != wantUnsubscribe {
+		t.Errorf("List-Unsubscribe: got %q, want %q", got, wantUnsubscribe)
+	}
+	if got, want := msg.Header.Get("List-Unsubscribe-Post"), "List-Unsubscribe=One-Click"; got != want {
+		t.Errorf("List-Unsubscribe-Post: got %q, want %q", got, want)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type: got %q, want multipart/alternative", mediaType)
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", p.Text},
+		{"text/html; charset=utf-8", p.HTML},
+	} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("reading %s part: %v", want.contentType, err)
+		}
+		if got := part.Header.Get("Content-Type"); got != want.contentType {
+			t.Errorf("part Content-Type: got %q, want %q", got, want.contentType)
+		}
+		// The reader undoes the quoted-printable encoding.
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want.body {
+			t.Errorf("%s part: got %q, want %q", want.contentType, body, want.body)
+		}
+	}
+	if _, err := parts.NextPart(); err == nil {
+		t.Error("got more than two parts")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/tcard/sqler"
+)
+
+// appointmentEventsChannel is the Postgres channel on which the appointments
+// trigger notifies changes. Every server instance listens on it, so a change
+// made through any of them reaches all connected devices.
+const appointmentEventsChannel = "appointment_events"
+
+const (
+	eventsKeepAliveInterval = 30 * time.Second
+	// eventsBuffer is how many events a slow connection may fall behind
+	// before it's closed.
+	eventsBuffer = 32
+)
+
+type appointmentEventType string
+
+const (
+	appointmentCreated  appointmentEventType = "created"
+	appointmentUpdated  appointmentEventType = "updated"
+	appointmentStarted  appointmentEventType = "started"
+	appointmentFinished appointmentEventType = "finished"
+	appointmentCanceled appointmentEventType = "canceled"
+	// appointmentsResync is notified instead of each event when many of a
+	// business' appointments change at once.
+	appointmentsResync appointmentEventType = "resync"
+)
+
+// An AppointmentEvent is streamed to the business app when one of its
+// appointments changes.
+type AppointmentEvent struct {
+	Event       appointmentEventType `json:"event"`
+	Appointment Appointment          `json:"appointment"`
+}
+
+// A streamEvent is a Server-Sent Event. A resync event tells the client that
+// some events may have been lost, and it should fetch everything again.
+type streamEvent struct {
+	Name string
+	Data interface{}
+}
+
+// businessEvents fans out appointment events from Postgres to the business app
+// connections to this server instance.
+type businessEvents struct {
+	db sqler.DB
+
+	mtx  sync.Mutex
+	subs map[string]map[chan streamEvent]struct{}
+}
+
+func newBusinessEvents(db sqler.DB) *businessEvents {
+	return &businessEvents{
+		db:   db,
+		subs: map[string]map[chan streamEvent]struct{}{},
+	}
+}
+
+// subscribe returns the events for businessID, until unsubscribe is called or
+// the channel is closed because the subscriber fell behind.
+func (e *businessEvents) subscribe(businessID string) (events <-chan streamEvent, unsubscribe func()) {
+	c := make(chan streamEvent, eventsBuffer)
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.subs[businessID] == nil {
+		e.subs[businessID] = map[chan streamEvent]struct{}{}
+	}
+	e.subs[businessID][c] = struct{}{}
+
+	return c, func() {
+		e.mtx.Lock()
+		defer e.mtx.Unlock()
+		e.remove(businessID, c)
+	}
+}
+
+func (e *businessEvents) remove(businessID string, c chan streamEvent) {
+	subs := e.subs[businessID]
+	if _, ok := subs[c]; !ok {
+		return
+	}
+	delete(subs, c)
+	close(c)
+	if len(subs) == 0 {
+		delete(e.subs, businessID)
+	}
+}
+
+func (e *businessEvents) hasSubscribers(businessID string) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return len(e.subs[businessID]) > 0
+}
+
+func (e *businessEvents) send(businessID string, ev streamEvent) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for c := range e.subs[businessID] {
+		select {
+		case c <- ev:
+		default:
+			e.remove(businessID, c)
+		}
+	}
+}
+
+func (e *businessEvents) sendAll(ev streamEvent) {
+	e.mtx.Lock()
+	var businessIDs []string
+	for businessID := range e.subs {
+		businessIDs = append(businessIDs, businessID)
+	}
+	e.mtx.Unlock()
+
+	for _, businessID := range businessIDs {
+		e.send(businessID, ev)
+	}
+}
+
+func (e *businessEvents) run() {
+	ctx := context.Background()
+	ctx = scope(ctx, "service", "events")
+
+	l := pq.NewListener(postgresConnString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log(ctx).Printf("Listener event=%v err=%s", ev, err)
+		}
+	})
+	// On error, the listener keeps trying to listen when it reconnects.
+	err := l.Listen(appointmentEventsChannel)
+	if err != nil {
+		log(ctx).Printf("Listening on channel=%s err=%s", appointmentEventsChannel, err)
+	}
+
+	for {
+		select {
+		case n := <-l.Notify:
+			if n == nil {
+				// The connection was reestablished; whatever happened while
+				// it was down was lost.
+				e.sendAll(streamEvent{Name: "resync"})
+				continue
+			}
+			err := e.handle(ctx, n.Extra)
+			if err != nil {
+				log(ctx).Printf("%s", err)
+			}
+		case <-time.After(90 * time.Second):
+			go l.Ping()
+		}
+	}
+}
+
+func (e *businessEvents) handle(ctx context.Context, payload string) error {
+	var n struct {
+		BusinessID    string               `json:"businessId"`
+		AppointmentID string               `json:"appointmentId"`
+		Event         appointmentEventType `json:"event"`
+	}
+	err := json.Unmarshal([]byte(payload), &n)
+	if err != nil {
+		return fmt.Errorf("decoding notification payload=%q: %w", payload, err)
+	}
+	if !e.hasSubscribers(n.BusinessID) {
+		return nil
+	}
+	if n.Event == appointmentsResync {
+		e.send(n.BusinessID, streamEvent{Name: "resync"})
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ev := AppointmentEvent{Event: n.Event}
+	err = scanAppointment(e.db.QueryRow(ctx, `
+		SELECT `+appointmentColumns+`
+		FROM appointments
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, n.BusinessID, n.AppointmentID), &ev.Appointment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching appointment for event businessID=%v appointmentID=%v: %w", n.BusinessID, n.AppointmentID, err)
+	}
+
+	e.send(n.BusinessID, streamEvent{Name: "appointment", Data: ev})
+	return nil
+}
+
+// serveBusinessEvents streams the business' appointment events as
+// Server-Sent Events. Since EventSource can't send a body, the auth token goes
+// in the query string.
+func (s server) serveBusinessEvents(w http.ResponseWriter, req *http.Request) error {
+	action := &businessEventsAction{w: w}
+	resp, err := withBusinessAuth{
+		authToken: req.URL.Query().Get("authToken"),
+		action:    action,
+	}.serveAction(req.Context(), s)
+	if err != nil {
+		return fmt.Errorf("on action=%s: %w", req.URL.Path[1:], err)
+	}
+	if action.streamed {
+		return nil
+	}
+	return writeActionResult(w, req, resp)
+}
+
+type businessEventsAction struct {
+	w        http.ResponseWriter
+	streamed bool
+}
+
+func (a *businessEventsAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	events, unsubscribe := srv.events.subscribe(businessID)
+	defer unsubscribe()
+
+	a.streamed = true
+	return nil, streamEvents(ctx, a.w, events)
+}
+
+// streamEvents writes events as Server-Sent Events until ctx is done or events
+// is closed.
+func streamEvents(ctx context.Context, w http.ResponseWriter, events <-chan streamEvent) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("response writer can't flush")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			err = writeStreamEvent(w, ev)
+		}
+		if err != nil {
+			// The client is gone.
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, ev streamEvent) error {
+	data := []byte("{}")
+	if ev.Data != nil {
+		var err error
+		data, err = json.Marshal(ev.Data)
+		if err != nil {
+			return fmt.Errorf("marshaling event=%s: %w", ev.Name, err)
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, data)
+	return err
+}
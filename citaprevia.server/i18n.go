@@ -0,0 +1,842 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tcard/sqler"
+)
+
+// Customer-facing texts are looked up in messages, in the locale of the
+// appointment. That's the one it was booked in or that the customer's browser
+// asked for when they first opened its page, or else the business' default.
+
+type locale string
+
+const (
+	localeES locale = "es"
+	localeEN locale = "en"
+	localeCA locale = "ca"
+)
+
+// defaultLocale is used for messages missing in a locale.
+const defaultLocale = localeES
+
+func (l locale) valid() bool {
+	switch l {
+	case localeES, localeEN, localeCA:
+		return true
+	default:
+		return false
+	}
+}
+
+// sprintf formats the message for key in l.
+func (l locale) sprintf(key string, args ...interface{}) string {
+	m, ok := messages[key]
+	if !ok {
+		return key
+	}
+	f, ok := m[l]
+	if !ok {
+		f = m[defaultLocale]
+	}
+	return fmt.Sprintf(f, args...)
+}
+
+// when formats the day and time of an appointment.
+func (l locale) when(t time.Time) string {
+	_, m, d := t.Date()
+	return l.sprintf("when", d, m, t.Hour(), t.Minute())
+}
+
+// acceptedLocale returns the supported locale that the client prefers the
+// most, according to its Accept-Language header.
+func acceptedLocale(req *http.Request) (locale, bool) {
+	var best locale
+	var bestQ float64
+	for _, lang := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(lang, ";")
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(p[len("q="):], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if i := strings.IndexAny(tag, "-_"); i >= 0 {
+			tag = tag[:i]
+		}
+		if l := locale(tag); l.valid() && q > bestQ {
+			best, bestQ = l, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// pageLocale is the locale to show a page in: the one chosen for what it's
+// about, if any, or else the one the client prefers, or else fallback.
+func pageLocale(req *http.Request, chosen *locale, fallback locale) locale {
+	if chosen != nil && chosen.valid() {
+		return *chosen
+	}
+	if l, ok := acceptedLocale(req); ok {
+		return l
+	}
+	return fallback
+}
+
+func businessLocale(ctx context.Context, db sqler.Queryer, businessID string) (locale, error) {
+	var l locale
+	err := db.QueryRow(ctx, `
+		SELECT locale FROM businesses WHERE id = $1;
+	`, businessID).Scan(&l)
+	if err != nil {
+		return "", fmt.Errorf("fetching business locale: %w", err)
+	}
+	return l, nil
+}
+
+func appointmentLocale(ctx context.Context, db sqler.Queryer, businessID, appointmentID string) (locale, error) {
+	var l locale
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(a.locale, b.locale)
+		FROM
+			appointments a
+			JOIN businesses b ON b.id = a.business_id
+		WHERE
+			a.business_id = $1 AND a.id = $2
+		;
+	`, businessID, appointmentID).Scan(&l)
+	if err != nil {
+		return "", fmt.Errorf("fetching appointment locale: %w", err)
+	}
+	return l, nil
+}
+
+// customerLocale is the locale of the appointment with customerLink, as seen
+// from req. If none was chosen for the appointment, the one the customer's
+// browser prefers is stored as its locale, so that later messages use it too.
+func customerLocale(ctx context.Context, db sqler.Queryer, req *http.Request, customerLink string) (locale, error) {
+	if l, ok := acceptedLocale(req); ok {
+		_, err := db.Exec(ctx, `
+			UPDATE appointments SET
+				locale = $2
+			WHERE
+				customer_link = $1 AND locale IS NULL
+			;
+		`, customerLink, l)
+		if err != nil {
+			return "", fmt.Errorf("setting locale for appointment customerLink=%v: %w", customerLink, err)
+		}
+	}
+
+	var l locale
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(a.locale, b.locale)
+		FROM
+			appointments a
+			JOIN businesses b ON b.id = a.business_id
+		WHERE
+			a.customer_link = $1
+		;
+	`, customerLink).Scan(&l)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pageLocale(req, nil, defaultLocale), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("fetching locale for appointment customerLink=%v: %w", customerLink, err)
+	}
+	return l, nil
+}
+
+// localeFuncs let templates show messages in the page's locale. tHTML is for
+// messages with markup; its arguments are escaped.
+var localeFuncs = template.FuncMap{
+	"t": func(l locale, key string, args ...interface{}) string {
+		return l.sprintf(key, args...)
+	},
+	"tHTML": func(l locale, key string, args ...interface{}) template.HTML {
+		escaped := make([]interface{}, len(args))
+		for i, arg := range args {
+			escaped[i] = template.HTMLEscapeString(fmt.Sprint(arg))
+		}
+		return template.HTML(l.sprintf(key, escaped...))
+	},
+	"when": func(l locale, t time.Time) string {
+		return l.when(t)
+	},
+}
+
+// messages are format strings, by key and locale. Those for SMS have an
+// escaped %%s for the business name; see smsWithName.
+var messages = map[string]map[locale]string{
+	// Common.
+
+	"when": {
+		localeES: "%d/%d a las %d:%02d",
+		localeEN: "%d/%d at %d:%02d",
+		localeCA: "%d/%d a les %d:%02d",
+	},
+	"reason": {
+		localeES: "Motivo: %s",
+		localeEN: "Reason: %s",
+		localeCA: "Motiu: %s",
+	},
+	"viewAppointment": {
+		localeES: "Ver cita",
+		localeEN: "View appointment",
+		localeCA: "Veure la cita",
+	},
+	"cancelAppointment": {
+		localeES: "Anular cita",
+		localeEN: "Cancel appointment",
+		localeCA: "Anul·lar la cita",
+	},
+	"confirmAttendance": {
+		localeES: "Confirmo que voy",
+		localeEN: "I'll be there",
+		localeCA: "Confirmo que hi aniré",
+	},
+	"youHaveAppointment": {
+		localeES: "Tienes cita con %s el %s.",
+		localeEN: "You have an appointment with %s on %s.",
+		localeCA: "Tens cita amb %s el %s.",
+	},
+	"showQRCode": {
+		localeES: "Cuando llegues, muestra el código QR que encontrarás en el enlace.",
+		localeEN: "When you arrive, show the QR code you'll find in the link.",
+		localeCA: "Quan arribis, mostra el codi QR que trobaràs a l'enllaç.",
+	},
+	"unexpectedError": {
+		localeES: "Ha ocurrido un error inesperado. Inténtalo de nuevo o ponte en contacto con hola@tengocita.app.",
+		localeEN: "An unexpected error happened. Try again or get in touch with hola@tengocita.app.",
+		localeCA: "S'ha produït un error inesperat. Torna-ho a provar o posa't en contacte amb hola@tengocita.app.",
+	},
+	"badLink": {
+		localeES: "Enlace incorrecto. Ponte en contacto con hola@tengocita.app.",
+		localeEN: "Wrong link. Get in touch with hola@tengocita.app.",
+		localeCA: "Enllaç incorrecte. Posa't en contacte amb hola@tengocita.app.",
+	},
+	"name": {
+		localeES: "Nombre",
+		localeEN: "Name",
+		localeCA: "Nom",
+	},
+	"phone": {
+		localeES: "Teléfono",
+		localeEN: "Phone",
+		localeCA: "Telèfon",
+	},
+	"email": {
+		localeES: "Email",
+		localeEN: "Email",
+		localeCA: "Correu electrònic",
+	},
+	"calendar.noShow": {
+		localeES: "No acudió a la cita",
+		localeEN: "Didn't come to the appointment",
+		localeCA: "No va venir a la cita",
+	},
+	"calendar.summary": {
+		localeES: "Cita con %s",
+		localeEN: "Appointment with %s",
+		localeCA: "Cita amb %s",
+	},
+	"comments": {
+		localeES: "Comentarios",
+		localeEN: "Comments",
+		localeCA: "Comentaris",
+	},
+
+	// Emails.
+
+	"email.unsubscribeText": {
+		localeES: "Para dejar de recibir correos sobre esta cita: %s",
+		localeEN: "To stop receiving emails about this appointment: %s",
+		localeCA: "Per deixar de rebre correus sobre aquesta cita: %s",
+	},
+	"email.unsubscribeLink": {
+		localeES: "Dejar de recibir correos sobre esta cita",
+		localeEN: "Stop receiving emails about this appointment",
+		localeCA: "Deixar de rebre correus sobre aquesta cita",
+	},
+	"email.unsubscribeConfirm": {
+		localeES: "¿Quieres dejar de recibir correos sobre esta cita?",
+		localeEN: "Do you want to stop receiving emails about this appointment?",
+		localeCA: "Vols deixar de rebre correus sobre aquesta cita?",
+	},
+	"email.unsubscribeSubmit": {
+		localeES: "Darme de baja",
+		localeEN: "Unsubscribe",
+		localeCA: "Donar-me de baixa",
+	},
+	"email.unsubscribed": {
+		localeES: "Ya no recibirás más correos sobre esta cita.",
+		localeEN: "You won't receive any more emails about this appointment.",
+		localeCA: "Ja no rebràs més correus sobre aquesta cita.",
+	},
+
+	// New appointments.
+
+	"created.sms": {
+		localeES: "Cita el %s con %%s. Muestra tu código aquí: %s",
+		localeEN: "Appointment on %s with %%s. Show your code here: %s",
+		localeCA: "Cita el %s amb %%s. Mostra el teu codi aquí: %s",
+	},
+	"created.subject": {
+		localeES: "📆 Tu cita con %s",
+		localeEN: "📆 Your appointment with %s",
+		localeCA: "📆 La teva cita amb %s",
+	},
+	"created.message": {
+		localeES: "📆 Tienes cita con %s el %s.%s\n\nPara recibir avisos relacionados con tu cita, acepta recibir notificaciones aquí: %s\n\nCuando llegues, muestra el código QR que encontrarás en el enlace.",
+		localeEN: "📆 You have an appointment with %s on %s.%s\n\nTo get notices about your appointment, accept notifications here: %s\n\nWhen you arrive, show the QR code you'll find in the link.",
+		localeCA: "📆 Tens cita amb %s el %s.%s\n\nPer rebre avisos sobre la teva cita, accepta rebre notificacions aquí: %s\n\nQuan arribis, mostra el codi QR que trobaràs a l'enllaç.",
+	},
+	"recurrence": {
+		localeES: "Se repite %s: %d citas hasta el %s.",
+		localeEN: "Repeats %s: %d appointments until %s.",
+		localeCA: "Es repeteix %s: %d cites fins al %s.",
+	},
+	"recurrence.week": {
+		localeES: "cada semana",
+		localeEN: "every week",
+		localeCA: "cada setmana",
+	},
+	"recurrence.weeks": {
+		localeES: "cada %d semanas",
+		localeEN: "every %d weeks",
+		localeCA: "cada %d setmanes",
+	},
+	"recurrence.month": {
+		localeES: "cada mes",
+		localeEN: "every month",
+		localeCA: "cada mes",
+	},
+	"recurrence.months": {
+		localeES: "cada %d meses",
+		localeEN: "every %d months",
+		localeCA: "cada %d mesos",
+	},
+
+	// Walk-ins.
+
+	"queue.sms": {
+		localeES: "Estás en la cola de %%s con el número %d. Sigue tu turno aquí: %s",
+		localeEN: "You're in the queue at %%s with number %d. Follow your turn here: %s",
+		localeCA: "Ets a la cua de %%s amb el número %d. Segueix el teu torn aquí: %s",
+	},
+	"queue.subject": {
+		localeES: "🎫 Estás en la cola de %s",
+		localeEN: "🎫 You're in the queue at %s",
+		localeCA: "🎫 Ets a la cua de %s",
+	},
+	"queue.body": {
+		localeES: "Tienes el número %d en la cola de %s.",
+		localeEN: "You have number %d in the queue at %s.",
+		localeCA: "Tens el número %d a la cua de %s.",
+	},
+	"queue.followInLink": {
+		localeES: "En el enlace puedes ver cuántas personas tienes delante y cuánto falta para tu turno.",
+		localeEN: "In the link you can see how many people are ahead of you and how long until your turn.",
+		localeCA: "A l'enllaç pots veure quantes persones tens davant i quant falta per al teu torn.",
+	},
+	"queue.message": {
+		localeES: "🎫 Tienes el número %d en la cola de %s.\n\nSigue tu turno aquí: %s",
+		localeEN: "🎫 You have number %d in the queue at %s.\n\nFollow your turn here: %s",
+		localeCA: "🎫 Tens el número %d a la cua de %s.\n\nSegueix el teu torn aquí: %s",
+	},
+
+	// Changes and cancellations.
+
+	"updated.title": {
+		localeES: "📆 Cita cambiada",
+		localeEN: "📆 Appointment changed",
+		localeCA: "📆 Cita canviada",
+	},
+	"updated.body": {
+		localeES: "Tu cita con %s ha cambiado al %s.",
+		localeEN: "Your appointment with %s has been moved to %s.",
+		localeCA: "La teva cita amb %s ha canviat al %s.",
+	},
+	"updated.subject": {
+		localeES: "📆 Cita cambiada con %s",
+		localeEN: "📆 Appointment with %s changed",
+		localeCA: "📆 Cita canviada amb %s",
+	},
+	"updated.message": {
+		localeES: "📆 Tu cita con %s ha cambiado al %s. Detalles: %s",
+		localeEN: "📆 Your appointment with %s has been moved to %s. Details: %s",
+		localeCA: "📆 La teva cita amb %s ha canviat al %s. Detalls: %s",
+	},
+	"updatedSeries.title": {
+		localeES: "📆 Citas cambiadas",
+		localeEN: "📆 Appointments changed",
+		localeCA: "📆 Cites canviades",
+	},
+	"updatedSeries.body": {
+		localeES: "Tus citas con %s han cambiado. La próxima es el %s.",
+		localeEN: "Your appointments with %s have changed. The next one is on %s.",
+		localeCA: "Les teves cites amb %s han canviat. La propera és el %s.",
+	},
+	"updatedSeries.subject": {
+		localeES: "📆 Citas cambiadas con %s",
+		localeEN: "📆 Appointments with %s changed",
+		localeCA: "📆 Cites canviades amb %s",
+	},
+	"updatedSeries.message": {
+		localeES: "📆 Tus citas con %s han cambiado. La próxima es el %s. Detalles: %s",
+		localeEN: "📆 Your appointments with %s have changed. The next one is on %s. Details: %s",
+		localeCA: "📆 Les teves cites amb %s han canviat. La propera és el %s. Detalls: %s",
+	},
+	"canceled.title": {
+		localeES: "🚫📆 Cita anulada",
+		localeEN: "🚫📆 Appointment cancelled",
+		localeCA: "🚫📆 Cita anul·lada",
+	},
+	"canceled.body": {
+		localeES: "Tu cita con %s del %s ha sido anulada.",
+		localeEN: "Your appointment with %s on %s has been cancelled.",
+		localeCA: "La teva cita amb %s del %s ha estat anul·lada.",
+	},
+	"canceled.subject": {
+		localeES: "🚫📆 Cita anulada con %s",
+		localeEN: "🚫📆 Appointment with %s cancelled",
+		localeCA: "🚫📆 Cita anul·lada amb %s",
+	},
+	"canceled.message": {
+		localeES: "🚫📆 Anulada tu cita con %s. Detalles: %s",
+		localeEN: "🚫📆 Your appointment with %s has been cancelled. Details: %s",
+		localeCA: "🚫📆 S'ha anul·lat la teva cita amb %s. Detalls: %s",
+	},
+	"canceledSeries.title": {
+		localeES: "🚫📆 Citas anuladas",
+		localeEN: "🚫📆 Appointments cancelled",
+		localeCA: "🚫📆 Cites anul·lades",
+	},
+	"canceledSeries.body": {
+		localeES: "Tus %d citas con %s desde el %s han sido anuladas.",
+		localeEN: "Your %d appointments with %s from %s on have been cancelled.",
+		localeCA: "Les teves %d cites amb %s des del %s han estat anul·lades.",
+	},
+	"canceledSeries.subject": {
+		localeES: "🚫📆 Citas anuladas con %s",
+		localeEN: "🚫📆 Appointments with %s cancelled",
+		localeCA: "🚫📆 Cites anul·lades amb %s",
+	},
+	"canceledSeries.message": {
+		localeES: "🚫📆 %s Detalles: %s",
+		localeEN: "🚫📆 %s Details: %s",
+		localeCA: "🚫📆 %s Detalls: %s",
+	},
+	"rescheduleRejected.title": {
+		localeES: "📆 Cambio de cita no disponible",
+		localeEN: "📆 Appointment change not available",
+		localeCA: "📆 Canvi de cita no disponible",
+	},
+	"rescheduleRejected.body": {
+		localeES: "%s no puede cambiar tu cita. Sigue siendo el %s.",
+		localeEN: "%s can't change your appointment. It's still on %s.",
+		localeCA: "%s no pot canviar la teva cita. Continua sent el %s.",
+	},
+	"reschedule.notAvailable": {
+		localeES: "La cita ya no se puede cambiar.",
+		localeEN: "The appointment can't be changed anymore.",
+		localeCA: "La cita ja no es pot canviar.",
+	},
+	"reschedule.tooManySlots": {
+		localeES: "Elige como mucho %d horas.",
+		localeEN: "Choose %d times at most.",
+		localeCA: "Tria com a molt %d hores.",
+	},
+	"reschedule.noSlots": {
+		localeES: "Elige al menos una hora disponible.",
+		localeEN: "Choose at least one available time.",
+		localeCA: "Tria almenys una hora disponible.",
+	},
+
+	// Reminders and delays.
+
+	"reminder.title": {
+		localeES: "⏰ Recordatorio de tu cita",
+		localeEN: "⏰ Appointment reminder",
+		localeCA: "⏰ Recordatori de la teva cita",
+	},
+	"reminder.sms": {
+		localeES: "Recordatorio: cita con %%s el %s. Detalles: %s",
+		localeEN: "Reminder: appointment with %%s on %s. Details: %s",
+		localeCA: "Recordatori: cita amb %%s el %s. Detalls: %s",
+	},
+	"reminder.subject": {
+		localeES: "⏰ Recordatorio de tu cita con %s",
+		localeEN: "⏰ Reminder of your appointment with %s",
+		localeCA: "⏰ Recordatori de la teva cita amb %s",
+	},
+	"reminder.cancelIfAbsent": {
+		localeES: "Si no puedes acudir, anula la cita desde el enlace para que otra persona pueda aprovechar la hora.",
+		localeEN: "If you can't make it, cancel the appointment from the link so that someone else can take the time.",
+		localeCA: "Si no hi pots anar, anul·la la cita des de l'enllaç perquè una altra persona pugui aprofitar l'hora.",
+	},
+	"delay.title": {
+		localeES: "%s Retraso en tu cita",
+		localeEN: "%s Your appointment is running late",
+		localeCA: "%s Retard en la teva cita",
+	},
+	"delay.body": {
+		localeES: "Tu cita con %s va con %v de retraso aproximado.",
+		localeEN: "Your appointment with %s is running about %v late.",
+		localeCA: "La teva cita amb %s va amb un retard aproximat de %v.",
+	},
+	"delay.cancelIfCantWait": {
+		localeES: "Si no puedes esperar, puedes anular la cita desde el enlace.",
+		localeEN: "If you can't wait, you can cancel the appointment from the link.",
+		localeCA: "Si no pots esperar, pots anul·lar la cita des de l'enllaç.",
+	},
+	"onTime.title": {
+		localeES: "✅ Cita en su hora",
+		localeEN: "✅ Appointment on time",
+		localeCA: "✅ Cita a l'hora",
+	},
+	"onTime.body": {
+		localeES: "Tu cita con %s ya no va con retraso.",
+		localeEN: "Your appointment with %s isn't running late anymore.",
+		localeCA: "La teva cita amb %s ja no va amb retard.",
+	},
+
+	// Booking page and waitlist.
+
+	"booking.title": {
+		localeES: "Pide cita con %s",
+		localeEN: "Book an appointment with %s",
+		localeCA: "Demana cita amb %s",
+	},
+	"booking.chooseTime": {
+		localeES: "Elige una hora",
+		localeEN: "Choose a time",
+		localeCA: "Tria una hora",
+	},
+	"booking.yourDetails": {
+		localeES: "Tus datos",
+		localeEN: "Your details",
+		localeCA: "Les teves dades",
+	},
+	"booking.submit": {
+		localeES: "Pedir cita",
+		localeEN: "Book",
+		localeCA: "Demanar cita",
+	},
+	"booking.noSlots": {
+		localeES: "No hay horas disponibles este día.",
+		localeEN: "There are no times available on this day.",
+		localeCA: "No hi ha hores disponibles aquest dia.",
+	},
+	"booking.tooManyBookings": {
+		localeES: "Has hecho demasiadas reservas. Inténtalo más tarde.",
+		localeEN: "You've made too many bookings. Try again later.",
+		localeCA: "Has fet massa reserves. Torna-ho a provar més tard.",
+	},
+	"booking.badStart": {
+		localeES: "Elige una hora disponible.",
+		localeEN: "Choose an available time.",
+		localeCA: "Tria una hora disponible.",
+	},
+	"booking.missingName": {
+		localeES: "Indica tu nombre.",
+		localeEN: "Tell us your name.",
+		localeCA: "Indica el teu nom.",
+	},
+	"booking.missingEmailOrPhone": {
+		localeES: "Indica tu teléfono o tu email.",
+		localeEN: "Tell us your phone or your email.",
+		localeCA: "Indica el teu telèfon o el teu correu electrònic.",
+	},
+	"booking.tooManyOpen": {
+		localeES: "Ya tienes demasiadas citas pendientes con este negocio.",
+		localeEN: "You already have too many upcoming appointments with this business.",
+		localeCA: "Ja tens massa cites pendents amb aquest negoci.",
+	},
+	"booking.slotTaken": {
+		localeES: "Esa hora ya no está disponible. Elige otra.",
+		localeEN: "That time isn't available anymore. Choose another one.",
+		localeCA: "Aquesta hora ja no està disponible. Tria'n una altra.",
+	},
+	"booking.failed": {
+		localeES: "No se ha podido reservar la cita. Inténtalo de nuevo.",
+		localeEN: "The appointment couldn't be booked. Try again.",
+		localeCA: "No s'ha pogut reservar la cita. Torna-ho a provar.",
+	},
+	"waitlist.join": {
+		localeES: "Apúntate a la lista de espera",
+		localeEN: "Join the waitlist",
+		localeCA: "Apunta't a la llista d'espera",
+	},
+	"waitlist.explain": {
+		localeES: "Si se libera una hora este día, te avisaremos para que puedas reservarla.",
+		localeEN: "If a time frees up on this day, we'll let you know so that you can book it.",
+		localeCA: "Si s'allibera una hora aquest dia, t'avisarem perquè la puguis reservar.",
+	},
+	"waitlist.submit": {
+		localeES: "Apuntarme",
+		localeEN: "Join",
+		localeCA: "Apuntar-me",
+	},
+	"waitlist.joined": {
+		localeES: "✅ Te hemos apuntado a la lista de espera. Si se libera una hora este día, te avisaremos.",
+		localeEN: "✅ You're on the waitlist. If a time frees up on this day, we'll let you know.",
+		localeCA: "✅ T'hem apuntat a la llista d'espera. Si s'allibera una hora aquest dia, t'avisarem.",
+	},
+	"waitlist.failed": {
+		localeES: "No se ha podido apuntarte a la lista de espera. Inténtalo de nuevo.",
+		localeEN: "You couldn't be added to the waitlist. Try again.",
+		localeCA: "No t'hem pogut apuntar a la llista d'espera. Torna-ho a provar.",
+	},
+	"offer.sms": {
+		localeES: "Hueco libre con %%s el %s. Resérvalo antes de las %s: %s",
+		localeEN: "Free time with %%s on %s. Book it before %s: %s",
+		localeCA: "Hora lliure amb %%s el %s. Reserva-la abans de les %s: %s",
+	},
+	"offer.title": {
+		localeES: "Hueco libre con %s",
+		localeEN: "Free time with %s",
+		localeCA: "Hora lliure amb %s",
+	},
+	"offer.subject": {
+		localeES: "📆 Hueco libre con %s",
+		localeEN: "📆 Free time with %s",
+		localeCA: "📆 Hora lliure amb %s",
+	},
+	"offer.body": {
+		localeES: "Se ha quedado libre un hueco con %s el %s.",
+		localeEN: "A time with %s has freed up on %s.",
+		localeCA: "S'ha quedat lliure una hora amb %s el %s.",
+	},
+	"offer.deadline": {
+		localeES: "Si lo quieres, resérvalo antes de las %s. Después se le ofrecerá a la siguiente persona en la lista de espera.",
+		localeEN: "If you want it, book it before %s. After that, it will be offered to the next person on the waitlist.",
+		localeCA: "Si la vols, reserva-la abans de les %s. Després s'oferirà a la següent persona de la llista d'espera.",
+	},
+	"offer.bookBefore": {
+		localeES: "Resérvalo antes de las %s.",
+		localeEN: "Book it before %s.",
+		localeCA: "Reserva-la abans de les %s.",
+	},
+	"offer.book": {
+		localeES: "Reservar",
+		localeEN: "Book",
+		localeCA: "Reservar",
+	},
+	"offer.taken": {
+		localeES: "Lo sentimos, alguien ha reservado ya este hueco.",
+		localeEN: "Sorry, someone has already booked this time.",
+		localeCA: "Ho sentim, algú ja ha reservat aquesta hora.",
+	},
+	"offer.failed": {
+		localeES: "No se ha podido reservar el hueco.",
+		localeEN: "The time couldn't be booked.",
+		localeCA: "No s'ha pogut reservar l'hora.",
+	},
+	"offer.expired": {
+		localeES: "Esta oferta ya no está disponible.",
+		localeEN: "This offer isn't available anymore.",
+		localeCA: "Aquesta oferta ja no està disponible.",
+	},
+
+	// Customer page. Messages ending in HTML have markup the page updates.
+
+	"page.title": {
+		localeES: "Tu cita con %s",
+		localeEN: "Your appointment with %s",
+		localeCA: "La teva cita amb %s",
+	},
+	"page.canceled": {
+		localeES: "Cita cancelada",
+		localeEN: "Appointment cancelled",
+		localeCA: "Cita cancel·lada",
+	},
+	"page.finished": {
+		localeES: "Cita finalizada",
+		localeEN: "Appointment finished",
+		localeCA: "Cita finalitzada",
+	},
+	"page.noShow": {
+		localeES: "No acudiste a la cita",
+		localeEN: "You didn't come to the appointment",
+		localeCA: "No vas venir a la cita",
+	},
+	"page.reason": {
+		localeES: "Motivo:",
+		localeEN: "Reason:",
+		localeCA: "Motiu:",
+	},
+	"page.askPush": {
+		localeES: "¿Quieres recibir avisos sobre tu cita? (Retrasos, anulación...)",
+		localeEN: "Do you want to get notices about your appointment? (Delays, cancellation...)",
+		localeCA: "Vols rebre avisos sobre la teva cita? (Retards, anul·lació...)",
+	},
+	"page.acceptPush": {
+		localeES: "Sí, recibir",
+		localeEN: "Yes, notify me",
+		localeCA: "Sí, rebre'ls",
+	},
+	"page.pushError": {
+		localeES: "Error al suscribirse a avisos sobre la cita. Actualiza la página para reintentarlo.",
+		localeEN: "Couldn't subscribe to notices about the appointment. Reload the page to try again.",
+		localeCA: "Error en subscriure's als avisos sobre la cita. Actualitza la pàgina per tornar-ho a provar.",
+	},
+	"page.confirmCancel": {
+		localeES: "¿Seguro que quieres anular la cita?",
+		localeEN: "Are you sure you want to cancel the appointment?",
+		localeCA: "Segur que vols anul·lar la cita?",
+	},
+	"page.cancelComments": {
+		localeES: "Comentario sobre la anulación (motivo, etc.)",
+		localeEN: "Comment about the cancellation (reason, etc.)",
+		localeCA: "Comentari sobre l'anul·lació (motiu, etc.)",
+	},
+	"page.yesCancel": {
+		localeES: "Sí, anular",
+		localeEN: "Yes, cancel",
+		localeCA: "Sí, anul·lar",
+	},
+	"page.reschedulePending": {
+		localeES: "Has pedido cambiar la hora de tu cita. Te avisaremos cuando %s responda.",
+		localeEN: "You've asked to change the time of your appointment. We'll let you know when %s replies.",
+		localeCA: "Has demanat canviar l'hora de la teva cita. T'avisarem quan %s respongui.",
+	},
+	"page.rescheduleRejected": {
+		localeES: "%s no ha podido cambiar tu cita a las horas que pediste.",
+		localeEN: "%s couldn't move your appointment to the times you asked for.",
+		localeCA: "%s no ha pogut canviar la teva cita a les hores que vas demanar.",
+	},
+	"page.yourTurn": {
+		localeES: "Tu turno: %d",
+		localeEN: "Your number: %d",
+		localeCA: "El teu torn: %d",
+	},
+	"page.next": {
+		localeES: "¡Eres el siguiente!",
+		localeEN: "You're next!",
+		localeCA: "Ets el següent!",
+	},
+	"page.queuePositionHTML": {
+		localeES: `Eres el número <strong id="queue-position-number">%s</strong> de la cola.`,
+		localeEN: `You're number <strong id="queue-position-number">%s</strong> in the queue.`,
+		localeCA: `Ets el número <strong id="queue-position-number">%s</strong> de la cua.`,
+	},
+	"page.queueWaitHTML": {
+		localeES: `Espera estimada: <strong id="queue-wait-minutes">%s</strong> aproximadamente.`,
+		localeEN: `Estimated wait: about <strong id="queue-wait-minutes">%s</strong>.`,
+		localeCA: `Espera estimada: <strong id="queue-wait-minutes">%s</strong> aproximadament.`,
+	},
+	"page.delayHTML": {
+		localeES: `⚠️ Tu cita va con un retraso aproximado de <strong id="delay-minutes">%s</strong>.`,
+		localeEN: `⚠️ Your appointment is running about <strong id="delay-minutes">%s</strong> late.`,
+		localeCA: `⚠️ La teva cita va amb un retard aproximat de <strong id="delay-minutes">%s</strong>.`,
+	},
+	"page.yourAppointment": {
+		localeES: "Tu cita",
+		localeEN: "Your appointment",
+		localeCA: "La teva cita",
+	},
+	"page.showCode": {
+		localeES: "Enseña este código al llegar:",
+		localeEN: "Show this code when you arrive:",
+		localeCA: "Ensenya aquest codi quan arribis:",
+	},
+	"page.sayCode": {
+		localeES: "O di tu código numérico:",
+		localeEN: "Or say your number code:",
+		localeCA: "O digues el teu codi numèric:",
+	},
+	"page.addToCalendar": {
+		localeES: "Añadir al calendario",
+		localeEN: "Add to calendar",
+		localeCA: "Afegeix al calendari",
+	},
+	"page.details": {
+		localeES: "Detalle de la cita",
+		localeEN: "Appointment details",
+		localeCA: "Detall de la cita",
+	},
+	"page.start": {
+		localeES: "%s a las %s",
+		localeEN: "%s at %s",
+		localeCA: "%s a les %s",
+	},
+	"page.arrival": {
+		localeES: "Llegada el %s a las %s",
+		localeEN: "Arrived on %s at %s",
+		localeCA: "Arribada el %s a les %s",
+	},
+	"page.confirmed": {
+		localeES: "✅ Has confirmado que vas a venir.",
+		localeEN: "✅ You've confirmed you're coming.",
+		localeCA: "✅ Has confirmat que vindràs.",
+	},
+	"page.confirm": {
+		localeES: "Confirmar que voy",
+		localeEN: "Confirm I'm coming",
+		localeCA: "Confirmar que hi aniré",
+	},
+	"page.askReschedule": {
+		localeES: "Pedir otra hora",
+		localeEN: "Ask for another time",
+		localeCA: "Demanar una altra hora",
+	},
+	"page.chooseRescheduleSlots": {
+		localeES: "Elige hasta %d horas que te vayan bien:",
+		localeEN: "Choose up to %d times that suit you:",
+		localeCA: "Tria fins a %d hores que et vagin bé:",
+	},
+	"page.optionalComment": {
+		localeES: "Comentario (opcional)",
+		localeEN: "Comment (optional)",
+		localeCA: "Comentari (opcional)",
+	},
+	"page.requestReschedule": {
+		localeES: "Pedir cambio",
+		localeEN: "Ask for the change",
+		localeCA: "Demanar el canvi",
+	},
+	"page.cancel": {
+		localeES: "Anular la cita",
+		localeEN: "Cancel the appointment",
+		localeCA: "Anul·lar la cita",
+	},
+
+	// Promo email pages.
+
+	"promo.unsubscribed": {
+		localeES: "Ya no recibirás más correos promocionales.",
+		localeEN: "You won't receive any more promotional emails.",
+		localeCA: "Ja no rebràs més correus promocionals.",
+	},
+	"promo.resubscribe": {
+		localeES: "Haz clic aquí para volver a suscribirte.",
+		localeEN: "Click here to subscribe again.",
+		localeCA: "Fes clic aquí per tornar a subscriure't.",
+	},
+	"promo.subscribed": {
+		localeES: "Ahora volverás a recibir correos promocionales.",
+		localeEN: "You'll receive promotional emails again.",
+		localeCA: "Ara tornaràs a rebre correus promocionals.",
+	},
+	"promo.unsubscribe": {
+		localeES: "Haz clic aquí para desuscribirte.",
+		localeEN: "Click here to unsubscribe.",
+		localeCA: "Fes clic aquí per donar-te de baixa.",
+	},
+}
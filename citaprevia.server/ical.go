@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/tcard/sqler"
+)
+
+// icalendar builds an iCalendar (RFC 5545) document.
+type icalendar struct {
+	b strings.Builder
+}
+
+// icalEvent is a VEVENT.
+type icalEvent struct {
+	UID string
+	// Sequence must increase each time the event changes, so that calendar
+	// apps replace their copy.
+	Sequence    int
+	Start, End  time.Time
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Status      icalStatus
+	// Alarms are how long before Start to show reminders.
+	Alarms []time.Duration
+}
+
+func newICalendar(name string) *icalendar {
+	c := &icalendar{}
+	c.line("BEGIN", "VCALENDAR")
+	c.line("VERSION", "2.0")
+	c.line("PRODID", "-//TengoCita//TengoCita//ES")
+	c.line("CALSCALE", "GREGORIAN")
+	c.line("METHOD", "PUBLISH")
+	if name != "" {
+		c.line("X-WR-CALNAME", icalText(name))
+	}
+	return c
+}
+
+func (c *icalendar) event(e icalEvent) {
+	c.line("BEGIN", "VEVENT")
+	c.line("UID", icalText(e.UID))
+	c.line("SEQUENCE", fmt.Sprint(e.Sequence))
+	c.line("DTSTAMP", icalTime(now()))
+	c.line("DTSTART", icalTime(e.Start))
+	c.line("DTEND", icalTime(e.End))
+	c.line("SUMMARY", icalText(e.Summary))
+	if e.Description != "" {
+		c.line("DESCRIPTION", icalText(e.Description))
+	}
+	if e.Location != "" {
+		c.line("LOCATION", icalText(e.Location))
+	}
+	if e.URL != "" {
+		c.line("URL", e.URL)
+	}
+	c.line("STATUS", string(e.Status))
+	for _, before := range e.Alarms {
+		c.line("BEGIN", "VALARM")
+		c.line("ACTION", "DISPLAY")
+		c.line("DESCRIPTION", icalText(e.Summary))
+		c.line("TRIGGER", fmt.Sprintf("-PT%dM", int(before/time.Minute)))
+		c.line("END", "VALARM")
+	}
+	c.line("END", "VEVENT")
+}
+
+// done ends the calendar and returns the document.
+func (c *icalendar) done() string {
+	c.line("END", "VCALENDAR")
+	return c.b.String()
+}
+
+// line writes a content line, folded so that no line is longer than 75
+// octets.
+func (c *icalendar) line(name, value string) {
+	l := name + ":" + value
+	for max := 75; len(l) > max; max = 74 {
+		n := max
+		for n > 0 && !utf8.RuneStart(l[n]) {
+			n--
+		}
+		c.b.WriteString(l[:n])
+		c.b.WriteString("\r\n ")
+		l = l[n:]
+	}
+	c.b.WriteString(l)
+	c.b.WriteString("\r\n")
+}
+
+var icalTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`;`, `\;`,
+	`,`, `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// icalText escapes s as a TEXT value.
+func icalText(s string) string {
+	return icalTextEscaper.Replace(s)
+}
+
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+type icalStatus string
+
+const (
+	icalConfirmed icalStatus = "CONFIRMED"
+	icalCancelled icalStatus = "CANCELLED"
+)
+
+// appointmentICalStatus is the STATUS of an appointment's event. VEVENT has
+// no status for events that already happened, so finished appointments stay
+// confirmed; appointments that didn't happen because the customer didn't
+// show up are cancelled, like the ones that were canceled beforehand.
+func appointmentICalStatus(canceledAt, noShowAt *time.Time) icalStatus {
+	if canceledAt != nil || noShowAt != nil {
+		return icalCancelled
+	}
+	return icalConfirmed
+}
+
+const maxCalendarFeedEvents = 1000
+
+// serveCalendarFeed serves the business' upcoming appointments, so that staff
+// can subscribe to them from their calendar apps. The URL has a secret token,
+// as calendar apps can't log in.
+func (srv server) serveCalendarFeed(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	token := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/cal/"), ".ics")
+
+	var businessID, businessName string
+	var l locale
+	err := srv.db.QueryRow(ctx, `
+		SELECT id, COALESCE(name, ''), locale
+		FROM businesses
+		WHERE calendar_feed_token = $1
+		;
+	`, token).Scan(&businessID, &businessName, &l)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching business for calendar feed: %w", err)
+	}
+
+	c, err := businessCalendar(ctx, srv.db, businessID, businessName, l)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/calendar;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, c.done())
+	return nil
+}
+
+func businessCalendar(ctx context.Context, db sqler.Queryer, businessID, businessName string, l locale) (*icalendar, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+appointmentColumns+`, calendar_sequence
+		FROM appointments
+		WHERE
+			business_id = $1 AND "end" >= now()
+		ORDER BY start
+		LIMIT $2
+		;
+	`, businessID, maxCalendarFeedEvents)
+	if err != nil {
+		return nil, fmt.Errorf("fetching appointments for calendar feed: %w", err)
+	}
+	defer rows.Close()
+
+	c := newICalendar("TengoCita: " + businessName)
+	for rows.Next() {
+		var app Appointment
+		var sequence int
+		err := scanAppointment(rowWithExtra{rows, []interface{}{&sequence}}, &app)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		summary := fmt.Sprintf("#%d", app.Number)
+		if app.Name != nil {
+			summary += " " + *app.Name
+		}
+		if app.Service != nil {
+			summary += " (" + app.Service.Name + ")"
+		}
+
+		var description []string
+		if app.Phone != nil {
+			description = append(description, l.sprintf("phone")+": "+*app.Phone)
+		}
+		if app.Email != nil {
+			description = append(description, l.sprintf("email")+": "+*app.Email)
+		}
+		if app.Comments != nil {
+			description = append(description, l.sprintf("comments")+": "+*app.Comments)
+		}
+		if app.CancelReason != nil {
+			description = append(description, l.sprintf("reason", *app.CancelReason))
+		}
+		switch {
+		case app.NoShowAt != nil:
+			description = append(description, l.sprintf("calendar.noShow"))
+		case app.FinishedAt != nil:
+			description = append(description, l.sprintf("page.finished"))
+		}
+
+		c.event(icalEvent{
+			UID:         app.ID + "@tengocita.app",
+			Sequence:    sequence,
+			Start:       app.Start,
+			End:         app.End,
+			Summary:     summary,
+			Description: strings.Join(description, "\n"),
+			Status:      appointmentICalStatus(app.CanceledAt, app.NoShowAt),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+	return c, nil
+}
+
+// rowWithExtra scans the columns after the ones a scan function knows about
+// into extra.
+type rowWithExtra struct {
+	sqler.Row
+	extra []interface{}
+}
+
+func (r rowWithExtra) Scan(dest ...interface{}) error {
+	return r.Row.Scan(append(dest, r.extra...)...)
+}
+
+// defaultCalendarAlarm is for appointments' .ics files when the business
+// doesn't send reminders.
+const defaultCalendarAlarm = time.Hour
+
+// serveAppointmentCalendar serves a customer's appointment as an .ics file, so
+// that they can add it to their calendar. Downloading it again after the
+// appointment changes or is cancelled updates it.
+func (srv server) serveAppointmentCalendar(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	customerLink := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/ics/"), ".ics")
+
+	var e icalEvent
+	var canceledAt, noShowAt *time.Time
+	var businessName string
+	var address *string
+	var leadMinutes []int64
+	var l locale
+	err := srv.db.QueryRow(ctx, `
+		SELECT
+			a.id, a.calendar_sequence, a.start, a."end", a.canceled_at, a.no_show_at,
+			COALESCE(b.name, ''), b.address, b.reminder_lead_minutes,
+			COALESCE(a.locale, b.locale)
+		FROM
+			appointments a
+			JOIN businesses b ON b.id = a.business_id
+		WHERE
+			a.customer_link = $1
+		;
+	`, customerLink).Scan(
+		&e.UID, &e.Sequence, &e.Start, &e.End, &canceledAt, &noShowAt,
+		&businessName, &address, pq.Array(&leadMinutes),
+		&l,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, pageLocale(req, nil, defaultLocale).sprintf("badLink"))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching appointment for calendar: %w", err)
+	}
+
+	link := "https://tengocita.app/c/" + customerLink
+	e.UID += "@tengocita.app"
+	e.Summary = l.sprintf("calendar.summary", businessName)
+	e.Description = l.sprintf("viewAppointment") + ": " + link
+	e.URL = link
+	if address != nil {
+		e.Location = *address
+	}
+	e.Status = appointmentICalStatus(canceledAt, noShowAt)
+	for _, m := range leadMinutes {
+		e.Alarms = append(e.Alarms, time.Duration(m)*time.Minute)
+	}
+	if len(e.Alarms) == 0 {
+		e.Alarms = []time.Duration{defaultCalendarAlarm}
+	}
+
+	c := newICalendar("")
+	c.event(e)
+
+	w.Header().Set("Content-Type", "text/calendar;charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="tengocita.ics"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, c.done())
+	return nil
+}
+
+func appointmentCalendarURL(customerLink string) string {
+	return "https://tengocita.app/ics/" + customerLink + ".ics"
+}
+
+type getCalendarFeedAction struct{}
+
+type (
+	calendarFeed struct {
+		URL string `json:"url"`
+	}
+)
+
+func (a getCalendarFeedAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var token string
+	err := srv.db.QueryRow(ctx, `
+		SELECT calendar_feed_token FROM businesses WHERE id = $1;
+	`, businessID).Scan(&token)
+	if err != nil {
+		return nil, fmt.Errorf("fetching calendar feed token: %w", err)
+	}
+	return calendarFeed{URL: calendarFeedURL(token)}, nil
+}
+
+// rotateCalendarFeedAction replaces the calendar feed's URL, so that whoever
+// had the old one can't see the appointments anymore.
+type rotateCalendarFeedAction struct{}
+
+type (
+// calendarFeed
+)
+
+func (a rotateCalendarFeedAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var token string
+	err := srv.db.QueryRow(ctx, `
+		UPDATE businesses SET
+			calendar_feed_token = base64_web_encode(random_bytea(12))
+		WHERE
+			id = $1
+		RETURNING
+			calendar_feed_token
+		;
+	`, businessID).Scan(&token)
+	if err != nil {
+		return nil, fmt.Errorf("rotating calendar feed token: %w", err)
+	}
+	return calendarFeed{URL: calendarFeedURL(token)}, nil
+}
+
+func calendarFeedURL(token string) string {
+	return "https://tengocita.app/cal/" + token + ".ics"
+}
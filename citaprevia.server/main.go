@@ -1,14 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -16,8 +14,8 @@ import (
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
-	"github.com/SherClockHolmes/webpush-go"
 	"github.com/alexedwards/argon2id"
 	"github.com/avct/uasurfer"
 	"github.com/canastic/ulidx"
@@ -28,13 +26,25 @@ import (
 )
 
 var (
-	serverAddr          = os.Getenv("CITAPREVIA_SERVER_ADDR")
-	postgresConnString  = os.Getenv("CITAPREVIA_POSTGRES_CONNSTRING")
-	authTokenHashKey    = os.Getenv("CITAPREVIA_AUTH_TOKEN_HASH_KEY")
-	authTokenBlockKey   = os.Getenv("CITAPREVIA_AUTH_TOKEN_BLOCK_KEY")
-	smsToKey            = os.Getenv("CITAPREVIA_SMSTO_KEY")
-	pushVAPIDPublicKey  = os.Getenv("CITAPREVIA_PUSH_VAPID_PUBLIC_KEY")
-	pushVAPIDPrivateKey = os.Getenv("CITAPREVIA_PUSH_VAPID_PRIVATE_KEY")
+	serverAddr            = os.Getenv("CITAPREVIA_SERVER_ADDR")
+	postgresConnString    = os.Getenv("CITAPREVIA_POSTGRES_CONNSTRING")
+	authTokenHashKey      = os.Getenv("CITAPREVIA_AUTH_TOKEN_HASH_KEY")
+	authTokenBlockKey     = os.Getenv("CITAPREVIA_AUTH_TOKEN_BLOCK_KEY")
+	smsProviderName       = os.Getenv("CITAPREVIA_SMS_PROVIDER")
+	smsToKey              = os.Getenv("CITAPREVIA_SMSTO_KEY")
+	smsHTTPURL            = os.Getenv("CITAPREVIA_SMS_HTTP_URL")
+	smsHTTPAuthorization  = os.Getenv("CITAPREVIA_SMS_HTTP_AUTHORIZATION")
+	smsDefaultCountryCode = envOr("CITAPREVIA_SMS_DEFAULT_COUNTRY_CODE", "+34")
+	smsStatusBaseURL      = os.Getenv("CITAPREVIA_SMS_STATUS_BASE_URL")
+	smsStatusToken        = os.Getenv("CITAPREVIA_SMS_STATUS_TOKEN")
+	pushVAPIDPublicKey    = os.Getenv("CITAPREVIA_PUSH_VAPID_PUBLIC_KEY")
+	pushVAPIDPrivateKey   = os.Getenv("CITAPREVIA_PUSH_VAPID_PRIVATE_KEY")
+	smsOnNewAppointment   = os.Getenv("CITAPREVIA_SMS_ON_NEW_APPOINTMENT") == "true"
+	smtpAddr              = os.Getenv("CITAPREVIA_SMTP_ADDR")
+	smtpUsername          = os.Getenv("CITAPREVIA_SMTP_USERNAME")
+	smtpPassword          = os.Getenv("CITAPREVIA_SMTP_PASSWORD")
+	emailFrom             = os.Getenv("CITAPREVIA_EMAIL_FROM")
+	trustedProxies        = envOr("CITAPREVIA_TRUSTED_PROXIES", "127.0.0.1,::1")
 )
 
 func main() {
@@ -48,20 +58,54 @@ func main() {
 	}
 	dbx := sqler.WrapDB(db)
 
+	sms, err := newSMSProvider()
+	if err != nil {
+		panic(err)
+	}
+
 	go func() {
 		(&delayAlertLoop{db: dbx}).run()
 	}()
+	go func() {
+		(&reminderLoop{db: dbx}).run()
+	}()
+	go func() {
+		(&noShowLoop{db: dbx}).run()
+	}()
+	go func() {
+		(&waitlistLoop{db: dbx}).run()
+	}()
+	go func() {
+		err := backfillCustomers(scope(ctx, "service", "customersBackfill"), dbx)
+		if err != nil {
+			log(ctx).Printf("Backfilling customers: %s", err)
+		}
+	}()
+	newOutboxLoop(dbx, sms).run()
+
+	events := newBusinessEvents(dbx)
+	go events.run()
+
+	srv := server{
+		db:             dbx,
+		sms:            sms,
+		bookingLimiter: newRateLimiter(bookingsPerIP, bookingsPerIPWindow),
+		events:         events,
+	}
 
 	s := http.Server{
 		Addr:    serverAddr,
-		Handler: server{dbx},
+		Handler: srv,
 	}
 	log(ctx).Printf("Serving at %s", serverAddr)
 	log(ctx).Printf("err=%s", s.ListenAndServe())
 }
 
 type server struct {
-	db sqler.DB
+	db             sqler.DB
+	sms            SMSProvider
+	bookingLimiter *rateLimiter
+	events         *businessEvents
 }
 
 func (s server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -106,6 +150,18 @@ func (s server) serveHTTP(w http.ResponseWriter, req *http.Request) error {
 
 	switch req.URL.Path {
 	default:
+		if strings.HasPrefix(req.URL.Path, "/b/") {
+			return s.serveBookingPage(w, req)
+		}
+		if strings.HasPrefix(req.URL.Path, "/w/") {
+			return s.serveWaitlistOffer(w, req)
+		}
+		if strings.HasPrefix(req.URL.Path, "/cal/") {
+			return s.serveCalendarFeed(w, req)
+		}
+		if strings.HasPrefix(req.URL.Path, "/ics/") {
+			return s.serveAppointmentCalendar(w, req)
+		}
 		landingFileServer.ServeHTTP(w, req)
 		return nil
 	case "/signup":
@@ -114,20 +170,112 @@ func (s server) serveHTTP(w http.ResponseWriter, req *http.Request) error {
 		return s.serveAction(w, req, &loginAction{})
 	case "/listActiveAppointments":
 		return s.serveAction(w, req, &withBusinessAuth{action: &listActiveAppointmentsAction{}})
+	case "/searchAppointments":
+		return s.serveAction(w, req, &withBusinessAuth{action: &searchAppointmentsAction{}})
 	case "/newAppointment":
 		return s.serveAction(w, req, &withBusinessAuth{action: &newAppointmentAction{}})
 	case "/startAppointment":
 		return s.serveAction(w, req, &withBusinessAuth{action: &startAppointmentAction{}})
 	case "/finishAppointment":
 		return s.serveAction(w, req, &withBusinessAuth{action: &finishAppointmentAction{}})
+	case "/updateAppointment":
+		return s.serveAction(w, req, &withBusinessAuth{action: &updateAppointmentAction{}})
 	case "/cancelAppointment":
 		return s.serveAction(w, req, &withBusinessAuth{action: &cancelAppointmentAction{}})
+	case "/listServices":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listServicesAction{}})
+	case "/newService":
+		return s.serveAction(w, req, &withBusinessAuth{action: &newServiceAction{}, roles: ownerOnly})
+	case "/updateService":
+		return s.serveAction(w, req, &withBusinessAuth{action: &updateServiceAction{}, roles: ownerOnly})
+	case "/deleteService":
+		return s.serveAction(w, req, &withBusinessAuth{action: &deleteServiceAction{}, roles: ownerOnly})
+	case "/listResources":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listResourcesAction{}})
+	case "/newResource":
+		return s.serveAction(w, req, &withBusinessAuth{action: &newResourceAction{}, roles: ownerOnly})
+	case "/updateResource":
+		return s.serveAction(w, req, &withBusinessAuth{action: &updateResourceAction{}, roles: ownerOnly})
+	case "/deleteResource":
+		return s.serveAction(w, req, &withBusinessAuth{action: &deleteResourceAction{}, roles: ownerOnly})
+	case "/getOpeningHours":
+		return s.serveAction(w, req, &withBusinessAuth{action: &getOpeningHoursAction{}})
+	case "/setOpeningHours":
+		return s.serveAction(w, req, &withBusinessAuth{action: &setOpeningHoursAction{}, roles: ownerOnly})
+	case "/newOpeningException":
+		return s.serveAction(w, req, &withBusinessAuth{action: &newOpeningExceptionAction{}, roles: ownerOnly})
+	case "/deleteOpeningException":
+		return s.serveAction(w, req, &withBusinessAuth{action: &deleteOpeningExceptionAction{}, roles: ownerOnly})
+	case "/availableSlots":
+		return s.serveAction(w, req, &withBusinessAuth{action: &availableSlotsAction{}})
+	case "/getReminders":
+		return s.serveAction(w, req, &withBusinessAuth{action: &getRemindersAction{}})
+	case "/setReminders":
+		return s.serveAction(w, req, &withBusinessAuth{action: &setRemindersAction{}, roles: ownerOnly})
+	case "/listRescheduleRequests":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listRescheduleRequestsAction{}})
+	case "/acceptRescheduleRequest":
+		return s.serveAction(w, req, &withBusinessAuth{action: &acceptRescheduleRequestAction{}})
+	case "/rejectRescheduleRequest":
+		return s.serveAction(w, req, &withBusinessAuth{action: &rejectRescheduleRequestAction{}})
+	case "/markNoShow":
+		return s.serveAction(w, req, &withBusinessAuth{action: &markNoShowAction{}})
+	case "/countNoShows":
+		return s.serveAction(w, req, &withBusinessAuth{action: &countNoShowsAction{}})
+	case "/getNoShowGracePeriod":
+		return s.serveAction(w, req, &withBusinessAuth{action: &getNoShowGracePeriodAction{}})
+	case "/setNoShowGracePeriod":
+		return s.serveAction(w, req, &withBusinessAuth{action: &setNoShowGracePeriodAction{}, roles: ownerOnly})
+	case "/listCustomers":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listCustomersAction{}})
+	case "/customerHistory":
+		return s.serveAction(w, req, &withBusinessAuth{action: &customerHistoryAction{}})
+	case "/updateCustomer":
+		return s.serveAction(w, req, &withBusinessAuth{action: &updateCustomerAction{}})
+	case "/mergeCustomers":
+		return s.serveAction(w, req, &withBusinessAuth{action: &mergeCustomersAction{}})
+	case "/addToWaitlist":
+		return s.serveAction(w, req, &withBusinessAuth{action: &addToWaitlistAction{}})
+	case "/listWaitlist":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listWaitlistAction{}})
+	case "/removeFromWaitlist":
+		return s.serveAction(w, req, &withBusinessAuth{action: &removeFromWaitlistAction{}})
+	case "/newWalkIn":
+		return s.serveAction(w, req, &withBusinessAuth{action: &newWalkInAction{}})
+	case "/listQueue":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listQueueAction{}})
+	case "/getMessageTemplates":
+		return s.serveAction(w, req, &withBusinessAuth{action: &getMessageTemplatesAction{}})
+	case "/setMessageTemplate":
+		return s.serveAction(w, req, &withBusinessAuth{action: &setMessageTemplateAction{}, roles: ownerOnly})
+	case "/previewMessageTemplate":
+		return s.serveAction(w, req, &withBusinessAuth{action: &previewMessageTemplateAction{}})
+	case "/getCalendarFeed":
+		return s.serveAction(w, req, &withBusinessAuth{action: &getCalendarFeedAction{}})
+	case "/rotateCalendarFeed":
+		return s.serveAction(w, req, &withBusinessAuth{action: &rotateCalendarFeedAction{}, roles: ownerOnly})
 	case "/configureBusiness":
-		return s.serveAction(w, req, &withBusinessAuth{action: &configureBusinessAction{}})
+		return s.serveAction(w, req, &withBusinessAuth{action: &configureBusinessAction{}, roles: ownerOnly})
+	case "/listStaff":
+		return s.serveAction(w, req, &withBusinessAuth{action: &listStaffAction{}})
+	case "/inviteStaff":
+		return s.serveAction(w, req, &withBusinessAuth{action: &inviteStaffAction{}, roles: ownerOnly})
+	case "/updateStaff":
+		return s.serveAction(w, req, &withBusinessAuth{action: &updateStaffAction{}, roles: ownerOnly})
+	case "/disableStaff":
+		return s.serveAction(w, req, &withBusinessAuth{action: &disableStaffAction{}, roles: ownerOnly})
+	case "/removeStaff":
+		return s.serveAction(w, req, &withBusinessAuth{action: &removeStaffAction{}, roles: ownerOnly})
+	case "/acceptStaffInvite":
+		return s.serveAction(w, req, &acceptStaffInviteAction{})
+	case "/businessEvents":
+		return s.serveBusinessEvents(w, req)
 	case "/delayAlert":
 		return s.serveAction(w, req, &withBusinessAuth{action: &delayAlertAction{}})
 	case "/customerAppointment":
 		return s.serveCustomerAppointment(w, req)
+	case "/customerAppointmentEvents":
+		return s.serveCustomerAppointmentEvents(w, req)
 	case "/customer-service-worker.js":
 		http.ServeContent(w, req, "customer-service-worker.js", time.Time{}, strings.NewReader(customerServiceWorkerJS))
 		return nil
@@ -137,6 +285,10 @@ func (s server) serveHTTP(w http.ResponseWriter, req *http.Request) error {
 		return s.unsubscribePromoEmails(w, req)
 	case "/subscribePromoEmails":
 		return s.subscribePromoEmails(w, req)
+	case "/unsubscribeEmails":
+		return s.unsubscribeEmails(w, req)
+	case "/smsStatus":
+		return s.serveSMSStatus(w, req)
 	}
 }
 
@@ -147,9 +299,16 @@ type httpAction interface {
 type withBusinessAuth struct {
 	authToken string
 	action    httpBusinessAction
+
+	// roles, if not empty, are the only staff roles allowed to perform the
+	// action.
+	roles []staffRole
 }
 
-type invalidAuthToken struct{}
+type (
+	invalidAuthToken struct{}
+	forbidden        struct{}
+)
 
 func (a *withBusinessAuth) UnmarshalJSON(js []byte) error {
 	err := json.Unmarshal(js, &struct {
@@ -168,15 +327,19 @@ func (a withBusinessAuth) serveAction(ctx context.Context, s server) (interface{
 		return invalidAuthToken{}, nil
 	}
 	var businessID string
+	var staff StaffMember
 	err = s.db.QueryRow(ctx, `
-		UPDATE business_sessions
+		UPDATE business_sessions bs
 		SET
 			last_used = now() at time zone 'utc'
+		FROM staff s
 		WHERE
-			id = $1
-		RETURNING business_id
+			bs.id = $1
+			AND s.business_id = bs.business_id AND s.id = bs.staff_id
+			AND s.disabled_at IS NULL
+		RETURNING bs.business_id, s.id, s.role
 		;
-	`, sessionAuth.SessionID).Scan(&businessID)
+	`, sessionAuth.SessionID).Scan(&businessID, &staff.ID, &staff.Role)
 	if errors.Is(err, sql.ErrNoRows) {
 		return invalidAuthToken{}, nil
 	}
@@ -185,6 +348,14 @@ func (a withBusinessAuth) serveAction(ctx context.Context, s server) (interface{
 	}
 
 	ctx = scope(ctx, "businessID", businessID)
+	ctx = scope(ctx, "staffID", staff.ID)
+
+	if !staff.Role.in(a.roles) {
+		log(ctx).Printf("Forbidden for role=%s", staff.Role)
+		return forbidden{}, nil
+	}
+
+	ctx = withStaff(ctx, staff)
 
 	result, err := a.action.serveAction(ctx, s, businessID)
 	if err != nil {
@@ -212,7 +383,11 @@ func (s server) serveAction(w http.ResponseWriter, req *http.Request, action htt
 		return fmt.Errorf("on action=%s: %w", req.URL.Path[1:], err)
 	}
 
-	err = json.NewEncoder(w).Encode(struct {
+	return writeActionResult(w, req, resp)
+}
+
+func writeActionResult(w http.ResponseWriter, req *http.Request, resp interface{}) error {
+	err := json.NewEncoder(w).Encode(struct {
 		Result  string      `json:"result"`
 		Payload interface{} `json:"payload,omitempty"`
 	}{
@@ -241,7 +416,8 @@ type (
 	badPromoCode        struct{}
 	signedUp            struct {
 		Business
-		AuthToken string `json:"authToken"`
+		Staff     StaffMember `json:"staff"`
+		AuthToken string      `json:"authToken"`
 	}
 )
 
@@ -281,20 +457,47 @@ func (a signupAction) serveAction(ctx context.Context, srv server) (interface{},
 	if phone.Valid {
 		business.Phone = &phone.String
 	}
+	staff := StaffMember{
+		ID:    ulidx.New(),
+		Email: business.Email,
+		Phone: business.Phone,
+		Role:  roleOwner,
+	}
 
-	_, err = srv.db.Exec(ctx, `
-		INSERT INTO businesses
-			(id, email, phone, password, last_login, signup_promo_code)
-		VALUES
-			($1, $2, $3, $4, now() at time zone 'utc', $5)
-	`, id, email, phone, hashedPassword, nilIfEmpty(a.PromoCode))
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO businesses
+				(id, email, phone, last_login, signup_promo_code)
+			VALUES
+				($1, $2, $3, now() at time zone 'utc', $4)
+		`, id, email, phone, nilIfEmpty(a.PromoCode))
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO staff
+				(business_id, id, email, phone, password, role)
+			VALUES
+				($1, $2, $3, $4, $5, $6)
+		`, id, staff.ID, email, phone, hashedPassword, staff.Role)
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
 
 	var authToken string
 	if isUniqueViolation(err) {
 		// Graceful retry after newSession failure: attempt login.
 		var err error
 		var ok bool
-		authToken, business, ok, err = srv.login(ctx, a.EmailOrPhone, a.Password)
+		authToken, business, staff, ok, err = srv.login(ctx, a.EmailOrPhone, a.Password)
 		if err != nil {
 			return nil, fmt.Errorf("logging in: %w", err)
 		}
@@ -307,7 +510,7 @@ func (a signupAction) serveAction(ctx context.Context, srv server) (interface{},
 		log(ctx).Printf("Signed up businessID=%s", id)
 
 		var err error
-		authToken, err = srv.newSession(ctx, id)
+		authToken, err = srv.newSession(ctx, id, staff.ID)
 		if err != nil {
 			return nil, fmt.Errorf("creating session: %w", err)
 		}
@@ -316,6 +519,7 @@ func (a signupAction) serveAction(ctx context.Context, srv server) (interface{},
 	return signedUp{
 		AuthToken: authToken,
 		Business:  business,
+		Staff:     staff,
 	}, nil
 }
 
@@ -328,15 +532,22 @@ type (
 	badCredentials struct{}
 	loggedIn       struct {
 		Business
-		AuthToken string `json:"authToken"`
+		Staff     StaffMember `json:"staff"`
+		AuthToken string      `json:"authToken"`
 	}
 )
 
 type Business struct {
-	Name    *string `json:"name,omitempty"`
-	Email   *string `json:"email,omitempty"`
-	Phone   *string `json:"phone,omitempty"`
-	Address *string `json:"address,omitempty"`
+	Name        *string `json:"name,omitempty"`
+	Email       *string `json:"email,omitempty"`
+	Phone       *string `json:"phone,omitempty"`
+	Address     *string `json:"address,omitempty"`
+	Slug        *string `json:"slug,omitempty"`
+	SelfBooking bool    `json:"selfBooking"`
+	// TimeZone is an IANA time zone name, like "Europe/Madrid".
+	TimeZone string `json:"timeZone"`
+	// Locale is the default language of messages to customers.
+	Locale locale `json:"locale"`
 }
 
 func (a loginAction) serveAction(ctx context.Context, srv server) (interface{}, error) {
@@ -350,7 +561,7 @@ func (a loginAction) serveAction(ctx context.Context, srv server) (interface{},
 		return missingPassword{}, nil
 	}
 
-	authToken, business, ok, err := srv.login(ctx, a.EmailOrPhone, a.Password)
+	authToken, business, staff, ok, err := srv.login(ctx, a.EmailOrPhone, a.Password)
 	if err != nil {
 		return nil, fmt.Errorf("logging in: %w", err)
 	}
@@ -360,12 +571,14 @@ func (a loginAction) serveAction(ctx context.Context, srv server) (interface{},
 	return loggedIn{
 		AuthToken: authToken,
 		Business:  business,
+		Staff:     staff,
 	}, nil
 }
 
 type listActiveAppointmentsAction struct {
-	Start time.Time `json:"start"`
-	End   time.Time `json:"end"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	ResourceID string    `json:"resourceId,omitempty"`
 }
 
 type (
@@ -375,17 +588,94 @@ type (
 )
 
 type Appointment struct {
-	ID         string     `json:"id"`
-	Number     int        `json:"number"`
-	Start      time.Time  `json:"start"`
-	End        time.Time  `json:"end"`
-	Phone      *string    `json:"phone,omitempty"`
-	Email      *string    `json:"email,omitempty"`
-	Name       *string    `json:"name,omitempty"`
-	Comments   *string    `json:"comments,omitempty"`
-	StartedAt  *time.Time `json:"startedAt,omitempty"`
-	FinishedAt *time.Time `json:"finishedAt,omitempty"`
-	CanceledAt *time.Time `json:"canceledAt,omitempty"`
+	ID        string     `json:"id"`
+	Number    int        `json:"number"`
+	Start     time.Time  `json:"start"`
+	End       time.Time  `json:"end"`
+	Phone     *string    `json:"phone,omitempty"`
+	Email     *string    `json:"email,omitempty"`
+	Name      *string    `json:"name,omitempty"`
+	Comments  *string    `json:"comments,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	NoShowAt  *time.Time `json:"noShowAt,omitempty"`
+	// ConfirmedAt is when the customer confirmed they'll attend.
+	ConfirmedAt *time.Time `json:"confirmedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	CanceledAt  *time.Time `json:"canceledAt,omitempty"`
+	// CancelReason is why the appointment was canceled, by the customer or the
+	// business, if they said.
+	CancelReason *string  `json:"cancelReason,omitempty"`
+	Service      *Service `json:"service,omitempty"`
+	ResourceID   *string  `json:"resourceId,omitempty"`
+	CustomerID   *string  `json:"customerId,omitempty"`
+	SeriesID     *string  `json:"seriesId,omitempty"`
+	// SMSStatus is the delivery status of the last SMS sent to the
+	// customer, if any.
+	SMSStatus *smsStatus `json:"smsStatus,omitempty"`
+}
+
+// appointmentColumns are the columns scanAppointment expects, in order.
+const appointmentColumns = `
+	id,
+	number,
+	start,
+	"end",
+	phone,
+	email,
+	name,
+	comments,
+	started_at,
+	no_show_at,
+	confirmed_at,
+	finished_at,
+	canceled_at,
+	cancel_reason,
+	` + serviceJSONColumn + `,
+	resource_id,
+	customer_id,
+	series_id,
+	(
+		SELECT m.status
+		FROM sms_messages m
+		WHERE m.business_id = appointments.business_id AND m.appointment_id = appointments.id
+		ORDER BY m.created_at DESC
+		LIMIT 1
+	)
+`
+
+func scanAppointment(row sqler.Row, app *Appointment) error {
+	var serviceJS []byte
+	err := row.Scan(
+		&app.ID,
+		&app.Number,
+		&app.Start,
+		&app.End,
+		&app.Phone,
+		&app.Email,
+		&app.Name,
+		&app.Comments,
+		&app.StartedAt,
+		&app.NoShowAt,
+		&app.ConfirmedAt,
+		&app.FinishedAt,
+		&app.CanceledAt,
+		&app.CancelReason,
+		&serviceJS,
+		&app.ResourceID,
+		&app.CustomerID,
+		&app.SeriesID,
+		&app.SMSStatus,
+	)
+	if err != nil {
+		return err
+	}
+	if len(serviceJS) > 0 {
+		err = json.Unmarshal(serviceJS, &app.Service)
+		if err != nil {
+			return fmt.Errorf("decoding service: %w", err)
+		}
+	}
+	return nil
 }
 
 func (a listActiveAppointmentsAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
@@ -397,21 +687,14 @@ func (a listActiveAppointmentsAction) serveAction(ctx context.Context, srv serve
 	}
 
 	rows, err := srv.db.Query(ctx, `
-		SELECT
-			id,
-			number,
-			start,
-			"end",
-			phone,
-			email,
-			name,
-			started_at
+		SELECT `+appointmentColumns+`
 		FROM appointments
 		WHERE
 			business_id = $1 AND "end" >= $2 AND start < $3
-			AND canceled_at IS NULL AND finished_at IS NULL
+			AND canceled_at IS NULL AND finished_at IS NULL AND no_show_at IS NULL
+			AND ($4 = '' OR resource_id = $4)
 		;
-	`, businessID, a.Start, a.End)
+	`, businessID, a.Start, a.End, a.ResourceID)
 	if err != nil {
 		return nil, fmt.Errorf("fetching appointments for businessID=%v start=%v end=%v: %w", businessID, a.Start, a.End, err)
 	}
@@ -421,16 +704,7 @@ func (a listActiveAppointmentsAction) serveAction(ctx context.Context, srv serve
 
 	for rows.Next() {
 		var app Appointment
-		err := rows.Scan(
-			&app.ID,
-			&app.Number,
-			&app.Start,
-			&app.End,
-			&app.Phone,
-			&app.Email,
-			&app.Name,
-			&app.StartedAt,
-		)
+		err := scanAppointment(rows, &app)
 		if err != nil {
 			return nil, fmt.Errorf("scanning row: %w", err)
 		}
@@ -444,35 +718,136 @@ func (a listActiveAppointmentsAction) serveAction(ctx context.Context, srv serve
 }
 
 type newAppointmentAction struct {
-	Start     time.Time `json:"start"`
-	End       time.Time `json:"end"`
-	Phone     string    `json:"phone,omitempty"`
-	Email     string    `json:"email,omitempty"`
-	Name      string    `json:"name,omitempty"`
-	Commments string    `json:"comments,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Phone      string    `json:"phone,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Commments  string    `json:"comments,omitempty"`
+	ServiceID  string    `json:"serviceId,omitempty"`
+	ResourceID string    `json:"resourceId,omitempty"`
+	// CustomerID books for an existing customer, whose contact details are
+	// used if Phone and Email are empty. If not set, the customer is matched
+	// by phone or email, or created.
+	CustomerID string `json:"customerId,omitempty"`
+	// Recurrence creates a series of appointments like this one, each with
+	// its own customer link and number.
+	Recurrence *Recurrence `json:"recurrence,omitempty"`
+	// Locale is the language of the messages to the customer. Defaults to
+	// the business' one.
+	Locale locale `json:"locale,omitempty"`
+
+	// waitlistOfferID is the offer being claimed, if any. It's claimed in
+	// the same transaction that creates the appointment.
+	waitlistOfferID string
+	// maxOpenBookings, if set, is how many upcoming appointments the
+	// customer can have by phone or email. It's checked in the same
+	// transaction that creates the appointment.
+	maxOpenBookings int
 }
 
 type (
 	// missingEmailOrPhone struct{}
 	// missingStart struct{}
-	created struct {
+	// outsideOpeningHours struct{}
+	// slotTaken struct{}
+	// occurrenceNotBookable struct{}
+	// badLocale struct{}
+	unknownService      struct{}
+	unknownResource     struct{}
+	unknownCustomer     struct{}
+	badRecurrence       struct{}
+	offerExpired        struct{}
+	tooManyOpenBookings struct{}
+	created             struct {
+		// CustomerLink is for the first appointment in a series.
+		CustomerLink    string `json:"customerLink"`
 		CustomerMessage string `json:"customerMessage,omitempty"`
+		SeriesID        string `json:"seriesId,omitempty"`
+		// Occurrences are the starts of each appointment in a series.
+		Occurrences []time.Time `json:"occurrences,omitempty"`
+		// NoShows are the customer's previous no-shows, if any.
+		NoShows *noShowCount `json:"noShows,omitempty"`
 	}
 )
 
 func (a newAppointmentAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
 	a.Phone = trimPhone(a.Phone)
 	a.Email = strings.TrimSpace(a.Email)
+	if a.CustomerID != "" {
+		c, ok, err := fetchCustomer(ctx, srv.db, businessID, a.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownCustomer{}, nil
+		}
+		if a.Phone == "" && a.Email == "" && c.Phone != nil {
+			a.Phone = *c.Phone
+		}
+		if a.Phone == "" && a.Email == "" && c.Email != nil {
+			a.Email = *c.Email
+		}
+		if strings.TrimSpace(a.Name) == "" && c.Name != nil {
+			a.Name = *c.Name
+		}
+	}
 	if a.Phone == "" && a.Email == "" {
 		return missingEmailOrPhone{}, nil
 	}
 	if a.Start.IsZero() {
 		return missingStart{}, nil
 	}
+	if a.ServiceID != "" {
+		duration, ok, err := serviceDuration(ctx, srv.db, businessID, a.ServiceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownService{}, nil
+		}
+		if a.End.IsZero() {
+			a.End = a.Start.Add(duration)
+		}
+	}
 	if a.End.IsZero() {
-		a.End = a.Start.Add(10 * time.Minute) // TODO
+		a.End = a.Start.Add(defaultAppointmentDuration)
+	}
+	if a.ResourceID != "" {
+		ok, err := resourceExists(ctx, srv.db, businessID, a.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownResource{}, nil
+		}
 	}
 	a.Name = strings.TrimSpace(a.Name)
+	if a.Locale != "" && !a.Locale.valid() {
+		return badLocale{}, nil
+	}
+
+	businessName, loc, err := fetchBusinessNameAndLocation(ctx, srv.db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	l := a.Locale
+	if l == "" {
+		l, err = businessLocale(ctx, srv.db, businessID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Occurrences repeat at the same local time, and messages show it.
+	a.Start = a.Start.In(loc)
+
+	slots := []Slot{{Start: a.Start, End: a.End}}
+	if a.Recurrence != nil {
+		if !a.Recurrence.valid(a.Start) {
+			return badRecurrence{}, nil
+		}
+		slots = a.Recurrence.occurrences(slots[0], loc)
+	}
 
 	tx, err := srv.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
@@ -480,114 +855,213 @@ func (a newAppointmentAction) serveAction(ctx context.Context, srv server, busin
 	}
 
 	var customerLink string
+	var customerCode int
+	var seriesID string
 
 	var result interface{}
 	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
-		var number int64
-		err = tx.QueryRow(ctx, `
-			INSERT INTO last_appointment_number_for_day
-				(business_id, day)
-			VALUES
-				($1, $2 :: date)
-			ON CONFLICT (business_id, day) DO UPDATE SET
-				number = last_appointment_number_for_day.number + 1
-			RETURNING
-				number
-			;
-		`, businessID, a.Start).Scan(&number)
-		if err != nil {
-			return false, fmt.Errorf("fetching appointment number: %w", err)
+		if a.maxOpenBookings > 0 {
+			var openBookings int
+			err := tx.QueryRow(ctx, `
+				SELECT count(*)
+				FROM appointments
+				WHERE
+					business_id = $1 AND (phone = $2 OR email = $3)
+					AND start >= now()
+					AND canceled_at IS NULL AND finished_at IS NULL AND no_show_at IS NULL
+				;
+			`, businessID, a.Phone, a.Email).Scan(&openBookings)
+			if err != nil {
+				return false, fmt.Errorf("counting open bookings: %w", err)
+			}
+			if openBookings >= a.maxOpenBookings {
+				result = tooManyOpenBookings{}
+				return false, nil
+			}
 		}
 
-		err = tx.QueryRow(ctx, `
-			INSERT INTO appointments (
-				business_id, id,
-				start, "end",
-				phone, email, number,
-				name, comments
-			) VALUES (
-				$1, $2,
-				$3, $4,
-				$5, $6, $7,
-				$8, $9
-			)
-			RETURNING
-				customer_link
-			;
-		`,
-			businessID, ulidx.New(),
-			a.Start, a.End,
-			nilIfEmpty(a.Phone), nilIfEmpty(a.Email), number,
-			nilIfEmpty(a.Name), nilIfEmpty(a.Commments),
-		).Scan(&customerLink)
-		if err != nil {
-			return false, fmt.Errorf("inserting appointment: %w", err)
+		customerID := a.CustomerID
+		if customerID == "" {
+			customerID, err = matchCustomer(ctx, tx, businessID, a.Name, a.Phone, a.Email)
+			if err != nil {
+				return false, err
+			}
 		}
 
-		var businessName string
-		err = tx.QueryRow(context.Background(), `
-			SELECT name FROM businesses WHERE id = $1;
-		`, businessID).Scan(&businessName)
-		if err != nil {
-			return false, fmt.Errorf("fetching business name: %w", err)
+		if r := a.Recurrence; r != nil {
+			var until *time.Time
+			if !r.Until.IsZero() {
+				until = &r.Until
+			}
+			seriesID = ulidx.New()
+			_, err = tx.Exec(ctx, `
+				INSERT INTO appointment_series
+					(business_id, id, frequency, interval, until, count)
+				VALUES
+					($1, $2, $3, $4, $5, $6)
+				;
+			`, businessID, seriesID, r.Frequency, r.interval(), until, r.Count)
+			if err != nil {
+				return false, fmt.Errorf("inserting series: %w", err)
+			}
 		}
-		_, m, d := a.Start.Date()
-		customerMsg := fmt.Sprintf(
-			`📆 Tienes cita con %s el %d/%d a las %d:%02d.
 
-Para recibir avisos relacionados con tu cita, acepta recibir notificaciones aquí: https://tengocita.app/c/%s
+		var appointmentID string
+		for i, slot := range slots {
+			notBookable, err := checkBookable(ctx, tx, businessID, a.ResourceID, slot, "")
+			if err != nil {
+				return false, err
+			}
+			if notBookable != nil && a.Recurrence != nil {
+				result = occurrenceNotBookable{Start: slot.Start, Problem: reflect.TypeOf(notBookable).Name()}
+				return false, nil
+			}
+			if notBookable != nil {
+				result = notBookable
+				return false, nil
+			}
 
-Cuando llegues, muestra el código QR que encontrarás en el enlace.`,
-			businessName, d, m, a.Start.Hour(), a.Start.Minute(), customerLink,
-		)
-		result = created{
-			CustomerMessage: customerMsg,
+			var number int64
+			err = tx.QueryRow(ctx, `
+				INSERT INTO last_appointment_number_for_day
+					(business_id, day)
+				VALUES
+					($1, business_day($1, $2))
+				ON CONFLICT (business_id, day) DO UPDATE SET
+					number = last_appointment_number_for_day.number + 1
+				RETURNING
+					number
+				;
+			`, businessID, slot.Start).Scan(&number)
+			if err != nil {
+				return false, fmt.Errorf("fetching appointment number: %w", err)
+			}
+
+			id := ulidx.New()
+			var link string
+			var code int
+			err = tx.QueryRow(ctx, `
+				INSERT INTO appointments (
+					business_id, id,
+					start, "end",
+					phone, email, number,
+					name, comments,
+					service_id, resource_id,
+					customer_id, series_id,
+					locale
+				) VALUES (
+					$1, $2,
+					$3, $4,
+					$5, $6, $7,
+					$8, $9,
+					$10, $11,
+					$12, $13,
+					$14
+				)
+				RETURNING
+					customer_link, customer_code
+				;
+			`,
+				businessID, id,
+				slot.Start, slot.End,
+				nilIfEmpty(a.Phone), nilIfEmpty(a.Email), number,
+				nilIfEmpty(a.Name), nilIfEmpty(a.Commments),
+				nilIfEmpty(a.ServiceID), nilIfEmpty(a.ResourceID),
+				customerID, nilIfEmpty(seriesID),
+				nilIfEmpty(string(a.Locale)),
+			).Scan(&link, &code)
+			if err != nil {
+				return false, fmt.Errorf("inserting appointment: %w", err)
+			}
+			if i == 0 {
+				appointmentID, customerLink, customerCode = id, link, code
+			}
 		}
-		return true, nil
-	})
 
-	if a.Phone != "" {
-		// TODO: Do this in a proper queue.
-		go func() {
-			if true {
-				return
+		if a.waitlistOfferID != "" {
+			claimed, err := claimWaitlistOffer(ctx, tx, businessID, a.waitlistOfferID, appointmentID)
+			if err != nil {
+				return false, err
 			}
+			if !claimed {
+				result = offerExpired{}
+				return false, nil
+			}
+		}
 
-			_, m, d := a.Start.Date()
-			f := fmt.Sprintf(
-				`Cita el %d/%d a las %d:%02d con %%s. Muestra tu código aquí: https://tengocita.app/c/%s`,
-				d, m, a.Start.Hour(), a.Start.Minute(), customerLink,
-			)
-			var name string
-			for {
-				err := srv.db.QueryRow(context.Background(), `
-					SELECT name FROM businesses WHERE id = $1;
-				`, businessID).Scan(&name)
-				if err == nil {
-					break
-				}
-				log(ctx).Printf("Error fetching business name for SMS businessID=%s err=%s", businessID, err)
-				time.Sleep(5 * time.Second)
+		var recurrence []string
+		if a.Recurrence != nil {
+			recurrence = append(recurrence, a.Recurrence.describe(l, slots))
+		}
+		vars := newMessageVars(businessName, a.Start, customerLink, customerCode)
+		vars.recurrence = strings.Join(recurrence, " ")
+
+		if a.Phone != "" && smsOnNewAppointment {
+			sms, err := renderMessage(ctx, tx, businessID, messageCreatedSMS, l, vars)
+			if err != nil {
+				return false, err
 			}
-			if len(name) > 160-len(f)-len(`%s`) {
-				name = name[:len(f)-len(`%s`)-len(`...`)] + "..."
+			err = enqueueNotification(ctx, tx, outboxMessage{
+				BusinessID:    businessID,
+				AppointmentID: appointmentID,
+				Channel:       channelSMS,
+				Recipient:     a.Phone,
+				Payload:       smsPayload{Message: sms},
+			})
+			if err != nil {
+				return false, err
 			}
-			for {
-				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-				defer cancel()
-				err := sendSMS(ctx, a.Phone, fmt.Sprintf(f, name))
-				cancel()
-				if err == nil {
-					break
-				}
-				log(ctx).Printf("Error sending SMS phone=%s err=%s", a.Phone, err)
-				time.Sleep(5 * time.Second)
+		}
+
+		err = enqueueEmail(ctx, tx, businessID, appointmentID, nilIfEmpty(a.Email), appointmentEmail{
+			Subject: l.sprintf("created.subject", businessName),
+			Paragraphs: append(append([]string{
+				l.sprintf("youHaveAppointment", businessName, l.when(a.Start)),
+			}, recurrence...),
+				l.sprintf("showQRCode"),
+			),
+			CustomerLink:   customerLink,
+			Unsubscribable: true,
+			Locale:         l,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		customerMsg, err := renderMessage(ctx, tx, businessID, messageCreated, l, vars)
+		if err != nil {
+			return false, err
+		}
+		var occurrences []time.Time
+		if a.Recurrence != nil {
+			for _, s := range slots {
+				occurrences = append(occurrences, s.Start)
 			}
-		}()
+		}
+		result = created{
+			CustomerLink:    customerLink,
+			CustomerMessage: customerMsg,
+			SeriesID:        seriesID,
+			Occurrences:     occurrences,
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := result.(created); ok {
+		noShows, err := countNoShows(ctx, srv.db, businessID, a.Phone, a.Email)
+		if err != nil {
+			return nil, err
+		}
+		if noShows.Count > 0 {
+			c.NoShows = &noShows
+		}
+		result = c
 	}
-	// TODO: Send emails
 
-	return result, err
+	return result, nil
 }
 
 type startAppointmentAction struct {
@@ -608,7 +1082,7 @@ func (a startAppointmentAction) serveAction(ctx context.Context, srv server, bus
 	where := ""
 	var params []interface{}
 	if a.Code != 0 {
-		where = "customer_code = $1 AND business_id = $2 AND (start AT TIME ZONE 'UTC') :: date = (now() at time zone 'utc') :: date"
+		where = "customer_code = $1 AND business_id = $2 AND day = business_day(business_id, now())"
 		params = append(params, a.Code/100, businessID)
 	} else if a.ID != "" {
 		where = "business_id = $1 AND id = $2"
@@ -625,45 +1099,37 @@ func (a startAppointmentAction) serveAction(ctx context.Context, srv server, bus
 		return nil, fmt.Errorf("beginning transaction: %w", err)
 	}
 	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
-		err = tx.QueryRow(ctx, `
-			UPDATE appointments SET started_at = COALESCE(appointments.started_at, $3)
+		row := tx.QueryRow(ctx, `
+			UPDATE appointments SET
+				started_at = COALESCE(appointments.started_at, $3),
+				-- Late customers may have been marked already.
+				no_show_at = NULL
 			WHERE
 				canceled_at IS NULL AND finished_at IS NULL AND `+where+`
-			RETURNING
-				id,
-				number,
-				start,
-				"end",
-				phone,
-				email,
-				name,
-				started_at
+			RETURNING `+appointmentColumns+`
 			;
-		`, append(params, now())...).Scan(
-			&app.ID,
-			&app.Number,
-			&app.Start,
-			&app.End,
-			&app.Phone,
-			&app.Email,
-			&app.Name,
-			&app.StartedAt,
-		)
+		`, append(params, now())...)
+		err = scanAppointment(row, &app)
 		if err != nil {
 			return false, fmt.Errorf("fetching appointment for businessID=%v id=%v code=%v: %w", businessID, a.ID, a.Code, err)
 		}
 
+		var resourceID string
+		if app.ResourceID != nil {
+			resourceID = *app.ResourceID
+		}
+
 		alreadyAlerting := false
 		err = tx.QueryRow(ctx, `
- 			SELECT c > 0 FROM (SELECT COUNT(*) AS c FROM delay_alerts WHERE business_id = $1) q;
-		`, businessID).Scan(&alreadyAlerting)
+ 			SELECT c > 0 FROM (SELECT COUNT(*) AS c FROM delay_alerts WHERE business_id = $1 AND resource_id = $2) q;
+		`, businessID, resourceID).Scan(&alreadyAlerting)
 		if err != nil {
-			return false, fmt.Errorf("checking if there's an alert already for businessID=%v: %w", businessID, err)
+			return false, fmt.Errorf("checking if there's an alert already for businessID=%v resourceID=%v: %w", businessID, resourceID, err)
 		}
 
 		if !alreadyAlerting {
 			var ok bool
-			delay, ok, err = meanDelay(ctx, tx, businessID, 3)
+			delay, ok, err = meanDelay(ctx, tx, businessID, resourceID, 3)
 			if err != nil {
 				return false, fmt.Errorf("calculating mean delay for businessID=%v: %w", businessID, err)
 			}
@@ -712,6 +1178,9 @@ func (a finishAppointmentAction) serveAction(ctx context.Context, srv server, bu
 type cancelAppointmentAction struct {
 	ID     string `json:"id"`
 	Reason string `json:"reason"`
+	// Scope is which appointments to cancel if it's in a series. Defaults
+	// to just this one.
+	Scope seriesScope `json:"scope,omitempty"`
 }
 
 type (
@@ -720,9 +1189,17 @@ type (
 	}
 
 // notFound
+// badScope
 )
 
 func (a cancelAppointmentAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if !a.Scope.valid() {
+		return badScope{}, nil
+	}
+	if a.Scope == scopeFollowing || a.Scope == scopeSeries {
+		return a.cancelSeries(ctx, srv, businessID)
+	}
+
 	tx, err := srv.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		return nil, fmt.Errorf("beginning transaction: %w", err)
@@ -731,7 +1208,8 @@ func (a cancelAppointmentAction) serveAction(ctx context.Context, srv server, bu
 	var result interface{}
 	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
 		var customerLink string
-		var phone sql.NullString
+		var customerCode int
+		var phone, email sql.NullString
 		var pushSubJS []byte
 		var day time.Time
 
@@ -741,80 +1219,393 @@ func (a cancelAppointmentAction) serveAction(ctx context.Context, srv server, bu
 				cancel_reason = $3
 			WHERE
 				business_id = $1 AND id = $2
-				AND started_at IS NULL AND finished_at IS NULL
+				AND started_at IS NULL AND finished_at IS NULL AND no_show_at IS NULL
 			RETURNING
-				customer_link, phone, push_subscription, start
+				customer_link, customer_code, phone, CASE WHEN can_send_emails THEN email END, push_subscription, start
 			;
 		`, businessID, a.ID, nilIfEmpty(strings.TrimSpace(a.Reason))).Scan(
-			&customerLink, &phone, &pushSubJS, &day,
+			&customerLink, &customerCode, &phone, &email, &pushSubJS, &day,
 		)
 		if err != nil {
 			return false, fmt.Errorf("cancel appointment for businessID=%v id=%v: %w", businessID, a.ID, err)
 		}
-		var pushSub *webpush.Subscription
-		if len(pushSubJS) > 0 {
-			json.Unmarshal(pushSubJS, &pushSub)
+
+		err = offerFreedSlot(ctx, tx, businessID, a.ID)
+		if err != nil {
+			return false, err
 		}
 
 		result = canceled{}
-		if !phone.Valid && pushSub == nil {
+		if !phone.Valid && !email.Valid && len(pushSubJS) == 0 {
 			return true, nil
 		}
 
-		var businessName string
-		err = srv.db.QueryRow(context.Background(), `
-			SELECT name FROM businesses WHERE id = $1;
-		`, businessID).Scan(&businessName)
+		businessName, loc, err := fetchBusinessNameAndLocation(ctx, tx, businessID)
 		if err != nil {
-			return false, fmt.Errorf("fetching business name for message: %w", err)
+			return false, err
 		}
+		day = day.In(loc)
+		l, err := appointmentLocale(ctx, tx, businessID, a.ID)
+		if err != nil {
+			return false, err
+		}
+
+		vars := newMessageVars(businessName, day, customerLink, customerCode)
 
 		if phone.Valid {
-			result = canceled{
-				CustomerMessage: fmt.Sprintf(
-					`🚫📆 Anulada tu cita con %s. Detalles: https://tengocita.app/c/%s`,
-					businessName, customerLink,
-				),
+			msg, err := renderMessage(ctx, tx, businessID, messageCanceled, l, vars)
+			if err != nil {
+				return false, err
+			}
+			result = canceled{CustomerMessage: msg}
+		}
+
+		pushBody, err := renderMessage(ctx, tx, businessID, messageCanceledPush, l, vars)
+		if err != nil {
+			return false, err
+		}
+		err = enqueuePush(ctx, tx, businessID, a.ID, pushSubJS, PushNotif{
+			Title: l.sprintf("canceled.title"),
+			Options: PushOptions{
+				Body:               pushBody,
+				Tag:                "cancelled:" + customerLink,
+				RequireInteraction: true,
+				Data: map[string]interface{}{
+					"customerLink": customerLink,
+				},
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+
+		var reason []string
+		if r := strings.TrimSpace(a.Reason); r != "" {
+			reason = append(reason, l.sprintf("reason", r))
+		}
+		err = enqueueEmail(ctx, tx, businessID, a.ID, nullStringPtr(email), appointmentEmail{
+			Subject: l.sprintf("canceled.subject", businessName),
+			Paragraphs: append([]string{l.sprintf(
+				"canceled.body",
+				businessName,
+				day.Format("2/1"),
+			)}, reason...),
+			CustomerLink:   customerLink,
+			Unsubscribable: true,
+			Locale:         l,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// updateAppointmentAction replaces the appointment's details with the ones
+// given: omitted fields are cleared, not kept, so clients must send the
+// service, resource and contact details they want the appointment to keep.
+// Only End may be omitted, to keep the previous duration. Appointments that
+// have already started can't be changed.
+type updateAppointmentAction struct {
+	ID         string    `json:"id"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Phone      string    `json:"phone,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Comments   string    `json:"comments,omitempty"`
+	ServiceID  string    `json:"serviceId,omitempty"`
+	ResourceID string    `json:"resourceId,omitempty"`
+	// Scope is which appointments to update if it's in a series. Defaults
+	// to just this one.
+	Scope seriesScope `json:"scope,omitempty"`
+
+	// rescheduleRequestID is the request being accepted, if any. It's
+	// accepted in the same transaction that updates the appointment.
+	rescheduleRequestID string
+}
+
+type (
+	// missingEmailOrPhone struct{}
+	// missingStart struct{}
+	// badScope struct{}
+	// occurrenceNotBookable struct{}
+	// updatedSeries struct{}
+	// unknownService struct{}
+	// unknownResource struct{}
+	// outsideOpeningHours struct{}
+	// slotTaken struct{}
+	// notFound struct{}
+	updated struct {
+		Appointment     Appointment `json:"appointment"`
+		CustomerMessage string      `json:"customerMessage,omitempty"`
+	}
+)
+
+func (a updateAppointmentAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Phone = trimPhone(a.Phone)
+	a.Email = strings.TrimSpace(a.Email)
+	if a.Phone == "" && a.Email == "" {
+		return missingEmailOrPhone{}, nil
+	}
+	if a.Start.IsZero() {
+		return missingStart{}, nil
+	}
+	if a.ServiceID != "" {
+		duration, ok, err := serviceDuration(ctx, srv.db, businessID, a.ServiceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownService{}, nil
+		}
+		if a.End.IsZero() {
+			a.End = a.Start.Add(duration)
+		}
+	}
+	if a.ResourceID != "" {
+		ok, err := resourceExists(ctx, srv.db, businessID, a.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownResource{}, nil
+		}
+	}
+	a.Name = strings.TrimSpace(a.Name)
+	if !a.Scope.valid() {
+		return badScope{}, nil
+	}
+	if a.Scope == scopeFollowing || a.Scope == scopeSeries {
+		return a.updateSeries(ctx, srv, businessID)
+	}
+
+	tx, err := srv.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	var app Appointment
+	var customerLink string
+	var customerCode int
+	var businessName string
+	var l locale
+	var timeChanged bool
+	var rejected interface{}
+
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		var prevStart, prevEnd time.Time
+		var prevResourceID string
+		var pushSubJS []byte
+		var canSendEmails bool
+		err = tx.QueryRow(ctx, `
+			SELECT
+				start, "end", COALESCE(resource_id, ''), customer_link, customer_code, push_subscription, can_send_emails
+			FROM appointments
+			WHERE
+				business_id = $1 AND id = $2
+				AND started_at IS NULL AND canceled_at IS NULL AND finished_at IS NULL
+			;
+		`, businessID, a.ID).Scan(&prevStart, &prevEnd, &prevResourceID, &customerLink, &customerCode, &pushSubJS, &canSendEmails)
+		if err != nil {
+			return false, fmt.Errorf("fetching appointment for businessID=%v id=%v: %w", businessID, a.ID, err)
+		}
+		if a.End.IsZero() {
+			// Keep the previous duration.
+			a.End = a.Start.Add(prevEnd.Sub(prevStart))
+		}
+		timeChanged = !a.Start.Equal(prevStart) || !a.End.Equal(prevEnd)
+
+		if a.rescheduleRequestID != "" {
+			accepted, err := acceptRescheduleRequest(ctx, tx, businessID, a.rescheduleRequestID, a.Start)
+			if err != nil {
+				return false, err
+			}
+			if !accepted {
+				rejected = notFound{}
+				return false, nil
 			}
 		}
 
-		if pushSub != nil {
-			go func() {
-				err := sendPush(pushSub, PushNotif{
-					Title: "🚫📆 Cita anulada",
-					Options: PushOptions{
-						Body: fmt.Sprintf(
-							"Tu cita con %s del %s ha sido anulada.",
-							businessName,
-							day.Format("2/1"),
-						),
-						Tag:                "cancelled:" + customerLink,
-						RequireInteraction: true,
-						Data: map[string]interface{}{
-							"customerLink": customerLink,
-						},
+		var loc *time.Location
+		businessName, loc, err = fetchBusinessNameAndLocation(ctx, tx, businessID)
+		if err != nil {
+			return false, err
+		}
+		// Messages show the time as the business' customers see it.
+		a.Start = a.Start.In(loc)
+		l, err = appointmentLocale(ctx, tx, businessID, a.ID)
+		if err != nil {
+			return false, err
+		}
+
+		if timeChanged || a.ResourceID != prevResourceID {
+			notBookable, err := checkBookable(ctx, tx, businessID, a.ResourceID, Slot{Start: a.Start, End: a.End}, a.ID)
+			if err != nil {
+				return false, err
+			}
+			if notBookable != nil {
+				rejected = notBookable
+				return false, nil
+			}
+		}
+
+		number := sql.NullInt64{}
+		if !sameDay(a.Start, prevStart, loc) {
+			// Numbers are per day, so moving to another day takes a number
+			// from that day. The customer link stays the same.
+			err = tx.QueryRow(ctx, `
+				INSERT INTO last_appointment_number_for_day
+					(business_id, day)
+				VALUES
+					($1, business_day($1, $2))
+				ON CONFLICT (business_id, day) DO UPDATE SET
+					number = last_appointment_number_for_day.number + 1
+				RETURNING
+					number
+				;
+			`, businessID, a.Start).Scan(&number)
+			if err != nil {
+				return false, fmt.Errorf("fetching appointment number: %w", err)
+			}
+		}
+
+		var newCode bool
+		err = retryCustomerCodeConflicts(ctx, tx, func(regenerate bool) error {
+			newCode = regenerate
+			row := tx.QueryRow(ctx, `
+				UPDATE appointments SET
+					start = $3,
+					"end" = $4,
+					phone = $5,
+					email = $6,
+					name = $7,
+					comments = $8,
+					number = COALESCE($9, number),
+					service_id = $10,
+					resource_id = $11,
+					confirmed_at = CASE WHEN $12 THEN NULL ELSE confirmed_at END,
+					no_show_at = CASE WHEN $12 THEN NULL ELSE no_show_at END,
+					no_show_cleared_at = CASE WHEN $12 THEN NULL ELSE no_show_cleared_at END,
+					customer_code = CASE WHEN $13 THEN random_customer_code() ELSE customer_code END
+				WHERE
+					business_id = $1 AND id = $2
+				RETURNING `+appointmentColumns+`
+				;
+			`,
+				businessID, a.ID,
+				a.Start, a.End,
+				nilIfEmpty(a.Phone), nilIfEmpty(a.Email),
+				nilIfEmpty(a.Name), nilIfEmpty(a.Comments),
+				number, nilIfEmpty(a.ServiceID), nilIfEmpty(a.ResourceID),
+				// A confirmation or a no-show was for the previous time.
+				timeChanged,
+				regenerate,
+			)
+			return scanAppointment(row, &app)
+		})
+		if err != nil {
+			return false, fmt.Errorf("updating appointment for businessID=%v id=%v: %w", businessID, a.ID, err)
+		}
+		if newCode {
+			customerCode, err = fetchCustomerCode(ctx, tx, businessID, a.ID)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if timeChanged {
+			// Reminders are due again relative to the new time.
+			_, err = tx.Exec(ctx, `
+				DELETE FROM appointment_reminders
+				WHERE business_id = $1 AND appointment_id = $2;
+			`, businessID, a.ID)
+			if err != nil {
+				return false, fmt.Errorf("resetting reminders: %w", err)
+			}
+
+			pushBody, err := renderMessage(ctx, tx, businessID, messageUpdatedPush, l, newMessageVars(businessName, a.Start, customerLink, customerCode))
+			if err != nil {
+				return false, err
+			}
+			err = enqueuePush(ctx, tx, businessID, a.ID, pushSubJS, PushNotif{
+				Title: l.sprintf("updated.title"),
+				Options: PushOptions{
+					Body:               pushBody,
+					Tag:                "updated:" + customerLink,
+					RequireInteraction: true,
+					Actions: []PushAction{{
+						Action: "go",
+						Title:  l.sprintf("viewAppointment"),
+					}},
+					Data: map[string]interface{}{
+						"customerLink": customerLink,
 					},
+				},
+			})
+			if err != nil {
+				return false, err
+			}
+
+			if canSendEmails {
+				err = enqueueEmail(ctx, tx, businessID, a.ID, app.Email, appointmentEmail{
+					Subject:        l.sprintf("updated.subject", businessName),
+					Paragraphs:     []string{l.sprintf("updated.body", businessName, l.when(a.Start))},
+					CustomerLink:   customerLink,
+					Unsubscribable: true,
+					Locale:         l,
 				})
 				if err != nil {
-					log(ctx).Printf("Error sending push notification to %s: %s", pushSub.Endpoint, err)
+					return false, err
 				}
-			}()
+			}
 		}
 
 		return true, nil
 	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	result := updated{Appointment: app}
+	if !timeChanged {
+		return result, nil
+	}
+
+	if a.Phone != "" {
+		result.CustomerMessage, err = renderMessage(ctx, srv.db, businessID, messageUpdated, l, newMessageVars(businessName, a.Start, customerLink, customerCode))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return result, nil
 }
 
+// configureBusinessAction sets the business' details. Email and Phone are how
+// customers and TengoCita contact the business; changing them doesn't change
+// anyone's login, which is set per staff member.
 type configureBusinessAction struct {
-	Name    string `json:"name"`
-	Phone   string `json:"phone,omitempty"`
-	Email   string `json:"email,omitempty"`
-	Address string `json:"address,omitempty"`
+	Name        string  `json:"name"`
+	Phone       string  `json:"phone,omitempty"`
+	Email       string  `json:"email,omitempty"`
+	Address     string  `json:"address,omitempty"`
+	Slug        *string `json:"slug,omitempty"`
+	SelfBooking *bool   `json:"selfBooking,omitempty"`
+	TimeZone    *string `json:"timeZone,omitempty"`
+	Locale      *locale `json:"locale,omitempty"`
 }
 
 type (
@@ -822,7 +1613,13 @@ type (
 	// missingEmailOrPhone
 	emailTaken struct{}
 	phoneTaken struct{}
-	business   Business
+	badSlug    struct{}
+	slugTaken  struct{}
+	// badTimeZone is returned if TimeZone isn't an IANA time zone name.
+	badTimeZone struct{}
+	// badLocale is returned if Locale isn't es, en or ca.
+	badLocale struct{}
+	business  Business
 )
 
 func (a configureBusinessAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
@@ -837,75 +1634,168 @@ func (a configureBusinessAction) serveAction(ctx context.Context, srv server, bu
 	if a.Email == "" && a.Phone == "" {
 		return missingEmailOrPhone{}, nil
 	}
+	if a.Slug != nil {
+		*a.Slug = strings.ToLower(strings.TrimSpace(*a.Slug))
+		if !slugRegexp.MatchString(*a.Slug) {
+			return badSlug{}, nil
+		}
+	}
+	if a.TimeZone != nil && !validTimeZone(*a.TimeZone) {
+		return badTimeZone{}, nil
+	}
+	if a.Locale != nil && !a.Locale.valid() {
+		return badLocale{}, nil
+	}
 
-	_, err := srv.db.Exec(ctx, `
-		UPDATE businesses SET
-			name = $2,
-			email = $3,
-			phone = $4,
-			address = $5
-		WHERE
-			id = $1
-		;
-	`, businessID, a.Name, nilIfEmpty(a.Email), nilIfEmpty(a.Phone), nilIfEmpty(a.Address))
+	tx, err := srv.db.BeginTx(ctx, nil)
 	if err != nil {
-		if isUniqueViolation(err) {
-			var pqErr *pq.Error
-			errors.As(err, &pqErr)
-			switch pqErr.Constraint {
-			case "businesses_email_key":
-				return emailTaken{}, nil
-			case "businesses_phone_key":
-				return phoneTaken{}, nil
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	var result interface{}
+	var slug *string
+	var selfBooking bool
+	var timeZone string
+	var l locale
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		var prevTimeZone string
+		err = tx.QueryRow(ctx, `
+			SELECT time_zone FROM businesses WHERE id = $1 FOR UPDATE;
+		`, businessID).Scan(&prevTimeZone)
+		if err != nil {
+			return false, fmt.Errorf("fetching time zone: %w", err)
+		}
+
+		err = tx.QueryRow(ctx, `
+			UPDATE businesses SET
+				name = $2,
+				email = $3,
+				phone = $4,
+				address = $5,
+				slug = COALESCE($6, slug),
+				self_booking = COALESCE($7, self_booking),
+				time_zone = COALESCE($8, time_zone),
+				locale = COALESCE($9, locale)
+			WHERE
+				id = $1
+			RETURNING
+				slug, self_booking, time_zone, locale
+			;
+		`,
+			businessID, a.Name, nilIfEmpty(a.Email), nilIfEmpty(a.Phone), nilIfEmpty(a.Address),
+			a.Slug, a.SelfBooking, a.TimeZone, a.Locale,
+		).Scan(&slug, &selfBooking, &timeZone, &l)
+		if err != nil {
+			if isUniqueViolation(err) {
+				var pqErr *pq.Error
+				errors.As(err, &pqErr)
+				switch pqErr.Constraint {
+				case "businesses_email_key":
+					result = emailTaken{}
+					return false, nil
+				case "businesses_phone_key":
+					result = phoneTaken{}
+					return false, nil
+				case "businesses_slug_key":
+					result = slugTaken{}
+					return false, nil
+				}
 			}
+			return false, fmt.Errorf("updating business businessID=%v: %w", businessID, err)
 		}
-		return nil, fmt.Errorf("updating business businessID=%v: %w", businessID, err)
+
+		if timeZone != prevTimeZone {
+			err = rebucketAppointments(ctx, tx, businessID)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		return result, nil
 	}
 
 	return business{
-		Name:    &a.Name,
-		Phone:   nilIfEmpty(a.Phone),
-		Email:   nilIfEmpty(a.Email),
-		Address: nilIfEmpty(a.Address),
+		Name:        &a.Name,
+		Phone:       nilIfEmpty(a.Phone),
+		Email:       nilIfEmpty(a.Email),
+		Address:     nilIfEmpty(a.Address),
+		Slug:        slug,
+		SelfBooking: selfBooking,
+		TimeZone:    timeZone,
+		Locale:      l,
 	}, nil
 }
 
-func (srv server) login(ctx context.Context, emailOrPhone, password string) (authToken string, business Business, ok bool, err error) {
+func (srv server) login(ctx context.Context, emailOrPhone, password string) (authToken string, business Business, staff StaffMember, ok bool, err error) {
 	var businessID, hashedPassword string
 	err = srv.db.QueryRow(ctx, `
 		SELECT
-			id, password,
-			email, phone,
-			name, address
-		FROM businesses
+			s.business_id, s.password,
+			`+staffColumns+`
+		FROM staff s
 		WHERE
-			email = $1 OR phone = $1
+			(s.email = $1 OR s.phone = $1)
+			AND s.password IS NOT NULL AND s.disabled_at IS NULL
 		;
 	`, emailOrPhone).Scan(
 		&businessID, &hashedPassword,
-		&business.Email, &business.Phone,
-		&business.Name, &business.Address,
+		&staff.ID, &staff.Name, &staff.Email, &staff.Phone, &staff.Role, &staff.Disabled, &staff.Invited,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", Business{}, false, nil
+			return "", Business{}, StaffMember{}, false, nil
 		}
-		return "", Business{}, false, fmt.Errorf("fetching business ID and password: %w", err)
+		return "", Business{}, StaffMember{}, false, fmt.Errorf("fetching staff ID and password: %w", err)
 	}
 
 	ok, err = argon2id.ComparePasswordAndHash(password, hashedPassword)
 	if err != nil {
-		return "", Business{}, false, fmt.Errorf("matching password hash: %w", err)
+		return "", Business{}, StaffMember{}, false, fmt.Errorf("matching password hash: %w", err)
 	}
 	if !ok {
-		return "", Business{}, false, nil
+		return "", Business{}, StaffMember{}, false, nil
+	}
+
+	business, err = fetchLoggedInBusiness(ctx, srv.db, businessID)
+	if err != nil {
+		return "", Business{}, StaffMember{}, false, err
 	}
 
-	authToken, err = srv.newSession(ctx, businessID)
-	return authToken, business, err == nil, err
+	authToken, err = srv.newSession(ctx, businessID, staff.ID)
+	return authToken, business, staff, err == nil, err
 }
 
-func (srv server) newSession(ctx context.Context, businessID string) (authToken string, err error) {
+// fetchLoggedInBusiness fetches the business details sent to staff when they
+// log in.
+func fetchLoggedInBusiness(ctx context.Context, db sqler.Queryer, businessID string) (Business, error) {
+	var business Business
+	err := db.QueryRow(ctx, `
+		SELECT
+			email, phone,
+			name, address,
+			slug, self_booking, time_zone, locale
+		FROM businesses
+		WHERE
+			id = $1
+		;
+	`, businessID).Scan(
+		&business.Email, &business.Phone,
+		&business.Name, &business.Address,
+		&business.Slug, &business.SelfBooking, &business.TimeZone, &business.Locale,
+	)
+	if err != nil {
+		return Business{}, fmt.Errorf("fetching business: %w", err)
+	}
+	return business, nil
+}
+
+func (srv server) newSession(ctx context.Context, businessID, staffID string) (authToken string, err error) {
 	sessionID := ulidx.New()
 
 	tx, err := srv.db.BeginTx(ctx, nil)
@@ -915,11 +1805,11 @@ func (srv server) newSession(ctx context.Context, businessID string) (authToken
 	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
 		_, err = tx.Exec(ctx, `
 			INSERT INTO business_sessions
-				(business_id, id)
+				(business_id, staff_id, id)
 			VALUES
-				($1, $2)
+				($1, $2, $3)
 			;
-		`, businessID, sessionID)
+		`, businessID, staffID, sessionID)
 		if err != nil {
 			return false, fmt.Errorf("inserting session: %w", err)
 		}
@@ -934,6 +1824,16 @@ func (srv server) newSession(ctx context.Context, businessID string) (authToken
 			return false, fmt.Errorf("updating last login timestamp: %w", err)
 		}
 
+		_, err = tx.Exec(ctx, `
+			UPDATE staff SET
+				last_login = now() at time zone 'utc'
+			WHERE staff.business_id = $1 AND staff.id = $2
+			;
+		`, businessID, staffID)
+		if err != nil {
+			return false, fmt.Errorf("updating staff last login timestamp: %w", err)
+		}
+
 		return true, nil
 	})
 	if err != nil {
@@ -943,6 +1843,7 @@ func (srv server) newSession(ctx context.Context, businessID string) (authToken
 	authToken, err = secCookies.Encode("authToken", sessionAuthentication{
 		SessionID:  sessionID,
 		BusinessID: businessID,
+		StaffID:    staffID,
 		Issued:     time.Now().UTC(),
 	})
 	if err != nil {
@@ -954,6 +1855,7 @@ func (srv server) newSession(ctx context.Context, businessID string) (authToken
 type sessionAuthentication struct {
 	SessionID  string    `json:"sessionID"`
 	BusinessID string    `json:"businessID"`
+	StaffID    string    `json:"staffID"`
 	Issued     time.Time `json:"issued"`
 }
 
@@ -974,6 +1876,7 @@ var secCookies = func() *securecookie.SecureCookie {
 
 func (srv server) unsubscribePromoEmails(w http.ResponseWriter, req *http.Request) error {
 	link := req.URL.Query().Get("id")
+	l := pageLocale(req, nil, defaultLocale)
 	res, err := srv.db.Exec(req.Context(), `
 		UPDATE businesses SET
 			can_send_promo_emails = false
@@ -982,32 +1885,35 @@ func (srv server) unsubscribePromoEmails(w http.ResponseWriter, req *http.Reques
 	`, link)
 	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintln(w, `Ha ocurrido un error inesperado. Inténtalo de nuevo o ponte en contacto con hola@tengocita.app.`)
+		fmt.Fprintln(w, l.sprintf("unexpectedError"))
 		return fmt.Errorf("unsubscribing %q from promo emails: %w", link, err)
 	}
 	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
 		w.WriteHeader(404)
-		fmt.Fprintln(w, `Enlace incorrecto. Ponte en contacto con hola@tengocita.app.`)
+		fmt.Fprintln(w, l.sprintf("badLink"))
 		return nil
 	}
 
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
 	unsubscribePromoEmailsTpl.ExecuteTemplate(w, "", struct {
-		Link string
+		Link   string
+		Locale locale
 	}{
-		Link: link,
+		Link:   link,
+		Locale: l,
 	})
 
 	return nil
 }
 
-var unsubscribePromoEmailsTpl = template.Must(template.New("").Parse(`
-<p>Ya no recibirás más correos promocionales.</p>
-<p><a href="/subscribePromoEmails?id={{.Link}}">Haz clic aquí para volver a suscribirte.</a></p>
+var unsubscribePromoEmailsTpl = template.Must(template.New("").Funcs(localeFuncs).Parse(`
+<p>{{t .Locale "promo.unsubscribed"}}</p>
+<p><a href="/subscribePromoEmails?id={{.Link}}">{{t .Locale "promo.resubscribe"}}</a></p>
 `))
 
 func (srv server) subscribePromoEmails(w http.ResponseWriter, req *http.Request) error {
 	link := req.URL.Query().Get("id")
+	l := pageLocale(req, nil, defaultLocale)
 	res, err := srv.db.Exec(req.Context(), `
 		UPDATE businesses SET
 			can_send_promo_emails = true
@@ -1016,28 +1922,30 @@ func (srv server) subscribePromoEmails(w http.ResponseWriter, req *http.Request)
 	`, link)
 	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintln(w, `Ha ocurrido un error inesperado. Inténtalo de nuevo o ponte en contacto con hola@tengocita.app.`)
+		fmt.Fprintln(w, l.sprintf("unexpectedError"))
 		return fmt.Errorf("subscribing %q to promo emails: %w", link, err)
 	}
 	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
 		w.WriteHeader(404)
-		fmt.Fprintln(w, `Enlace incorrecto. Ponte en contacto con hola@tengocita.app.`)
+		fmt.Fprintln(w, l.sprintf("badLink"))
 		return nil
 	}
 
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
 	subscribePromoEmailsTpl.ExecuteTemplate(w, "", struct {
-		Link string
+		Link   string
+		Locale locale
 	}{
-		Link: link,
+		Link:   link,
+		Locale: l,
 	})
 
 	return nil
 }
 
-var subscribePromoEmailsTpl = template.Must(template.New("").Parse(`
-<p>Ahora volverás a recibir correos promocionales.</p>
-<p><a href="/unsubscribePromoEmails?id={{.Link}}">Haz clic aquí para desuscribirte.</a></p>
+var subscribePromoEmailsTpl = template.Must(template.New("").Funcs(localeFuncs).Parse(`
+<p>{{t .Locale "promo.subscribed"}}</p>
+<p><a href="/unsubscribePromoEmails?id={{.Link}}">{{t .Locale "promo.unsubscribe"}}</a></p>
 `))
 
 func isUniqueViolation(err error) bool {
@@ -1046,6 +1954,66 @@ func isUniqueViolation(err error) bool {
 	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
 }
 
+const maxCustomerCodeAttempts = 5
+
+// retryCustomerCodeConflicts runs f, which puts an appointment on a day, and
+// runs it again with regenerate set if the appointment's customer code is
+// already taken on that day. Codes are only unique per day, so an appointment
+// moved to another day may need a new one.
+func retryCustomerCodeConflicts(ctx context.Context, tx sqler.Tx, f func(regenerate bool) error) error {
+	for attempt := 0; ; attempt++ {
+		_, err := tx.Exec(ctx, `SAVEPOINT customer_code;`)
+		if err != nil {
+			return fmt.Errorf("creating savepoint: %w", err)
+		}
+		err = f(attempt > 0)
+		if !isCustomerCodeConflict(err) || attempt+1 == maxCustomerCodeAttempts {
+			return err
+		}
+		// The failed statement aborted the transaction up to the savepoint.
+		_, err = tx.Exec(ctx, `ROLLBACK TO SAVEPOINT customer_code;`)
+		if err != nil {
+			return fmt.Errorf("rolling back to savepoint: %w", err)
+		}
+	}
+}
+
+func isCustomerCodeConflict(err error) bool {
+	var pqErr *pq.Error
+	return isUniqueViolation(err) && errors.As(err, &pqErr) && pqErr.Constraint == "appointments_business_id_day_customer_code_idx"
+}
+
+func fetchCustomerCode(ctx context.Context, db sqler.Queryer, businessID, appointmentID string) (int, error) {
+	var code int
+	err := db.QueryRow(ctx, `
+		SELECT customer_code FROM appointments WHERE business_id = $1 AND id = $2;
+	`, businessID, appointmentID).Scan(&code)
+	if err != nil {
+		return 0, fmt.Errorf("fetching customer code: %w", err)
+	}
+	return code, nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	const foreignKeyViolation = "23503"
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if s.Valid {
+		return &s.String
+	}
+	return nil
+}
+
 func nilIfEmpty(s string) *string {
 	if s != "" {
 		return &s
@@ -1053,6 +2021,22 @@ func nilIfEmpty(s string) *string {
 	return nil
 }
 
+// truncate shortens s to at most n bytes, ending it with "..." if it was
+// longer, without splitting any UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	n -= len("...")
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	if n < 0 {
+		n = 0
+	}
+	return s[:n] + "..."
+}
+
 func trimPhone(s string) string {
 	s = strings.ReplaceAll(s, "(", "")
 	s = strings.ReplaceAll(s, ")", "")
@@ -1062,46 +2046,6 @@ func trimPhone(s string) string {
 	return s
 }
 
-func sendSMS(ctx context.Context, phone, msg string) error {
-	if smsToKey == "" {
-		log(ctx).Printf("Skipping SMS to %s: %s", phone, msg)
-		return nil
-	}
-
-	if !strings.HasPrefix(phone, "+34") {
-		phone = "+34" + phone
-	}
-	js, err := json.Marshal(map[string]interface{}{
-		"message":   msg,
-		"to":        phone,
-		"sender_id": "TengoCita",
-		// TODO: callback_url
-	})
-	if err != nil {
-		panic(err)
-	}
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.sms.to/sms/send", bytes.NewReader(js))
-	if err != nil {
-		panic(err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+smsToKey)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log(ctx).Printf(fmt.Sprintf("POST https://api.sms.to/sms/send responded with %s; body: %+v", resp.Status, string(body)))
-		return nil
-	}
-	if resp.StatusCode >= 500 {
-		return fmt.Errorf("POST https://api.sms.to/sms/send responded with %s", resp.Status)
-	}
-	return nil
-}
-
 func startMonitorAPI(ctx context.Context) {
 	f := os.NewFile(3, "monitor-api")
 	if f == nil {
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tcard/sqler"
+)
+
+// A messageKind is a message to customers whose text a business can replace
+// with its own template.
+type messageKind string
+
+const (
+	// messageCreated is created.customerMessage.
+	messageCreated messageKind = "created"
+	// messageCreatedSMS is the SMS sent for new appointments.
+	messageCreatedSMS messageKind = "createdSMS"
+	// messageUpdated is updated.customerMessage.
+	messageUpdated messageKind = "updated"
+	// messageUpdatedPush is the push notification for changed appointments.
+	messageUpdatedPush messageKind = "updatedPush"
+	// messageCanceled is canceled.customerMessage.
+	messageCanceled messageKind = "canceled"
+	// messageCanceledPush is the push notification for cancelled
+	// appointments.
+	messageCanceledPush messageKind = "canceledPush"
+	// messageReminderPush is the push notification for reminders.
+	messageReminderPush messageKind = "reminderPush"
+	// messageReminderSMS is the SMS sent for reminders.
+	messageReminderSMS messageKind = "reminderSMS"
+	// messageDelayPush is the push notification for delays.
+	messageDelayPush messageKind = "delayPush"
+	// messageUpdatedSeries is updatedSeries.customerMessage.
+	messageUpdatedSeries messageKind = "updatedSeries"
+	// messageUpdatedSeriesPush is the push notification and email for
+	// changed series.
+	messageUpdatedSeriesPush messageKind = "updatedSeriesPush"
+	// messageCanceledSeries is canceled.customerMessage for series.
+	messageCanceledSeries messageKind = "canceledSeries"
+	// messageCanceledSeriesPush is the push notification and email for
+	// cancelled series.
+	messageCanceledSeriesPush messageKind = "canceledSeriesPush"
+	// messageOfferSMS is the SMS offering a freed slot to the waitlist.
+	messageOfferSMS messageKind = "offerSMS"
+	// messageQueued is queuedWalkIn.customerMessage.
+	messageQueued messageKind = "queued"
+	// messageQueuedSMS is the SMS sent to walk-ins.
+	messageQueuedSMS messageKind = "queuedSMS"
+)
+
+var messageKinds = []messageKind{
+	messageCreated,
+	messageCreatedSMS,
+	messageUpdated,
+	messageUpdatedPush,
+	messageCanceled,
+	messageCanceledPush,
+	messageReminderPush,
+	messageReminderSMS,
+	messageDelayPush,
+	messageUpdatedSeries,
+	messageUpdatedSeriesPush,
+	messageCanceledSeries,
+	messageCanceledSeriesPush,
+	messageOfferSMS,
+	messageQueued,
+	messageQueuedSMS,
+}
+
+func (k messageKind) valid() bool {
+	for _, kk := range messageKinds {
+		if k == kk {
+			return true
+		}
+	}
+	return false
+}
+
+// sms is whether the message is sent as an SMS, so it must fit in one.
+func (k messageKind) sms() bool {
+	return k == messageCreatedSMS || k == messageReminderSMS || k == messageOfferSMS || k == messageQueuedSMS
+}
+
+const maxMessageTemplateLength = 1000
+
+// messageVars are what templates can refer to, as in
+//
+//	Hola, te esperamos el {{.Date}} a las {{.Time}} en {{.Business}}.
+type messageVars struct {
+	// Business is the business' name.
+	Business string
+	// Date is the day of the appointment, as in 31/12.
+	Date string
+	// Time is when the appointment starts, as in 17:30.
+	Time string
+	// Link is the customer's page for the appointment. For waitlist offers,
+	// it's the page to claim the slot.
+	Link string
+	// Code is what the customer says on arrival, as on their page. It's not
+	// set for waitlist offers.
+	Code int
+	// Delay is how late the appointment is running, as in 15 min. It's
+	// only set for delay alerts.
+	Delay string
+	// Number is the walk-in's turn. It's only set for walk-ins.
+	Number int64
+	// Count is how many appointments were cancelled. It's only set for
+	// series.
+	Count int
+	// Deadline is until when a waitlist offer can be claimed, as in 17:30.
+	// It's only set for waitlist offers.
+	Deadline string
+
+	start time.Time
+	delay time.Duration
+	// recurrence describes the series a new appointment starts, if any.
+	recurrence string
+}
+
+func newMessageVars(businessName string, start time.Time, customerLink string, customerCode int) messageVars {
+	return messageVars{
+		Business: businessName,
+		Date:     start.Format("2/1"),
+		Time:     start.Format("15:04"),
+		Link:     "https://tengocita.app/c/" + customerLink,
+		Code:     customerCodeWithChecksum(customerCode),
+		start:    start,
+	}
+}
+
+func (v messageVars) withDelay(delay time.Duration) messageVars {
+	v.delay = delay.Truncate(time.Minute)
+	v.Delay = fmt.Sprintf("%d min", int(v.delay/time.Minute))
+	return v
+}
+
+// defaultText is the message of kind k for businesses without a template for
+// it.
+func (k messageKind) defaultText(l locale, v messageVars) string {
+	switch k {
+	case messageCreated:
+		recurrence := ""
+		if v.recurrence != "" {
+			recurrence = " " + v.recurrence
+		}
+		return l.sprintf("created.message", v.Business, l.when(v.start), recurrence, v.Link)
+	case messageCreatedSMS:
+		return smsWithName(l.sprintf("created.sms", l.when(v.start), v.Link), v.Business)
+	case messageUpdated:
+		return l.sprintf("updated.message", v.Business, l.when(v.start), v.Link)
+	case messageUpdatedPush:
+		return l.sprintf("updated.body", v.Business, l.when(v.start))
+	case messageCanceled:
+		return l.sprintf("canceled.message", v.Business, v.Link)
+	case messageCanceledPush:
+		return l.sprintf("canceled.body", v.Business, v.Date)
+	case messageReminderPush:
+		return l.sprintf("youHaveAppointment", v.Business, l.when(v.start))
+	case messageReminderSMS:
+		return smsWithName(l.sprintf("reminder.sms", l.when(v.start), v.Link), v.Business)
+	case messageDelayPush:
+		return l.sprintf("delay.body", v.Business, v.delay)
+	case messageUpdatedSeries:
+		return l.sprintf("updatedSeries.message", v.Business, l.when(v.start), v.Link)
+	case messageUpdatedSeriesPush:
+		return l.sprintf("updatedSeries.body", v.Business, l.when(v.start))
+	case messageCanceledSeries:
+		return l.sprintf("canceledSeries.message", messageCanceledSeriesPush.defaultText(l, v), v.Link)
+	case messageCanceledSeriesPush:
+		if v.Count == 1 {
+			return l.sprintf("canceled.body", v.Business, v.Date)
+		}
+		return l.sprintf("canceledSeries.body", v.Count, v.Business, v.Date)
+	case messageOfferSMS:
+		return smsWithName(l.sprintf("offer.sms", l.when(v.start), v.Deadline, v.Link), v.Business)
+	case messageQueued:
+		return l.sprintf("queue.message", v.Number, v.Business, v.Link)
+	case messageQueuedSMS:
+		return smsWithName(l.sprintf("queue.sms", v.Number, v.Link), v.Business)
+	default:
+		panic(fmt.Sprintf("unknown message kind %q", k))
+	}
+}
+
+// renderTemplate executes src with v. For SMS, the result must fit in a single
+// GSM-7 message.
+func (k messageKind) renderTemplate(src string, v messageVars) (msg string, problem interface{}) {
+	if len(src) > maxMessageTemplateLength {
+		return "", badTemplate{Error: fmt.Sprintf("longer than %d characters", maxMessageTemplateLength)}
+	}
+	tpl, err := template.New(string(k)).Parse(src)
+	if err != nil {
+		return "", badTemplate{Error: err.Error()}
+	}
+	var b strings.Builder
+	err = tpl.Execute(&b, v)
+	if err != nil {
+		return "", badTemplate{Error: err.Error()}
+	}
+	msg = strings.TrimSpace(b.String())
+	if msg == "" {
+		return "", badTemplate{Error: "empty message"}
+	}
+	if k.sms() {
+		n, bad := gsm7Length(msg)
+		if bad != "" {
+			return "", smsNotGSM7{Chars: bad}
+		}
+		if n > maxSMSLength {
+			return "", smsTooLong{Length: n, Max: maxSMSLength}
+		}
+	}
+	return msg, nil
+}
+
+// renderMessage renders the business' template of kind k in locale l, or the
+// default text in l if there's none. Templates are checked when saved, but
+// they may still not fit an SMS if, say, the business' name changes; the
+// default text is used then too.
+func renderMessage(ctx context.Context, db sqler.Queryer, businessID string, k messageKind, l locale, v messageVars) (string, error) {
+	var src string
+	err := db.QueryRow(ctx, `
+		SELECT template FROM message_templates WHERE business_id = $1 AND kind = $2 AND locale = $3;
+	`, businessID, k, l).Scan(&src)
+	if errors.Is(err, sql.ErrNoRows) {
+		return k.defaultText(l, v), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("fetching %s message template: %w", k, err)
+	}
+	msg, problem := k.renderTemplate(src, v)
+	if problem != nil {
+		log(ctx).Printf("Using default %s message instead of template: %+v", k, problem)
+		return k.defaultText(l, v), nil
+	}
+	return msg, nil
+}
+
+// gsm7Basic and gsm7Extension are the GSM 03.38 alphabet. Extension characters
+// take two septets.
+const (
+	gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extension = "\f^{}\\[~]|€"
+)
+
+// gsm7Length returns how many septets s takes in a GSM-7 SMS, and the
+// characters in s that GSM-7 can't encode, if any.
+func gsm7Length(s string) (n int, bad string) {
+	var badChars strings.Builder
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune(gsm7Basic, r):
+			n++
+		case strings.ContainsRune(gsm7Extension, r):
+			n += 2
+		case !strings.ContainsRune(badChars.String(), r):
+			badChars.WriteRune(r)
+		}
+	}
+	return n, badChars.String()
+}
+
+// sampleMessageVars are used for previews and to check templates on save.
+// The date and link are as long as real ones can be.
+func sampleMessageVars(ctx context.Context, db sqler.Queryer, businessID string) (messageVars, error) {
+	businessName, loc, err := fetchBusinessNameAndLocation(ctx, db, businessID)
+	if err != nil {
+		return messageVars{}, err
+	}
+	start := time.Date(now().In(loc).Year(), time.December, 31, 17, 30, 0, 0, loc)
+	v := newMessageVars(businessName, start, "AbCdEfGhIjKl", 1234).withDelay(15 * time.Minute)
+	v.Number = 123
+	v.Count = 12
+	v.Deadline = "16:30"
+	return v, nil
+}
+
+// templateLocale is the locale that message template actions are for: l, or
+// the business' one if l is empty. ok is false if l isn't valid.
+func templateLocale(ctx context.Context, db sqler.Queryer, businessID string, l locale) (_ locale, ok bool, err error) {
+	if l == "" {
+		l, err = businessLocale(ctx, db, businessID)
+		return l, err == nil, err
+	}
+	return l, l.valid(), nil
+}
+
+type getMessageTemplatesAction struct {
+	// Locale defaults to the business' one.
+	Locale locale `json:"locale,omitempty"`
+}
+
+type (
+	// badLocale
+	messageTemplates []messageTemplate
+	messageTemplate  struct {
+		Kind messageKind `json:"kind"`
+		// Template is nil if the business uses the default text.
+		Template *string `json:"template"`
+		SMS      bool    `json:"sms"`
+	}
+)
+
+func (a getMessageTemplatesAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	l, ok, err := templateLocale(ctx, srv.db, businessID, a.Locale)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return badLocale{}, nil
+	}
+
+	rows, err := srv.db.Query(ctx, `
+		SELECT kind, template FROM message_templates WHERE business_id = $1 AND locale = $2;
+	`, businessID, l)
+	if err != nil {
+		return nil, fmt.Errorf("selecting message templates: %w", err)
+	}
+	defer rows.Close()
+
+	templates := map[messageKind]string{}
+	for rows.Next() {
+		var k messageKind
+		var src string
+		err := rows.Scan(&k, &src)
+		if err != nil {
+			return nil, fmt.Errorf("scanning message template: %w", err)
+		}
+		templates[k] = src
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fetching next message template: %w", err)
+	}
+
+	list := messageTemplates{}
+	for _, k := range messageKinds {
+		t := messageTemplate{Kind: k, SMS: k.sms()}
+		if src, ok := templates[k]; ok {
+			t.Template = &src
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+type setMessageTemplateAction struct {
+	Kind messageKind `json:"kind"`
+	// Locale is of the customers who get the message. Defaults to the
+	// business' one.
+	Locale locale `json:"locale,omitempty"`
+	// Template is a Go text/template over messageVars. Empty goes back to the
+	// default text.
+	Template string `json:"template"`
+}
+
+type (
+	// badLocale
+	badMessageKind struct{}
+	badTemplate    struct {
+		Error string `json:"error"`
+	}
+	// smsNotGSM7 is for SMS templates with characters that GSM-7 can't
+	// encode. Such messages would be sent as UCS-2, which only fits 70
+	// characters.
+	smsNotGSM7 struct {
+		Chars string `json:"chars"`
+	}
+	smsTooLong struct {
+		Length int `json:"length"`
+		Max    int `json:"max"`
+	}
+	// messagePreview
+)
+
+func (a setMessageTemplateAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if !a.Kind.valid() {
+		return badMessageKind{}, nil
+	}
+	l, ok, err := templateLocale(ctx, srv.db, businessID, a.Locale)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return badLocale{}, nil
+	}
+
+	if strings.TrimSpace(a.Template) == "" {
+		_, err := srv.db.Exec(ctx, `
+			DELETE FROM message_templates WHERE business_id = $1 AND kind = $2 AND locale = $3;
+		`, businessID, a.Kind, l)
+		if err != nil {
+			return nil, fmt.Errorf("deleting message template: %w", err)
+		}
+		return previewMessageTemplateAction{Kind: a.Kind, Locale: l}.serveAction(ctx, srv, businessID)
+	}
+
+	v, err := sampleMessageVars(ctx, srv.db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	_, problem := a.Kind.renderTemplate(a.Template, v)
+	if problem != nil {
+		return problem, nil
+	}
+
+	_, err = srv.db.Exec(ctx, `
+		INSERT INTO message_templates
+			(business_id, kind, locale, template)
+		VALUES
+			($1, $2, $3, $4)
+		ON CONFLICT (business_id, kind, locale) DO UPDATE SET
+			template = excluded.template,
+			updated_at = now()
+		;
+	`, businessID, a.Kind, l, a.Template)
+	if err != nil {
+		return nil, fmt.Errorf("upserting message template: %w", err)
+	}
+
+	return previewMessageTemplateAction{Kind: a.Kind, Locale: l, Template: &a.Template}.serveAction(ctx, srv, businessID)
+}
+
+type previewMessageTemplateAction struct {
+	Kind messageKind `json:"kind"`
+	// Locale defaults to the business' one.
+	Locale locale `json:"locale,omitempty"`
+	// Template, if not set, is the one the business has saved, if any.
+	Template *string `json:"template,omitempty"`
+}
+
+type (
+	messagePreview struct {
+		Message string `json:"message"`
+		// Default is whether Message is the default text, because there's no
+		// template.
+		Default bool `json:"default"`
+		// Length is in GSM-7 septets, for SMS.
+		Length int `json:"length,omitempty"`
+	}
+	// badLocale
+	// badMessageKind
+	// badTemplate
+	// smsNotGSM7
+	// smsTooLong
+)
+
+func (a previewMessageTemplateAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if !a.Kind.valid() {
+		return badMessageKind{}, nil
+	}
+	l, ok, err := templateLocale(ctx, srv.db, businessID, a.Locale)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return badLocale{}, nil
+	}
+
+	src := a.Template
+	if src == nil {
+		var saved string
+		err := srv.db.QueryRow(ctx, `
+			SELECT template FROM message_templates WHERE business_id = $1 AND kind = $2 AND locale = $3;
+		`, businessID, a.Kind, l).Scan(&saved)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("fetching %s message template: %w", a.Kind, err)
+		}
+		if err == nil {
+			src = &saved
+		}
+	}
+
+	v, err := sampleMessageVars(ctx, srv.db, businessID)
+	if err != nil {
+		return nil, err
+	}
+
+	var preview messagePreview
+	if src == nil || strings.TrimSpace(*src) == "" {
+		preview = messagePreview{Message: a.Kind.defaultText(l, v), Default: true}
+	} else {
+		msg, problem := a.Kind.renderTemplate(*src, v)
+		if problem != nil {
+			return problem, nil
+		}
+		preview = messagePreview{Message: msg}
+	}
+	if a.Kind.sms() {
+		preview.Length, _ = gsm7Length(preview.Message)
+	}
+	return preview, nil
+}
@@ -0,0 +1,393 @@
+-- Brings databases migrated with staff.sql up to date with sql.sql. Run it
+-- after staff.sql.
+--
+-- Existing appointments get their day in the business' time zone, which is
+-- Europe/Madrid for every business until they change it, and their customer
+-- codes become unique per that day instead of per UTC day; the few that would
+-- clash get new codes. Businesses keep taking bookings at any time until they
+-- set their opening hours.
+BEGIN;
+
+ALTER TABLE businesses
+    ADD COLUMN "slug" text NULL UNIQUE,
+    ADD COLUMN "self_booking" boolean NOT NULL DEFAULT false,
+    ADD COLUMN "reminder_lead_minutes" int[] NOT NULL DEFAULT '{1440, 120}',
+    ADD COLUMN "no_show_grace_minutes" int NULL DEFAULT 60,
+    ADD COLUMN "time_zone" text NOT NULL DEFAULT 'Europe/Madrid',
+    ADD COLUMN "locale" text NOT NULL DEFAULT 'es',
+    -- The default is evaluated for each row, so every business gets its own.
+    ADD COLUMN "calendar_feed_token" text NOT NULL UNIQUE DEFAULT base64_web_encode(random_bytea(12));
+
+-- random_customer_code is four random digits from 1 to 9.
+CREATE OR REPLACE FUNCTION random_customer_code()
+RETURNS int AS $body$
+    SELECT 0 +
+        width_bucket(random(), 0, 1, 9) * 1 +
+        width_bucket(random(), 0, 1, 9) * 10 +
+        width_bucket(random(), 0, 1, 9) * 100 +
+        width_bucket(random(), 0, 1, 9) * 1000;
+$body$
+LANGUAGE sql
+VOLATILE;
+
+-- business_day is the date of t in the business' time zone. Appointments are
+-- bucketed into days with it.
+CREATE OR REPLACE FUNCTION business_day(business_id text, t timestamptz)
+RETURNS date AS $body$
+    SELECT (t AT TIME ZONE b.time_zone) :: date FROM businesses b WHERE b.id = business_id;
+$body$
+LANGUAGE sql
+STABLE;
+
+CREATE TABLE "opening_hours" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "weekday" int NOT NULL,
+    "opens" time NOT NULL,
+    "closes" time NOT NULL,
+    PRIMARY KEY ("business_id", "weekday", "opens"),
+    CHECK ("weekday" BETWEEN 0 AND 6),
+    CHECK ("opens" < "closes")
+) WITH (oids = false);
+
+CREATE TABLE "opening_exceptions" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "day" date NOT NULL,
+    "opens" time NULL,
+    "closes" time NULL,
+    "reason" text NULL,
+    PRIMARY KEY ("business_id", "id"),
+    CHECK (("opens" IS NULL) = ("closes" IS NULL)),
+    CHECK ("opens" < "closes")
+) WITH (oids = false);
+
+CREATE INDEX ON opening_exceptions ("business_id", "day");
+
+CREATE TABLE "services" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NOT NULL,
+    "duration" interval NOT NULL,
+    "price_cents" int NULL,
+    "color" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "deleted_at" timestamptz NULL,
+    PRIMARY KEY ("business_id", "id"),
+    CHECK ("duration" > interval '0'),
+    CHECK ("price_cents" >= 0)
+) WITH (oids = false);
+
+CREATE TABLE "resources" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NOT NULL,
+    "kind" text NOT NULL,
+    "staff_id" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "deleted_at" timestamptz NULL,
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "staff_id") REFERENCES "staff" ("business_id", "id") ON UPDATE CASCADE,
+    CHECK ("kind" IN ('staff', 'room', 'chair')),
+    CHECK (NOT (("staff_id" IS NOT NULL) AND ("kind" <> 'staff')))
+) WITH (oids = false);
+
+-- phone is in international format and email in lowercase, so that
+-- appointments can be matched to customers.
+CREATE TABLE "customers" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NULL,
+    "phone" text NULL,
+    "email" text NULL,
+    "notes" text NOT NULL DEFAULT '',
+    "tags" text[] NOT NULL DEFAULT '{}',
+    "marketing_consent_at" timestamptz NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "id")
+) WITH (oids = false);
+
+CREATE UNIQUE INDEX ON customers ("business_id", "phone");
+CREATE UNIQUE INDEX ON customers ("business_id", "email");
+CREATE INDEX ON customers ("business_id", (COALESCE("name", '')), "id");
+
+-- until and count are as requested; the appointments are created upfront.
+CREATE TABLE "appointment_series" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "frequency" text NOT NULL,
+    "interval" int NOT NULL,
+    "until" timestamptz NULL,
+    "count" int NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "id"),
+    CHECK ("frequency" IN ('weekly', 'monthly'))
+) WITH (oids = false);
+
+ALTER TABLE appointments
+    ALTER COLUMN "customer_code" SET DEFAULT random_customer_code(),
+    ADD COLUMN "day" date NULL,
+    ADD COLUMN "no_show_at" timestamptz,
+    ADD COLUMN "no_show_cleared_at" timestamptz,
+    ADD COLUMN "confirmed_at" timestamptz,
+    ADD COLUMN "can_send_emails" boolean NOT NULL DEFAULT true,
+    ADD COLUMN "service_id" text NULL,
+    ADD COLUMN "resource_id" text NULL,
+    ADD COLUMN "customer_id" text NULL,
+    ADD COLUMN "series_id" text NULL,
+    ADD COLUMN "walk_in" boolean NOT NULL DEFAULT false,
+    ADD COLUMN "locale" text NULL,
+    ADD COLUMN "calendar_sequence" int NOT NULL DEFAULT 0,
+    ADD FOREIGN KEY ("business_id", "service_id") REFERENCES "services" ("business_id", "id") ON UPDATE CASCADE,
+    ADD FOREIGN KEY ("business_id", "resource_id") REFERENCES "resources" ("business_id", "id") ON UPDATE CASCADE,
+    ADD FOREIGN KEY ("business_id", "customer_id") REFERENCES "customers" ("business_id", "id") ON UPDATE CASCADE,
+    ADD FOREIGN KEY ("business_id", "series_id") REFERENCES "appointment_series" ("business_id", "id") ON UPDATE CASCADE,
+    ADD CHECK (NOT (("no_show_at" IS NOT NULL) AND (("started_at" IS NOT NULL) OR ("canceled_at" IS NOT NULL))));
+
+UPDATE appointments SET day = business_day(business_id, start);
+ALTER TABLE appointments ALTER COLUMN "day" SET NOT NULL;
+
+-- The customer code index was on the UTC day, with a generated name.
+DO $body$
+DECLARE
+    index_name text;
+BEGIN
+    SELECT indexname INTO STRICT index_name
+    FROM pg_indexes
+    WHERE tablename = 'appointments' AND indexdef LIKE '%customer_code%';
+    EXECUTE format('DROP INDEX %I', index_name);
+END;
+$body$;
+
+-- Codes that clash on the new days are regenerated until none do.
+DO $body$
+BEGIN
+    LOOP
+        UPDATE appointments a SET
+            customer_code = random_customer_code()
+        WHERE EXISTS (
+            SELECT 1 FROM appointments o
+            WHERE
+                o.business_id = a.business_id AND o.day = a.day
+                AND o.customer_code = a.customer_code AND o.id < a.id
+        );
+        EXIT WHEN NOT FOUND;
+    END LOOP;
+END;
+$body$;
+
+CREATE INDEX ON appointments ("business_id", "resource_id", "start");
+CREATE INDEX ON appointments ("business_id", "start", "id");
+CREATE INDEX ON appointments ("business_id", "customer_id", "start");
+CREATE INDEX ON appointments ("business_id", "series_id", "start");
+CREATE UNIQUE INDEX appointments_business_id_day_customer_code_idx ON appointments ("business_id", "day", "customer_code");
+
+CREATE OR REPLACE FUNCTION set_appointment_day()
+RETURNS trigger AS $body$
+BEGIN
+    NEW.day := business_day(NEW.business_id, NEW.start);
+    RETURN NEW;
+END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER appointment_day
+BEFORE INSERT OR UPDATE OF start ON appointments
+FOR EACH ROW EXECUTE PROCEDURE set_appointment_day();
+
+-- Calendar apps only replace a saved event if its SEQUENCE is higher. Both the
+-- customer's .ics and the business' feed use it, so it changes with anything
+-- either of them shows.
+CREATE OR REPLACE FUNCTION increment_appointment_calendar_sequence()
+RETURNS trigger AS $body$
+BEGIN
+    NEW.calendar_sequence := OLD.calendar_sequence + 1;
+    RETURN NEW;
+END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER appointment_calendar_sequence
+BEFORE UPDATE OF
+    start, "end", canceled_at, no_show_at, finished_at, service_id,
+    number, name, phone, email, comments, cancel_reason
+ON appointments
+FOR EACH ROW
+WHEN (
+    (NEW.start, NEW."end", NEW.canceled_at, NEW.no_show_at, NEW.finished_at, NEW.service_id,
+        NEW.number, NEW.name, NEW.phone, NEW.email, NEW.comments, NEW.cancel_reason)
+    IS DISTINCT FROM
+    (OLD.start, OLD."end", OLD.canceled_at, OLD.no_show_at, OLD.finished_at, OLD.service_id,
+        OLD.number, OLD.name, OLD.phone, OLD.email, OLD.comments, OLD.cancel_reason)
+)
+EXECUTE PROCEDURE increment_appointment_calendar_sequence();
+
+-- Changes to appointments are notified on the appointment_events channel, so
+-- that every server instance can stream them to the business app. Changes only
+-- to how the customer is notified aren't interesting for the business.
+-- Transactions that change many appointments at once set
+-- tengocita.quiet_appointment_events and notify a single resync event instead.
+CREATE OR REPLACE FUNCTION notify_appointment_event()
+RETURNS trigger AS $body$
+DECLARE
+    event text;
+BEGIN
+    IF current_setting('tengocita.quiet_appointment_events', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'INSERT' THEN
+        event := 'created';
+    ELSIF to_jsonb(NEW) - 'push_subscription' - 'can_send_emails' - 'locale' = to_jsonb(OLD) - 'push_subscription' - 'can_send_emails' - 'locale' THEN
+        RETURN NULL;
+    ELSIF NEW.canceled_at IS NOT NULL AND OLD.canceled_at IS NULL THEN
+        event := 'canceled';
+    ELSIF NEW.finished_at IS NOT NULL AND OLD.finished_at IS NULL THEN
+        event := 'finished';
+    ELSIF NEW.started_at IS NOT NULL AND OLD.started_at IS NULL THEN
+        event := 'started';
+    ELSE
+        event := 'updated';
+    END IF;
+    PERFORM pg_notify('appointment_events', json_build_object(
+        'businessId', NEW.business_id,
+        'appointmentId', NEW.id,
+        'event', event
+    ) :: text);
+    RETURN NULL;
+END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER appointment_events
+AFTER INSERT OR UPDATE ON appointments
+FOR EACH ROW EXECUTE PROCEDURE notify_appointment_event();
+
+-- channel is NULL for reminders that were due at the same time as a
+-- shorter one, and so weren't sent.
+CREATE TABLE "appointment_reminders" (
+    "business_id" text NOT NULL,
+    "appointment_id" text NOT NULL,
+    "lead_minutes" int NOT NULL,
+    "channel" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "appointment_id", "lead_minutes"),
+    FOREIGN KEY ("business_id", "appointment_id") REFERENCES "appointments" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
+) WITH (oids = false);
+
+-- slots is a JSON array of {"start", "end"} objects.
+CREATE TABLE "reschedule_requests" (
+    "business_id" text NOT NULL,
+    "id" text NOT NULL,
+    "appointment_id" text NOT NULL,
+    "slots" json NOT NULL,
+    "comments" text,
+    "status" text NOT NULL DEFAULT 'pending' CHECK ("status" IN ('pending', 'accepted', 'rejected', 'withdrawn')),
+    "reason" text,
+    "accepted_start" timestamptz,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "resolved_at" timestamptz,
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "appointment_id") REFERENCES "appointments" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
+) WITH (oids = false);
+
+CREATE INDEX ON reschedule_requests ("business_id", "appointment_id", "created_at");
+CREATE UNIQUE INDEX ON reschedule_requests ("business_id", "appointment_id") WHERE "status" = 'pending';
+
+CREATE TABLE "waitlist_entries" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NULL,
+    "phone" text NULL,
+    "email" text NULL,
+    "service_id" text NULL,
+    "resource_id" text NULL,
+    "from" timestamptz NOT NULL,
+    "to" timestamptz NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "claimed_at" timestamptz NULL,
+    "removed_at" timestamptz NULL,
+    "locale" text NULL,
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "service_id") REFERENCES "services" ("business_id", "id") ON UPDATE CASCADE,
+    FOREIGN KEY ("business_id", "resource_id") REFERENCES "resources" ("business_id", "id") ON UPDATE CASCADE,
+    CHECK (NOT (("email" IS NULL) AND ("phone" IS NULL))),
+    CHECK ("from" < "to")
+) WITH (oids = false);
+
+CREATE INDEX ON waitlist_entries ("business_id", "created_at") WHERE "claimed_at" IS NULL AND "removed_at" IS NULL;
+
+-- resource_id is '' for slots without resource. Only one offer per slot can be
+-- pending at a time.
+CREATE TABLE "waitlist_offers" (
+    "business_id" text NOT NULL,
+    "id" text NOT NULL,
+    "entry_id" text NOT NULL,
+    "token" text NOT NULL UNIQUE DEFAULT base64_web_encode(random_bytea(9)),
+    "start" timestamptz NOT NULL,
+    "end" timestamptz NOT NULL,
+    "resource_id" text NOT NULL DEFAULT '',
+    "service_id" text NULL,
+    "status" text NOT NULL DEFAULT 'pending' CHECK ("status" IN ('pending', 'claimed', 'expired', 'unavailable')),
+    "expires_at" timestamptz NOT NULL,
+    "appointment_id" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "entry_id") REFERENCES "waitlist_entries" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
+) WITH (oids = false);
+
+CREATE UNIQUE INDEX ON waitlist_offers ("business_id", "resource_id", "start") WHERE "status" = 'pending';
+CREATE INDEX ON waitlist_offers ("expires_at") WHERE "status" = 'pending';
+
+ALTER TABLE delay_alerts
+    ADD COLUMN "resource_id" text NOT NULL DEFAULT '',
+    DROP CONSTRAINT delay_alerts_pkey,
+    ADD PRIMARY KEY ("business_id", "resource_id");
+
+CREATE TABLE "outbox" (
+    "id" text NOT NULL PRIMARY KEY,
+    "business_id" text NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "appointment_id" text NULL,
+    "channel" text NOT NULL CHECK ("channel" IN ('push', 'sms', 'email')),
+    "recipient" text NOT NULL,
+    "payload" json NOT NULL,
+    "status" text NOT NULL DEFAULT 'pending' CHECK ("status" IN ('pending', 'sent', 'dead')),
+    "attempts" int NOT NULL DEFAULT 0,
+    "max_attempts" int NOT NULL,
+    "next_attempt_at" timestamptz NOT NULL DEFAULT now(),
+    "locked_until" timestamptz,
+    "last_error" text,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "sent_at" timestamptz
+) WITH (oids = false);
+
+CREATE INDEX ON outbox ("channel", "next_attempt_at") WHERE "status" = 'pending';
+
+CREATE TABLE "sms_messages" (
+    "id" text NOT NULL PRIMARY KEY,
+    "outbox_id" text NOT NULL REFERENCES "outbox" ("id") ON DELETE CASCADE,
+    "business_id" text NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "appointment_id" text NULL,
+    "phone" text NOT NULL,
+    "provider" text NOT NULL,
+    "provider_message_id" text NULL,
+    "status" text NOT NULL CHECK ("status" IN ('sent', 'delivered', 'failed')),
+    "error" text,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "updated_at" timestamptz NOT NULL DEFAULT now(),
+    UNIQUE ("provider", "provider_message_id")
+) WITH (oids = false);
+
+CREATE INDEX ON sms_messages ("business_id", "appointment_id", "created_at");
+
+-- template is a text/template over messageVars that replaces the default text
+-- of a kind of message to customers.
+-- Templates are per locale, as each customer gets messages in theirs.
+CREATE TABLE "message_templates" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "kind" text NOT NULL,
+    "locale" text NOT NULL,
+    "template" text NOT NULL,
+    "updated_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "kind", "locale")
+) WITH (oids = false);
+
+COMMIT;
@@ -0,0 +1,39 @@
+-- Moves the login credentials from businesses to staff, for databases created
+-- before staff members existed. Each business' credentials become its owner's,
+-- with the business' ID as the owner's staff ID, and existing sessions become
+-- the owner's, so nobody is logged out.
+BEGIN;
+
+CREATE TABLE "staff" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "email" text NULL UNIQUE,
+    "phone" text NULL UNIQUE,
+    "password" text NULL,
+    "name" text NULL,
+    "role" text NOT NULL,
+    "invite_token" text NULL UNIQUE,
+    "disabled_at" timestamptz NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "last_login" timestamptz NULL,
+    PRIMARY KEY ("business_id", "id"),
+    CHECK ("role" IN ('owner', 'receptionist', 'practitioner')),
+    CHECK (NOT (("email" IS NULL) AND ("phone" IS NULL))),
+    CHECK (NOT (("password" IS NULL) AND ("invite_token" IS NULL)))
+) WITH (oids = false);
+
+INSERT INTO staff
+    (business_id, id, email, phone, password, role, created_at, last_login)
+SELECT
+    id, id, email, phone, password, 'owner', created_at, last_login
+FROM businesses;
+
+ALTER TABLE business_sessions ADD COLUMN "staff_id" text NULL;
+UPDATE business_sessions SET staff_id = business_id;
+ALTER TABLE business_sessions ALTER COLUMN "staff_id" SET NOT NULL;
+ALTER TABLE business_sessions ADD FOREIGN KEY ("business_id", "staff_id")
+    REFERENCES "staff" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE;
+
+ALTER TABLE businesses DROP COLUMN "password";
+
+COMMIT;
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tcard/sqler"
+)
+
+const (
+	noShowInterval       = 5 * time.Minute
+	maxNoShowGracePeriod = 7 * 24 * time.Hour
+)
+
+type markNoShowAction struct {
+	ID string `json:"id"`
+	// NoShow false undoes a previous mark, and keeps the appointment from
+	// being marked again automatically.
+	NoShow bool `json:"noShow"`
+}
+
+type (
+	// notFound
+	markedNoShow struct {
+		Appointment Appointment `json:"appointment"`
+	}
+)
+
+func (a markNoShowAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	// Appointments that haven't started yet can't be missed.
+	var app Appointment
+	row := srv.db.QueryRow(ctx, `
+		UPDATE appointments SET
+			no_show_at = CASE WHEN $3 THEN COALESCE(no_show_at, now()) END,
+			no_show_cleared_at = CASE WHEN $3 THEN NULL ELSE now() END
+		WHERE
+			business_id = $1 AND id = $2
+			AND started_at IS NULL AND canceled_at IS NULL AND finished_at IS NULL
+			AND start <= now()
+		RETURNING `+appointmentColumns+`
+		;
+	`, businessID, a.ID, a.NoShow)
+	err := scanAppointment(row, &app)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("marking no-show for businessID=%v id=%v: %w", businessID, a.ID, err)
+	}
+
+	return markedNoShow{Appointment: app}, nil
+}
+
+type getNoShowGracePeriodAction struct{}
+
+type (
+	noShowGracePeriod struct {
+		// GracePeriod is how long after an appointment's end it's marked as
+		// a no-show if it hasn't started. Nil if appointments aren't marked
+		// automatically.
+		GracePeriod *time.Duration `json:"gracePeriod,omitempty"`
+	}
+)
+
+func (a getNoShowGracePeriodAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var minutes sql.NullInt64
+	err := srv.db.QueryRow(ctx, `
+		SELECT no_show_grace_minutes
+		FROM businesses
+		WHERE
+			id = $1
+		;
+	`, businessID).Scan(&minutes)
+	if err != nil {
+		return nil, fmt.Errorf("fetching no-show grace period: %w", err)
+	}
+
+	var result noShowGracePeriod
+	if minutes.Valid {
+		d := time.Duration(minutes.Int64) * time.Minute
+		result.GracePeriod = &d
+	}
+	return result, nil
+}
+
+type setNoShowGracePeriodAction struct {
+	// GracePeriod nil disables automatic marking.
+	GracePeriod *time.Duration `json:"gracePeriod"`
+}
+
+type (
+	badGracePeriod struct{}
+	// noShowGracePeriod
+)
+
+func (a setNoShowGracePeriodAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var minutes *int64
+	if a.GracePeriod != nil {
+		if *a.GracePeriod < 0 || *a.GracePeriod > maxNoShowGracePeriod {
+			return badGracePeriod{}, nil
+		}
+		m := int64(*a.GracePeriod / time.Minute)
+		minutes = &m
+	}
+
+	_, err := srv.db.Exec(ctx, `
+		UPDATE businesses SET
+			no_show_grace_minutes = $2
+		WHERE
+			id = $1
+		;
+	`, businessID, minutes)
+	if err != nil {
+		return nil, fmt.Errorf("updating no-show grace period: %w", err)
+	}
+
+	var result noShowGracePeriod
+	if minutes != nil {
+		d := time.Duration(*minutes) * time.Minute
+		result.GracePeriod = &d
+	}
+	return result, nil
+}
+
+type countNoShowsAction struct {
+	Phone string `json:"phone,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+type (
+	// missingEmailOrPhone
+	noShowCount struct {
+		Count int        `json:"count"`
+		Last  *time.Time `json:"last,omitempty"`
+	}
+)
+
+func (a countNoShowsAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Phone = trimPhone(a.Phone)
+	a.Email = strings.TrimSpace(a.Email)
+	if a.Phone == "" && a.Email == "" {
+		return missingEmailOrPhone{}, nil
+	}
+
+	return countNoShows(ctx, srv.db, businessID, a.Phone, a.Email)
+}
+
+// countNoShows counts a customer's no-shows at a business, by phone or email.
+func countNoShows(ctx context.Context, db sqler.Queryer, businessID, phone, email string) (noShowCount, error) {
+	var c noShowCount
+	err := db.QueryRow(ctx, `
+		SELECT count(*), max(start)
+		FROM appointments
+		WHERE
+			business_id = $1 AND no_show_at IS NOT NULL
+			AND (phone = $2 OR email = $3)
+		;
+	`, businessID, nilIfEmpty(phone), nilIfEmpty(email)).Scan(&c.Count, &c.Last)
+	if err != nil {
+		return noShowCount{}, fmt.Errorf("counting no-shows: %w", err)
+	}
+	return c, nil
+}
+
+// noShowLoop marks as no-shows the appointments that haven't started after
+// their business' grace period.
+type noShowLoop struct {
+	db sqler.DB
+}
+
+func (l *noShowLoop) run() {
+	ctx := context.Background()
+	ctx = scope(ctx, "service", "noShows")
+
+	for {
+		time.Sleep(noShowInterval)
+
+		err := l.mark(ctx, now())
+		if err != nil {
+			log(ctx).Printf("%s", err)
+		}
+	}
+}
+
+// mark marks the appointments whose grace period is over at t.
+func (l *noShowLoop) mark(ctx context.Context, t time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	res, err := l.db.Exec(ctx, `
+		UPDATE appointments a SET
+			no_show_at = $1
+		FROM businesses b
+		WHERE
+			b.id = a.business_id AND b.no_show_grace_minutes IS NOT NULL
+			AND a."end" + b.no_show_grace_minutes * interval '1 minute' < $1
+			AND a.started_at IS NULL AND a.canceled_at IS NULL AND a.finished_at IS NULL
+			AND a.no_show_at IS NULL AND a.no_show_cleared_at IS NULL AND NOT a.walk_in
+		;
+	`, t)
+	if err != nil {
+		return fmt.Errorf("marking no-shows: %w", err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected > 0 {
+		log(ctx).Printf("Marked %d appointments as no-shows", affected)
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// OpeningHours is a range of time within a day, as "15:04" strings in the
+// business' local time.
+type OpeningHours struct {
+	Opens  string `json:"opens"`
+	Closes string `json:"closes"`
+}
+
+type WeeklyOpeningHours struct {
+	Weekday time.Weekday `json:"weekday"`
+	OpeningHours
+}
+
+// OpeningException replaces the weekly opening hours for a day. An exception
+// without hours means the business is closed that day.
+type OpeningException struct {
+	ID     string  `json:"id"`
+	Day    string  `json:"day"`
+	Opens  *string `json:"opens,omitempty"`
+	Closes *string `json:"closes,omitempty"`
+	Reason *string `json:"reason,omitempty"`
+}
+
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (s Slot) overlaps(o Slot) bool {
+	return s.Start.Before(o.End) && o.Start.Before(s.End)
+}
+
+func (s Slot) contains(o Slot) bool {
+	return !o.Start.Before(s.Start) && !o.End.After(s.End)
+}
+
+const dayFormat = "2006-01-02"
+
+// schedule holds the opening hours of a business. A business without weekly
+// opening hours is considered always open, except for its exceptions.
+type schedule struct {
+	loc        *time.Location
+	weekly     map[time.Weekday][]OpeningHours
+	exceptions map[string][]OpeningHours
+}
+
+func loadSchedule(ctx context.Context, db sqler.Queryer, businessID string) (schedule, error) {
+	loc, err := businessLocation(ctx, db, businessID)
+	if err != nil {
+		return schedule{}, err
+	}
+	s := schedule{
+		loc:        loc,
+		weekly:     map[time.Weekday][]OpeningHours{},
+		exceptions: map[string][]OpeningHours{},
+	}
+
+	weekly, err := fetchWeeklyOpeningHours(ctx, db, businessID)
+	if err != nil {
+		return schedule{}, err
+	}
+	for _, h := range weekly {
+		s.weekly[h.Weekday] = append(s.weekly[h.Weekday], h.OpeningHours)
+	}
+
+	exceptions, err := fetchOpeningExceptions(ctx, db, businessID)
+	if err != nil {
+		return schedule{}, err
+	}
+	for _, e := range exceptions {
+		hours := s.exceptions[e.Day]
+		if e.Opens != nil {
+			hours = append(hours, OpeningHours{Opens: *e.Opens, Closes: *e.Closes})
+		}
+		s.exceptions[e.Day] = hours
+	}
+
+	return s, nil
+}
+
+// openSlots returns the periods in which the business is open between from
+// and to.
+func (s schedule) openSlots(from, to time.Time) []Slot {
+	var open []Slot
+	from, to = from.In(s.loc), to.In(s.loc)
+	for y, m, d := from.Date(); ; d++ {
+		day := time.Date(y, m, d, 0, 0, 0, 0, s.loc)
+		if !day.Before(to) {
+			break
+		}
+
+		hours, ok := s.exceptions[day.Format(dayFormat)]
+		if !ok {
+			if len(s.weekly) == 0 {
+				hours = []OpeningHours{{Opens: "00:00", Closes: "24:00"}}
+			} else {
+				hours = s.weekly[day.Weekday()]
+			}
+		}
+
+		for _, h := range hours {
+			slot := Slot{
+				Start: atClock(day, h.Opens),
+				End:   atClock(day, h.Closes),
+			}
+			if slot.Start.Before(from) {
+				slot.Start = from
+			}
+			if slot.End.After(to) {
+				slot.End = to
+			}
+			if slot.Start.Before(slot.End) {
+				open = append(open, slot)
+			}
+		}
+	}
+
+	sort.Slice(open, func(i, j int) bool { return open[i].Start.Before(open[j].Start) })
+	return mergeSlots(open)
+}
+
+func (s schedule) isOpen(slot Slot) bool {
+	for _, open := range s.openSlots(slot.Start, slot.End) {
+		if open.contains(slot) {
+			return true
+		}
+	}
+	return false
+}
+
+func atClock(day time.Time, clock string) time.Time {
+	var h, m int
+	fmt.Sscanf(clock, "%d:%d", &h, &m)
+	y, mo, d := day.Date()
+	return time.Date(y, mo, d, h, m, 0, 0, day.Location())
+}
+
+func mergeSlots(sorted []Slot) []Slot {
+	var merged []Slot
+	for _, s := range sorted {
+		if n := len(merged); n > 0 && !s.Start.After(merged[n-1].End) {
+			if s.End.After(merged[n-1].End) {
+				merged[n-1].End = s.End
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// busySlots returns the slots taken by non-canceled appointments for the
+// resource overlapping the given period, except the one with ID excludeID.
+// Appointments without resource only take slots from each other. Walk-ins
+// are served in between and don't take slots.
+func busySlots(ctx context.Context, db sqler.Queryer, businessID, resourceID string, period Slot, excludeID string) ([]Slot, error) {
+	rows, err := db.Query(ctx, `
+		SELECT start, "end"
+		FROM appointments
+		WHERE
+			business_id = $1 AND start < $3 AND "end" > $2
+			AND canceled_at IS NULL AND no_show_at IS NULL AND id <> $4
+			AND COALESCE(resource_id, '') = $5 AND NOT walk_in
+		ORDER BY start
+		;
+	`, businessID, period.Start, period.End, excludeID, resourceID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching busy slots: %w", err)
+	}
+	defer rows.Close()
+
+	var busy []Slot
+	for rows.Next() {
+		var s Slot
+		err := rows.Scan(&s.Start, &s.End)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		busy = append(busy, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+	return busy, nil
+}
+
+// freeSlots splits the open periods into slots of the given duration,
+// starting every step from each opening, that don't overlap any of the busy
+// ones. Slots starting before notBefore are left out, so that slots later on
+// the same day still start at round times.
+func freeSlots(open, busy []Slot, duration, step time.Duration, notBefore time.Time) []Slot {
+	free := []Slot{}
+	for _, o := range open {
+		start := o.Start
+		if start.Before(notBefore) {
+			// The first step boundary not before notBefore.
+			steps := (notBefore.Sub(start) + step - 1) / step
+			start = start.Add(steps * step)
+		}
+		for ; !start.Add(duration).After(o.End); start = start.Add(step) {
+			candidate := Slot{Start: start, End: start.Add(duration)}
+			taken := false
+			for _, b := range busy {
+				if b.overlaps(candidate) {
+					taken = true
+					break
+				}
+			}
+			if !taken {
+				free = append(free, candidate)
+			}
+		}
+	}
+	return free
+}
+
+type (
+	outsideOpeningHours struct{}
+	slotTaken           struct{}
+)
+
+// checkBookable returns outsideOpeningHours or slotTaken if an appointment
+// can't be booked at slot, or nil if it can. Appointment excludeID is ignored
+// when looking for overlaps, so that it can be moved.
+func checkBookable(ctx context.Context, db sqler.Queryer, businessID, resourceID string, slot Slot, excludeID string) (interface{}, error) {
+	sched, err := loadSchedule(ctx, db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	if !sched.isOpen(slot) {
+		return outsideOpeningHours{}, nil
+	}
+
+	busy, err := busySlots(ctx, db, businessID, resourceID, slot, excludeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(busy) > 0 {
+		return slotTaken{}, nil
+	}
+
+	return nil, nil
+}
+
+func fetchWeeklyOpeningHours(ctx context.Context, db sqler.Queryer, businessID string) ([]WeeklyOpeningHours, error) {
+	rows, err := db.Query(ctx, `
+		SELECT
+			weekday, to_char(opens, 'HH24:MI'), to_char(closes, 'HH24:MI')
+		FROM opening_hours
+		WHERE
+			business_id = $1
+		ORDER BY weekday, opens
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching opening hours: %w", err)
+	}
+	defer rows.Close()
+
+	weekly := []WeeklyOpeningHours{}
+	for rows.Next() {
+		var h WeeklyOpeningHours
+		err := rows.Scan(&h.Weekday, &h.Opens, &h.Closes)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		weekly = append(weekly, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+	return weekly, nil
+}
+
+func fetchOpeningExceptions(ctx context.Context, db sqler.Queryer, businessID string) ([]OpeningException, error) {
+	rows, err := db.Query(ctx, `
+		SELECT
+			id, to_char(day, 'YYYY-MM-DD'),
+			to_char(opens, 'HH24:MI'), to_char(closes, 'HH24:MI'),
+			reason
+		FROM opening_exceptions
+		WHERE
+			business_id = $1
+		ORDER BY day, opens
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching opening exceptions: %w", err)
+	}
+	defer rows.Close()
+
+	exceptions := []OpeningException{}
+	for rows.Next() {
+		var e OpeningException
+		err := rows.Scan(&e.ID, &e.Day, &e.Opens, &e.Closes, &e.Reason)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		exceptions = append(exceptions, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+	return exceptions, nil
+}
+
+func validClock(clock string) bool {
+	var h, m int
+	n, _ := fmt.Sscanf(clock, "%d:%d", &h, &m)
+	return n == 2 && len(clock) == len("15:04") &&
+		h >= 0 && m >= 0 && m < 60 && (h < 24 || h == 24 && m == 0)
+}
+
+func (h OpeningHours) valid() bool {
+	// Zero-padded "15:04" strings compare like the times they represent.
+	return validClock(h.Opens) && validClock(h.Closes) && h.Opens < h.Closes
+}
+
+type getOpeningHoursAction struct{}
+
+type (
+	openingHours struct {
+		Weekly     []WeeklyOpeningHours `json:"weekly"`
+		Exceptions []OpeningException   `json:"exceptions"`
+	}
+)
+
+func (a getOpeningHoursAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	weekly, err := fetchWeeklyOpeningHours(ctx, srv.db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	exceptions, err := fetchOpeningExceptions(ctx, srv.db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	return openingHours{
+		Weekly:     weekly,
+		Exceptions: exceptions,
+	}, nil
+}
+
+type setOpeningHoursAction struct {
+	Weekly []WeeklyOpeningHours `json:"weekly"`
+}
+
+type (
+	badOpeningHours struct{}
+	// ok
+)
+
+func (a setOpeningHoursAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	sort.Slice(a.Weekly, func(i, j int) bool {
+		if a.Weekly[i].Weekday != a.Weekly[j].Weekday {
+			return a.Weekly[i].Weekday < a.Weekly[j].Weekday
+		}
+		return a.Weekly[i].Opens < a.Weekly[j].Opens
+	})
+	for i, h := range a.Weekly {
+		if h.Weekday < time.Sunday || h.Weekday > time.Saturday || !h.valid() {
+			return badOpeningHours{}, nil
+		}
+		if i > 0 && a.Weekly[i-1].Weekday == h.Weekday && a.Weekly[i-1].Closes > h.Opens {
+			return badOpeningHours{}, nil
+		}
+	}
+
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		_, err = tx.Exec(ctx, `
+			DELETE FROM opening_hours WHERE business_id = $1;
+		`, businessID)
+		if err != nil {
+			return false, fmt.Errorf("deleting previous opening hours: %w", err)
+		}
+
+		for _, h := range a.Weekly {
+			_, err = tx.Exec(ctx, `
+				INSERT INTO opening_hours
+					(business_id, weekday, opens, closes)
+				VALUES
+					($1, $2, $3, $4)
+				;
+			`, businessID, h.Weekday, h.Opens, h.Closes)
+			if err != nil {
+				return false, fmt.Errorf("inserting opening hours: %w", err)
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ok{}, nil
+}
+
+type newOpeningExceptionAction struct {
+	Day    string `json:"day"`
+	Opens  string `json:"opens,omitempty"`
+	Closes string `json:"closes,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type (
+	// badOpeningHours
+	openingException OpeningException
+)
+
+func (a newOpeningExceptionAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Reason = strings.TrimSpace(a.Reason)
+
+	if _, err := time.Parse(dayFormat, a.Day); err != nil {
+		return badOpeningHours{}, nil
+	}
+	if (a.Opens != "" || a.Closes != "") && !(OpeningHours{Opens: a.Opens, Closes: a.Closes}).valid() {
+		return badOpeningHours{}, nil
+	}
+
+	e := OpeningException{
+		ID:     ulidx.New(),
+		Day:    a.Day,
+		Opens:  nilIfEmpty(a.Opens),
+		Closes: nilIfEmpty(a.Closes),
+		Reason: nilIfEmpty(a.Reason),
+	}
+	_, err := srv.db.Exec(ctx, `
+		INSERT INTO opening_exceptions
+			(business_id, id, day, opens, closes, reason)
+		VALUES
+			($1, $2, $3, $4, $5, $6)
+		;
+	`, businessID, e.ID, e.Day, e.Opens, e.Closes, e.Reason)
+	if err != nil {
+		return nil, fmt.Errorf("inserting opening exception: %w", err)
+	}
+
+	return openingException(e), nil
+}
+
+type deleteOpeningExceptionAction struct {
+	ID string `json:"id"`
+}
+
+type (
+// ok
+// notFound
+)
+
+func (a deleteOpeningExceptionAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	res, err := srv.db.Exec(ctx, `
+		DELETE FROM opening_exceptions
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("deleting opening exception id=%v: %w", a.ID, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return notFound{}, nil
+	}
+
+	return ok{}, nil
+}
+
+const (
+	maxAvailableSlotsRange = 31 * 24 * time.Hour
+	maxSlotStep            = 15 * time.Minute
+)
+
+type availableSlotsAction struct {
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	ServiceID  string        `json:"serviceId,omitempty"`
+	ResourceID string        `json:"resourceId,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+}
+
+type (
+	// missingStart
+	// missingEnd
+	// unknownService
+	rangeTooLong struct{}
+	slots        []Slot
+)
+
+func (a availableSlotsAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if a.Start.IsZero() {
+		return missingStart{}, nil
+	}
+	if a.End.IsZero() {
+		return missingEnd{}, nil
+	}
+	if a.End.Sub(a.Start) > maxAvailableSlotsRange {
+		return rangeTooLong{}, nil
+	}
+
+	if a.ServiceID != "" {
+		duration, ok, err := serviceDuration(ctx, srv.db, businessID, a.ServiceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownService{}, nil
+		}
+		a.Duration = duration
+	}
+	if a.Duration <= 0 {
+		a.Duration = defaultAppointmentDuration
+	}
+
+	return availableSlots(ctx, srv.db, businessID, a.ResourceID, Slot{Start: a.Start, End: a.End}, a.Duration, "")
+}
+
+// availableSlots returns the free slots of the given duration within period.
+// The appointment excludeID, if any, doesn't take up its time.
+func availableSlots(ctx context.Context, db sqler.Queryer, businessID, resourceID string, period Slot, duration time.Duration, excludeID string) (slots, error) {
+	sched, err := loadSchedule(ctx, db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	busy, err := busySlots(ctx, db, businessID, resourceID, period, excludeID)
+	if err != nil {
+		return nil, err
+	}
+
+	step := duration
+	if step > maxSlotStep {
+		step = maxSlotStep
+	}
+	return slots(freeSlots(sched.openSlots(period.Start, period.End), busy, duration, step, now())), nil
+}
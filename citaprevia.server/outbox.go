@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// Notifications to customers are written to the outbox table in the same
+// transaction as the change they're about, and then delivered by an
+// outboxLoop. Failed deliveries are retried with exponential backoff until
+// maxAttempts, after which the message is left as dead.
+
+type notificationChannel string
+
+const (
+	channelPush  notificationChannel = "push"
+	channelSMS   notificationChannel = "sms"
+	channelEmail notificationChannel = "email"
+)
+
+const (
+	outboxMaxAttempts  = 8
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = 6 * time.Hour
+	outboxLease        = 2 * time.Minute
+	outboxSendTimeout  = 30 * time.Second
+	outboxPollInterval = 5 * time.Second
+)
+
+type outboxMessage struct {
+	BusinessID    string
+	AppointmentID string
+	Channel       notificationChannel
+	// Recipient is the push subscription, phone number or email address.
+	Recipient string
+	Payload   interface{}
+}
+
+type smsPayload struct {
+	Message string `json:"message"`
+}
+
+// enqueueNotification writes m to the outbox. It's meant to be called within
+// the transaction that makes the change the notification is about, so that
+// it's sent if and only if the transaction is committed.
+func enqueueNotification(ctx context.Context, tx sqler.Queryer, m outboxMessage) error {
+	payload, err := json.Marshal(m.Payload)
+	if err != nil {
+		panic(err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO outbox (
+			id, business_id, appointment_id,
+			channel, recipient, payload,
+			max_attempts
+		) VALUES (
+			$1, $2, $3,
+			$4, $5, $6,
+			$7
+		);
+	`,
+		ulidx.New(), nilIfEmpty(m.BusinessID), nilIfEmpty(m.AppointmentID),
+		m.Channel, m.Recipient, string(payload),
+		outboxMaxAttempts,
+	)
+	if err != nil {
+		return fmt.Errorf("enqueuing %s notification: %w", m.Channel, err)
+	}
+	return nil
+}
+
+// enqueuePush enqueues notif for the push subscription pushSubJS, if any.
+func enqueuePush(ctx context.Context, tx sqler.Queryer, businessID, appointmentID string, pushSubJS []byte, notif PushNotif) error {
+	if len(pushSubJS) == 0 {
+		return nil
+	}
+	return enqueueNotification(ctx, tx, outboxMessage{
+		BusinessID:    businessID,
+		AppointmentID: appointmentID,
+		Channel:       channelPush,
+		Recipient:     string(pushSubJS),
+		Payload:       notif,
+	})
+}
+
+// permanentError marks a delivery error that won't go away by retrying.
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+type outboxSender struct {
+	concurrency int
+	send        func(ctx context.Context, m claimedOutboxMessage) error
+}
+
+type claimedOutboxMessage struct {
+	ID            string
+	BusinessID    *string
+	AppointmentID *string
+	Recipient     string
+	Payload       json.RawMessage
+	Attempts      int
+	MaxAttempts   int
+}
+
+type outboxLoop struct {
+	db      sqler.DB
+	sms     SMSProvider
+	senders map[notificationChannel]outboxSender
+}
+
+func newOutboxLoop(db sqler.DB, sms SMSProvider) *outboxLoop {
+	l := &outboxLoop{
+		db:  db,
+		sms: sms,
+	}
+	l.senders = map[notificationChannel]outboxSender{
+		channelPush:  {concurrency: 10, send: sendOutboxPush},
+		channelSMS:   {concurrency: 2, send: l.sendSMS},
+		channelEmail: {concurrency: 4, send: sendOutboxEmail},
+	}
+	return l
+}
+
+func (l *outboxLoop) run() {
+	ctx := context.Background()
+	ctx = scope(ctx, "service", "outbox")
+
+	for channel, sender := range l.senders {
+		go l.runChannel(scope(ctx, "channel", channel), channel, sender)
+	}
+}
+
+func (l *outboxLoop) runChannel(ctx context.Context, channel notificationChannel, sender outboxSender) {
+	slots := make(chan struct{}, sender.concurrency)
+	for {
+		free := cap(slots) - len(slots)
+		var msgs []claimedOutboxMessage
+		if free > 0 {
+			var err error
+			msgs, err = l.claim(ctx, channel, free)
+			if err != nil {
+				log(ctx).Printf("%s", err)
+			}
+		}
+		if len(msgs) == 0 {
+			time.Sleep(outboxPollInterval)
+			continue
+		}
+
+		for _, m := range msgs {
+			slots <- struct{}{}
+			go func(m claimedOutboxMessage) {
+				defer func() { <-slots }()
+				l.deliver(scope(ctx, "outboxID", m.ID), sender, m)
+			}(m)
+		}
+	}
+}
+
+// claim leases up to n due messages for channel, so that other instances
+// don't pick them while they're being delivered.
+func (l *outboxLoop) claim(ctx context.Context, channel notificationChannel, n int) ([]claimedOutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := l.db.Query(ctx, `
+		UPDATE outbox SET
+			locked_until = now() + $3 * interval '1 second'
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE
+				channel = $1 AND status = 'pending'
+				AND next_attempt_at <= now()
+				AND (locked_until IS NULL OR locked_until < now())
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING
+			id, business_id, appointment_id, recipient, payload, attempts, max_attempts
+		;
+	`, channel, n, outboxLease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("claiming outbox messages: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []claimedOutboxMessage
+	for rows.Next() {
+		var m claimedOutboxMessage
+		var payload []byte
+		err := rows.Scan(&m.ID, &m.BusinessID, &m.AppointmentID, &m.Recipient, &payload, &m.Attempts, &m.MaxAttempts)
+		if err != nil {
+			return nil, fmt.Errorf("scanning outbox message: %w", err)
+		}
+		m.Payload = payload
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fetching next outbox message: %w", err)
+	}
+	return msgs, nil
+}
+
+func (l *outboxLoop) deliver(ctx context.Context, sender outboxSender, m claimedOutboxMessage) {
+	sendErr := func() error {
+		ctx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+		defer cancel()
+		return sender.send(ctx, m)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if sendErr == nil {
+		_, err := l.db.Exec(ctx, `
+			UPDATE outbox SET
+				status = 'sent',
+				attempts = attempts + 1,
+				sent_at = now(),
+				locked_until = NULL
+			WHERE id = $1;
+		`, m.ID)
+		if err != nil {
+			log(ctx).Printf("Error marking outbox message as sent: %s", err)
+		}
+		return
+	}
+
+	attempts := m.Attempts + 1
+	status := "pending"
+	var permanent permanentError
+	if attempts >= m.MaxAttempts || errors.As(sendErr, &permanent) {
+		status = "dead"
+	}
+	log(ctx).Printf("Error delivering outbox message attempts=%d status=%s err=%s", attempts, status, sendErr)
+
+	_, err := l.db.Exec(ctx, `
+		UPDATE outbox SET
+			status = $2,
+			attempts = $3,
+			next_attempt_at = now() + $4 * interval '1 second',
+			last_error = $5,
+			locked_until = NULL
+		WHERE id = $1;
+	`, m.ID, status, attempts, outboxBackoff(attempts).Seconds(), sendErr.Error())
+	if err != nil {
+		log(ctx).Printf("Error marking outbox message as failed: %s", err)
+	}
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+func sendOutboxPush(ctx context.Context, m claimedOutboxMessage) error {
+	var sub webpush.Subscription
+	err := json.Unmarshal([]byte(m.Recipient), &sub)
+	if err != nil {
+		return permanentError{fmt.Errorf("decoding push subscription: %w", err)}
+	}
+	return sendPush(&sub, m.Payload)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 
 	"github.com/SherClockHolmes/webpush-go"
 )
@@ -44,7 +45,12 @@ func sendPush(sub *webpush.Subscription, data interface{}) error {
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("non-OK response  with status %d; body: %s", resp.StatusCode, body)
+		err := fmt.Errorf("non-OK response  with status %d; body: %s", resp.StatusCode, body)
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			// The subscription has expired or been removed.
+			return permanentError{err}
+		}
+		return err
 	}
 	return nil
 }
@@ -56,6 +62,17 @@ self.addEventListener('push', function(event) {
 });
 
 self.addEventListener('notificationclick', function(event) {
-	clients.openWindow('https://tengocita.app/c/' + event.notification.data.customerLink);
+	var url = 'https://tengocita.app/c/' + event.notification.data.customerLink;
+	event.notification.close();
+
+	if (event.action === 'confirm') {
+		var body = new URLSearchParams();
+		body.append('customerLink', event.notification.data.customerLink);
+		body.append('action', 'confirm');
+		event.waitUntil(fetch(url, {method: 'post', body: body}));
+		return;
+	}
+
+	event.waitUntil(clients.openWindow(url));
 });
 `
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// Walk-ins are appointments without a fixed start: the customer queues up and
+// is served in order of arrival, after those already waiting for the same
+// resource. Their start is the time they arrived, and they don't take up
+// slots in the calendar.
+
+// serviceTimeSample is how many recently finished appointments are used to
+// estimate how long each customer in the queue takes.
+const serviceTimeSample = 5
+
+// A QueuedWalkIn is a walk-in waiting to be served.
+type QueuedWalkIn struct {
+	Appointment Appointment `json:"appointment"`
+	queuePosition
+}
+
+type queuePosition struct {
+	// Position is 1 for the next customer to be served.
+	Position      int           `json:"position"`
+	EstimatedWait time.Duration `json:"estimatedWait"`
+}
+
+// queueEstimator estimates waits in a resource's queue from how long
+// customers have recently taken to be served.
+type queueEstimator struct {
+	serviceTime time.Duration
+	// remaining is what's left of the customer being served, if any.
+	remaining time.Duration
+}
+
+func loadQueueEstimator(ctx context.Context, db sqler.Queryer, businessID, resourceID string) (queueEstimator, error) {
+	var serviceTimeSecs, servingSecs sql.NullFloat64
+	err := db.QueryRow(ctx, `
+		SELECT
+			(
+				SELECT extract(epoch from avg(finished_at - started_at))
+				FROM (
+					SELECT started_at, finished_at
+					FROM appointments
+					WHERE
+						business_id = $1 AND COALESCE(resource_id, '') = $2
+						AND finished_at IS NOT NULL AND finished_at > now() - interval '7 days'
+					ORDER BY finished_at DESC
+					LIMIT $3
+				) q
+			),
+			(
+				SELECT extract(epoch from now() - max(started_at))
+				FROM appointments
+				WHERE
+					business_id = $1 AND COALESCE(resource_id, '') = $2
+					AND started_at IS NOT NULL AND finished_at IS NULL AND canceled_at IS NULL
+					AND started_at > now() - interval '1 day'
+			)
+		;
+	`, businessID, resourceID, serviceTimeSample).Scan(&serviceTimeSecs, &servingSecs)
+	if err != nil {
+		return queueEstimator{}, fmt.Errorf("fetching service times for resourceID=%q: %w", resourceID, err)
+	}
+
+	e := queueEstimator{serviceTime: defaultAppointmentDuration}
+	if serviceTimeSecs.Valid {
+		e.serviceTime = time.Second * time.Duration(serviceTimeSecs.Float64)
+	}
+	if servingSecs.Valid {
+		if elapsed := time.Second * time.Duration(servingSecs.Float64); elapsed < e.serviceTime {
+			e.remaining = e.serviceTime - elapsed
+		}
+	}
+	return e, nil
+}
+
+func (e queueEstimator) position(ahead int) queuePosition {
+	return queuePosition{
+		Position:      ahead + 1,
+		EstimatedWait: (time.Duration(ahead)*e.serviceTime + e.remaining).Round(time.Minute),
+	}
+}
+
+// walkInPosition returns the position in its queue of a walk-in that's still
+// waiting. ok is false if it isn't.
+func walkInPosition(ctx context.Context, db sqler.Queryer, businessID, appointmentID string) (p queuePosition, ok bool, err error) {
+	var resourceID string
+	var ahead int
+	err = db.QueryRow(ctx, `
+		SELECT
+			COALESCE(a.resource_id, ''),
+			(
+				SELECT count(*)
+				FROM appointments o
+				WHERE
+					o.business_id = a.business_id AND COALESCE(o.resource_id, '') = COALESCE(a.resource_id, '')
+					AND o.walk_in AND o.number < a.number
+					AND o.day = a.day
+					AND o.started_at IS NULL AND o.canceled_at IS NULL AND o.no_show_at IS NULL
+			)
+		FROM appointments a
+		WHERE
+			a.business_id = $1 AND a.id = $2 AND a.walk_in
+			AND a.started_at IS NULL AND a.canceled_at IS NULL AND a.no_show_at IS NULL
+		;
+	`, businessID, appointmentID).Scan(&resourceID, &ahead)
+	if errors.Is(err, sql.ErrNoRows) {
+		return queuePosition{}, false, nil
+	}
+	if err != nil {
+		return queuePosition{}, false, fmt.Errorf("fetching queue position for appointmentID=%v: %w", appointmentID, err)
+	}
+
+	e, err := loadQueueEstimator(ctx, db, businessID, resourceID)
+	if err != nil {
+		return queuePosition{}, false, err
+	}
+	return e.position(ahead), true, nil
+}
+
+type newWalkInAction struct {
+	Phone      string `json:"phone,omitempty"`
+	Email      string `json:"email,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Comments   string `json:"comments,omitempty"`
+	ServiceID  string `json:"serviceId,omitempty"`
+	ResourceID string `json:"resourceId,omitempty"`
+	// Locale is the language of the messages to the customer. Defaults to
+	// the business' one.
+	Locale locale `json:"locale,omitempty"`
+}
+
+type (
+	// missingEmailOrPhone
+	// unknownService
+	// unknownResource
+	// badLocale
+	queuedWalkIn struct {
+		CustomerLink    string `json:"customerLink"`
+		CustomerMessage string `json:"customerMessage,omitempty"`
+		Number          int64  `json:"number"`
+		queuePosition
+	}
+)
+
+func (a newWalkInAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Phone = trimPhone(a.Phone)
+	a.Email = strings.TrimSpace(a.Email)
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Phone == "" && a.Email == "" {
+		return missingEmailOrPhone{}, nil
+	}
+	if a.Locale != "" && !a.Locale.valid() {
+		return badLocale{}, nil
+	}
+	duration := defaultAppointmentDuration
+	if a.ServiceID != "" {
+		d, ok, err := serviceDuration(ctx, srv.db, businessID, a.ServiceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownService{}, nil
+		}
+		duration = d
+	}
+	if a.ResourceID != "" {
+		ok, err := resourceExists(ctx, srv.db, businessID, a.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownResource{}, nil
+		}
+	}
+
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	var result queuedWalkIn
+	var appointmentID string
+	var businessName string
+	var l locale
+	var vars messageVars
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		arrival := now()
+		var customerCode int
+
+		err = tx.QueryRow(ctx, `
+			INSERT INTO last_appointment_number_for_day
+				(business_id, day)
+			VALUES
+				($1, business_day($1, $2))
+			ON CONFLICT (business_id, day) DO UPDATE SET
+				number = last_appointment_number_for_day.number + 1
+			RETURNING
+				number
+			;
+		`, businessID, arrival).Scan(&result.Number)
+		if err != nil {
+			return false, fmt.Errorf("fetching appointment number: %w", err)
+		}
+
+		customerID, err := matchCustomer(ctx, tx, businessID, a.Name, a.Phone, a.Email)
+		if err != nil {
+			return false, err
+		}
+
+		appointmentID = ulidx.New()
+		err = tx.QueryRow(ctx, `
+			INSERT INTO appointments (
+				business_id, id,
+				start, "end",
+				phone, email, number,
+				name, comments,
+				service_id, resource_id,
+				customer_id, walk_in,
+				locale
+			) VALUES (
+				$1, $2,
+				$3, $4,
+				$5, $6, $7,
+				$8, $9,
+				$10, $11,
+				$12, true,
+				$13
+			)
+			RETURNING
+				customer_link, customer_code
+			;
+		`,
+			businessID, appointmentID,
+			arrival, arrival.Add(duration),
+			nilIfEmpty(a.Phone), nilIfEmpty(a.Email), result.Number,
+			nilIfEmpty(a.Name), nilIfEmpty(a.Comments),
+			nilIfEmpty(a.ServiceID), nilIfEmpty(a.ResourceID),
+			customerID,
+			nilIfEmpty(string(a.Locale)),
+		).Scan(&result.CustomerLink, &customerCode)
+		if err != nil {
+			return false, fmt.Errorf("inserting walk-in: %w", err)
+		}
+
+		var timeZone string
+		err = tx.QueryRow(ctx, `
+			SELECT name, time_zone, COALESCE($2, locale) FROM businesses WHERE id = $1;
+		`, businessID, nilIfEmpty(string(a.Locale))).Scan(&businessName, &timeZone, &l)
+		if err != nil {
+			return false, fmt.Errorf("fetching business name: %w", err)
+		}
+		loc, err := loadTimeZone(timeZone)
+		if err != nil {
+			return false, err
+		}
+
+		vars = newMessageVars(businessName, arrival.In(loc), result.CustomerLink, customerCode)
+		vars.Number = result.Number
+
+		if a.Phone != "" && smsOnNewAppointment {
+			sms, err := renderMessage(ctx, tx, businessID, messageQueuedSMS, l, vars)
+			if err != nil {
+				return false, err
+			}
+			err = enqueueNotification(ctx, tx, outboxMessage{
+				BusinessID:    businessID,
+				AppointmentID: appointmentID,
+				Channel:       channelSMS,
+				Recipient:     a.Phone,
+				Payload:       smsPayload{Message: sms},
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+
+		err = enqueueEmail(ctx, tx, businessID, appointmentID, nilIfEmpty(a.Email), appointmentEmail{
+			Subject: l.sprintf("queue.subject", businessName),
+			Paragraphs: []string{
+				l.sprintf("queue.body", result.Number, businessName),
+				l.sprintf("queue.followInLink"),
+			},
+			CustomerLink:   result.CustomerLink,
+			Unsubscribable: true,
+			Locale:         l,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.queuePosition, _, err = walkInPosition(ctx, srv.db, businessID, appointmentID)
+	if err != nil {
+		return nil, err
+	}
+	result.CustomerMessage, err = renderMessage(ctx, srv.db, businessID, messageQueued, l, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+type listQueueAction struct {
+	ResourceID string `json:"resourceId,omitempty"`
+}
+
+type (
+	queue []QueuedWalkIn
+)
+
+func (a listQueueAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+appointmentColumns+`
+		FROM appointments
+		WHERE
+			business_id = $1 AND COALESCE(resource_id, '') = $2 AND walk_in
+			AND day = business_day($1, now())
+			AND started_at IS NULL AND canceled_at IS NULL AND no_show_at IS NULL
+		ORDER BY number
+		;
+	`, businessID, a.ResourceID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching queue for resourceID=%q: %w", a.ResourceID, err)
+	}
+	defer rows.Close()
+
+	q := queue{}
+	for rows.Next() {
+		var w QueuedWalkIn
+		err := scanAppointment(rows, &w.Appointment)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		q = append(q, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	e, err := loadQueueEstimator(ctx, srv.db, businessID, a.ResourceID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range q {
+		q[i].queuePosition = e.position(i)
+	}
+
+	return q, nil
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/tcard/sqler"
+)
+
+// maxOccurrences limits how many appointments a series creates, whatever its
+// end.
+const maxOccurrences = 104
+
+type recurrenceFrequency string
+
+const (
+	recurWeekly  recurrenceFrequency = "weekly"
+	recurMonthly recurrenceFrequency = "monthly"
+)
+
+// A Recurrence repeats an appointment every Interval weeks or months, until a
+// day or for Count occurrences, whatever comes first.
+type Recurrence struct {
+	Frequency recurrenceFrequency `json:"frequency"`
+	// Interval defaults to 1.
+	Interval int `json:"interval,omitempty"`
+	// Until is the last day in which an occurrence may happen. Only its date
+	// matters, in its own offset.
+	Until time.Time `json:"until,omitempty"`
+	Count int       `json:"count,omitempty"`
+}
+
+func (r Recurrence) interval() int {
+	if r.Interval == 0 {
+		return 1
+	}
+	return r.Interval
+}
+
+// valid checks the recurrence for a series starting at first, in the
+// business' time zone.
+func (r Recurrence) valid(first time.Time) bool {
+	if r.Frequency != recurWeekly && r.Frequency != recurMonthly {
+		return false
+	}
+	if r.Interval < 0 || r.Interval > 52 {
+		return false
+	}
+	if r.Until.IsZero() && r.Count == 0 {
+		return false
+	}
+	if r.Count < 0 || r.Count > maxOccurrences {
+		return false
+	}
+	return r.Until.IsZero() || first.Before(r.untilDay(first.Location()))
+}
+
+// untilDay is the start of the day after Until, in loc.
+func (r Recurrence) untilDay(loc *time.Location) time.Time {
+	y, m, d := r.Until.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+}
+
+// occurrences returns the slots of each appointment in the series, starting
+// with first. Monthly occurrences on days that some month doesn't have (say,
+// the 31st) skip that month.
+func (r Recurrence) occurrences(first Slot, loc *time.Location) []Slot {
+	interval := r.interval()
+	start := first.Start.In(loc)
+	duration := first.End.Sub(first.Start)
+
+	var untilDay time.Time
+	if !r.Until.IsZero() {
+		untilDay = r.untilDay(loc)
+	}
+
+	var slots []Slot
+	for i := 0; len(slots) < maxOccurrences; i++ {
+		if r.Count > 0 && len(slots) >= r.Count {
+			break
+		}
+
+		var s time.Time
+		switch r.Frequency {
+		case recurWeekly:
+			s = start.AddDate(0, 0, 7*interval*i)
+		case recurMonthly:
+			y, m, d := start.Date()
+			s = time.Date(y, m+time.Month(interval*i), d, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), loc)
+			if s.Day() != d {
+				continue
+			}
+		}
+		if !untilDay.IsZero() && !s.Before(untilDay) {
+			break
+		}
+
+		slots = append(slots, Slot{Start: s, End: s.Add(duration)})
+	}
+	return slots
+}
+
+// describe tells the customer how the series repeats.
+func (r Recurrence) describe(l locale, slots []Slot) string {
+	interval := r.interval()
+	var every string
+	switch {
+	case r.Frequency == recurWeekly && interval == 1:
+		every = l.sprintf("recurrence.week")
+	case r.Frequency == recurWeekly:
+		every = l.sprintf("recurrence.weeks", interval)
+	case interval == 1:
+		every = l.sprintf("recurrence.month")
+	default:
+		every = l.sprintf("recurrence.months", interval)
+	}
+	last := slots[len(slots)-1].Start
+	return l.sprintf("recurrence", every, len(slots), last.Format("2/1/2006"))
+}
+
+// seriesScope is which appointments of a series an edit or cancellation
+// applies to.
+type seriesScope string
+
+const (
+	scopeThis      seriesScope = "this"
+	scopeFollowing seriesScope = "following"
+	scopeSeries    seriesScope = "series"
+)
+
+func (s seriesScope) valid() bool {
+	return s == "" || s == scopeThis || s == scopeFollowing || s == scopeSeries
+}
+
+type (
+	// occurrenceNotBookable is returned when some appointment of a series
+	// can't be booked. Problem is outsideOpeningHours or slotTaken.
+	occurrenceNotBookable struct {
+		Start   time.Time `json:"start"`
+		Problem string    `json:"problem"`
+	}
+	badScope struct{}
+)
+
+type seriesOccurrence struct {
+	id            string
+	start, end    time.Time
+	customerLink  string
+	customerCode  int
+	pushSubJS     []byte
+	canSendEmails bool
+}
+
+// fetchSeriesOccurrences returns the pending appointments in the series of
+// appointmentID that scope applies to, sorted by start. ok is false if the
+// appointment isn't in a series.
+func fetchSeriesOccurrences(ctx context.Context, tx sqler.Tx, businessID, appointmentID string, scope seriesScope) (occs []seriesOccurrence, ok bool, err error) {
+	var seriesID sql.NullString
+	var from time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT series_id, start
+		FROM appointments
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, appointmentID).Scan(&seriesID, &from)
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching appointment for businessID=%v id=%v: %w", businessID, appointmentID, err)
+	}
+	if !seriesID.Valid {
+		return nil, false, nil
+	}
+	if scope == scopeSeries {
+		from = time.Time{}
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT
+			id, start, "end", customer_link, customer_code, push_subscription, can_send_emails
+		FROM appointments
+		WHERE
+			business_id = $1 AND series_id = $2 AND start >= $3
+			AND started_at IS NULL AND finished_at IS NULL AND canceled_at IS NULL AND no_show_at IS NULL
+		ORDER BY start
+		FOR UPDATE
+		;
+	`, businessID, seriesID.String, from)
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching series for businessID=%v seriesID=%v: %w", businessID, seriesID.String, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o seriesOccurrence
+		err := rows.Scan(&o.id, &o.start, &o.end, &o.customerLink, &o.customerCode, &o.pushSubJS, &o.canSendEmails)
+		if err != nil {
+			return nil, false, fmt.Errorf("scanning row: %w", err)
+		}
+		occs = append(occs, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	return occs, true, nil
+}
+
+type (
+	// notFound
+	// occurrenceNotBookable
+	updatedSeries struct {
+		Appointments    appointments `json:"appointments"`
+		CustomerMessage string       `json:"customerMessage,omitempty"`
+	}
+)
+
+// updateSeries applies the update to the appointment and, depending on the
+// scope, to the following ones or to the whole series. Occurrences are moved
+// by the same number of days and the same change in time of day as the
+// appointment, and take its new duration.
+func (a updateAppointmentAction) updateSeries(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	tx, err := srv.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	var result interface{}
+	var notInSeries bool
+	var businessName string
+	var l locale
+	var first *seriesOccurrence
+	var vars messageVars
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		occs, ok, err := fetchSeriesOccurrences(ctx, tx, businessID, a.ID, a.Scope)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			notInSeries = true
+			return false, nil
+		}
+
+		var prev *seriesOccurrence
+		for i := range occs {
+			if occs[i].id == a.ID {
+				prev = &occs[i]
+			}
+		}
+		if prev == nil {
+			// Already started, finished, canceled...
+			return false, sql.ErrNoRows
+		}
+		if a.End.IsZero() {
+			// Keep the previous duration.
+			a.End = a.Start.Add(prev.end.Sub(prev.start))
+		}
+		duration := a.End.Sub(a.Start)
+
+		var loc *time.Location
+		businessName, loc, err = fetchBusinessNameAndLocation(ctx, tx, businessID)
+		if err != nil {
+			return false, err
+		}
+
+		// The shift is applied on the calendar, as days and wall clock time,
+		// so that occurrences on the other side of a DST change keep their
+		// time of day.
+		prevStart, newStart := prev.start.In(loc), a.Start.In(loc)
+		dayShift := calendarDays(prevStart, newStart)
+		clockShift := clockTime(newStart) - clockTime(prevStart)
+
+		apps := appointments{}
+		for i, o := range occs {
+			start := o.start.In(loc)
+			y, m, d := start.Date()
+			slot := Slot{Start: time.Date(y, m, d+dayShift, 0, 0, 0, int(clockTime(start)+clockShift), loc)}
+			slot.End = slot.Start.Add(duration)
+			timeChanged := !slot.Start.Equal(o.start) || !slot.End.Equal(o.end)
+
+			notBookable, err := checkBookable(ctx, tx, businessID, a.ResourceID, slot, o.id)
+			if err != nil {
+				return false, err
+			}
+			if notBookable != nil {
+				result = occurrenceNotBookable{Start: slot.Start, Problem: reflect.TypeOf(notBookable).Name()}
+				return false, nil
+			}
+
+			number := sql.NullInt64{}
+			if !sameDay(slot.Start, o.start, loc) {
+				err = tx.QueryRow(ctx, `
+					INSERT INTO last_appointment_number_for_day
+						(business_id, day)
+					VALUES
+						($1, business_day($1, $2))
+					ON CONFLICT (business_id, day) DO UPDATE SET
+						number = last_appointment_number_for_day.number + 1
+					RETURNING
+						number
+					;
+				`, businessID, slot.Start).Scan(&number)
+				if err != nil {
+					return false, fmt.Errorf("fetching appointment number: %w", err)
+				}
+			}
+
+			var app Appointment
+			var newCode bool
+			err = retryCustomerCodeConflicts(ctx, tx, func(regenerate bool) error {
+				newCode = regenerate
+				row := tx.QueryRow(ctx, `
+					UPDATE appointments SET
+						start = $3,
+						"end" = $4,
+						phone = $5,
+						email = $6,
+						name = $7,
+						comments = $8,
+						number = COALESCE($9, number),
+						service_id = $10,
+						resource_id = $11,
+						confirmed_at = CASE WHEN $12 THEN NULL ELSE confirmed_at END,
+						no_show_cleared_at = CASE WHEN $12 THEN NULL ELSE no_show_cleared_at END,
+						customer_code = CASE WHEN $13 THEN random_customer_code() ELSE customer_code END
+					WHERE
+						business_id = $1 AND id = $2
+					RETURNING `+appointmentColumns+`
+					;
+				`,
+					businessID, o.id,
+					slot.Start, slot.End,
+					nilIfEmpty(a.Phone), nilIfEmpty(a.Email),
+					nilIfEmpty(a.Name), nilIfEmpty(a.Comments),
+					number, nilIfEmpty(a.ServiceID), nilIfEmpty(a.ResourceID),
+					timeChanged,
+					regenerate,
+				)
+				return scanAppointment(row, &app)
+			})
+			if err != nil {
+				return false, fmt.Errorf("updating appointment for businessID=%v id=%v: %w", businessID, o.id, err)
+			}
+			if newCode {
+				occs[i].customerCode, err = fetchCustomerCode(ctx, tx, businessID, o.id)
+				if err != nil {
+					return false, err
+				}
+			}
+			apps = append(apps, app)
+
+			if timeChanged {
+				_, err = tx.Exec(ctx, `
+					DELETE FROM appointment_reminders
+					WHERE business_id = $1 AND appointment_id = $2;
+				`, businessID, o.id)
+				if err != nil {
+					return false, fmt.Errorf("resetting reminders: %w", err)
+				}
+				if first == nil {
+					first = &occs[i]
+					first.start, first.end = slot.Start.In(loc), slot.End.In(loc)
+				}
+			}
+		}
+		result = updatedSeries{Appointments: apps}
+
+		if first == nil {
+			return true, nil
+		}
+
+		// A single notification for the whole series, pointing to the
+		// first appointment that changed.
+		l, err = appointmentLocale(ctx, tx, businessID, first.id)
+		if err != nil {
+			return false, err
+		}
+		vars = newMessageVars(businessName, first.start, first.customerLink, first.customerCode)
+		msg, err := renderMessage(ctx, tx, businessID, messageUpdatedSeriesPush, l, vars)
+		if err != nil {
+			return false, err
+		}
+		err = enqueuePush(ctx, tx, businessID, first.id, first.pushSubJS, PushNotif{
+			Title: l.sprintf("updatedSeries.title"),
+			Options: PushOptions{
+				Body:               msg,
+				Tag:                "updated:" + first.customerLink,
+				RequireInteraction: true,
+				Actions: []PushAction{{
+					Action: "go",
+					Title:  l.sprintf("viewAppointment"),
+				}},
+				Data: map[string]interface{}{
+					"customerLink": first.customerLink,
+				},
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if first.canSendEmails {
+			err = enqueueEmail(ctx, tx, businessID, first.id, nilIfEmpty(a.Email), appointmentEmail{
+				Subject:        l.sprintf("updatedSeries.subject", businessName),
+				Paragraphs:     []string{msg},
+				CustomerLink:   first.customerLink,
+				Unsubscribable: true,
+				Locale:         l,
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if notInSeries {
+		a.Scope = scopeThis
+		return a.serveAction(ctx, srv, businessID)
+	}
+
+	if u, ok := result.(updatedSeries); ok && first != nil && a.Phone != "" {
+		u.CustomerMessage, err = renderMessage(ctx, srv.db, businessID, messageUpdatedSeries, l, vars)
+		if err != nil {
+			return nil, err
+		}
+		result = u
+	}
+
+	return result, nil
+}
+
+// cancelSeries cancels the appointment and, depending on the scope, the
+// following ones or the whole series.
+func (a cancelAppointmentAction) cancelSeries(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	tx, err := srv.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	var result interface{}
+	var notInSeries bool
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		occs, ok, err := fetchSeriesOccurrences(ctx, tx, businessID, a.ID, a.Scope)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			notInSeries = true
+			return false, nil
+		}
+		if len(occs) == 0 {
+			return false, sql.ErrNoRows
+		}
+
+		var ids []string
+		for _, o := range occs {
+			ids = append(ids, o.id)
+		}
+		rows, err := tx.Query(ctx, `
+			UPDATE appointments SET
+				canceled_at = now() at time zone 'utc',
+				cancel_reason = $3
+			WHERE
+				business_id = $1 AND id = ANY($2)
+			RETURNING
+				start, phone, CASE WHEN can_send_emails THEN email END
+			;
+		`, businessID, pq.Array(ids), nilIfEmpty(strings.TrimSpace(a.Reason)))
+		if err != nil {
+			return false, fmt.Errorf("canceling series for businessID=%v id=%v: %w", businessID, a.ID, err)
+		}
+		type canceledOccurrence struct {
+			start        time.Time
+			phone, email sql.NullString
+		}
+		var canceledOccs []canceledOccurrence
+		for rows.Next() {
+			var c canceledOccurrence
+			err := rows.Scan(&c.start, &c.phone, &c.email)
+			if err != nil {
+				rows.Close()
+				return false, fmt.Errorf("scanning row: %w", err)
+			}
+			canceledOccs = append(canceledOccs, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return false, fmt.Errorf("scanning rows: %w", err)
+		}
+		sort.Slice(canceledOccs, func(i, j int) bool { return canceledOccs[i].start.Before(canceledOccs[j].start) })
+
+		for _, id := range ids {
+			err := offerFreedSlot(ctx, tx, businessID, id)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		result = canceled{}
+		first, c := occs[0], canceledOccs[0]
+		if !c.phone.Valid && !c.email.Valid && len(first.pushSubJS) == 0 {
+			return true, nil
+		}
+
+		businessName, loc, err := fetchBusinessNameAndLocation(ctx, tx, businessID)
+		if err != nil {
+			return false, err
+		}
+
+		l, err := appointmentLocale(ctx, tx, businessID, first.id)
+		if err != nil {
+			return false, err
+		}
+
+		vars := newMessageVars(businessName, first.start.In(loc), first.customerLink, first.customerCode)
+		vars.Count = len(canceledOccs)
+		msg, err := renderMessage(ctx, tx, businessID, messageCanceledSeriesPush, l, vars)
+		if err != nil {
+			return false, err
+		}
+
+		if c.phone.Valid {
+			customerMessage, err := renderMessage(ctx, tx, businessID, messageCanceledSeries, l, vars)
+			if err != nil {
+				return false, err
+			}
+			result = canceled{CustomerMessage: customerMessage}
+		}
+
+		err = enqueuePush(ctx, tx, businessID, first.id, first.pushSubJS, PushNotif{
+			Title: l.sprintf("canceledSeries.title"),
+			Options: PushOptions{
+				Body:               msg,
+				Tag:                "cancelled:" + first.customerLink,
+				RequireInteraction: true,
+				Data: map[string]interface{}{
+					"customerLink": first.customerLink,
+				},
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+
+		var reason []string
+		if r := strings.TrimSpace(a.Reason); r != "" {
+			reason = append(reason, l.sprintf("reason", r))
+		}
+		err = enqueueEmail(ctx, tx, businessID, first.id, nullStringPtr(c.email), appointmentEmail{
+			Subject:        l.sprintf("canceledSeries.subject", businessName),
+			Paragraphs:     append([]string{msg}, reason...),
+			CustomerLink:   first.customerLink,
+			Unsubscribable: true,
+			Locale:         l,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if notInSeries {
+		a.Scope = scopeThis
+		return a.serveAction(ctx, srv, businessID)
+	}
+
+	return result, nil
+}
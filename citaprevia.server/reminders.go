@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/tcard/sqler"
+)
+
+const (
+	reminderInterval    = time.Minute
+	maxReminders        = 4
+	minReminderLeadTime = 15 * time.Minute
+	maxReminderLeadTime = 7 * 24 * time.Hour
+)
+
+type getRemindersAction struct{}
+
+type (
+	reminderLeadTimes []time.Duration
+)
+
+func (a getRemindersAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var minutes []int64
+	err := srv.db.QueryRow(ctx, `
+		SELECT reminder_lead_minutes
+		FROM businesses
+		WHERE
+			id = $1
+		;
+	`, businessID).Scan(pq.Array(&minutes))
+	if err != nil {
+		return nil, fmt.Errorf("fetching reminder lead times: %w", err)
+	}
+
+	leadTimes := reminderLeadTimes{}
+	for _, m := range minutes {
+		leadTimes = append(leadTimes, time.Duration(m)*time.Minute)
+	}
+	return leadTimes, nil
+}
+
+type setRemindersAction struct {
+	// LeadTimes are how long before the appointment reminders are sent. An
+	// empty list disables reminders.
+	LeadTimes []time.Duration `json:"leadTimes"`
+}
+
+type (
+	badLeadTimes struct{}
+	// reminderLeadTimes
+)
+
+func (a setRemindersAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if len(a.LeadTimes) > maxReminders {
+		return badLeadTimes{}, nil
+	}
+
+	minutes := []int64{}
+	seen := map[int64]bool{}
+	for _, d := range a.LeadTimes {
+		if d < minReminderLeadTime || d > maxReminderLeadTime {
+			return badLeadTimes{}, nil
+		}
+		m := int64(d / time.Minute)
+		if !seen[m] {
+			seen[m] = true
+			minutes = append(minutes, m)
+		}
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] > minutes[j] })
+
+	_, err := srv.db.Exec(ctx, `
+		UPDATE businesses SET
+			reminder_lead_minutes = $2
+		WHERE
+			id = $1
+		;
+	`, businessID, pq.Array(minutes))
+	if err != nil {
+		return nil, fmt.Errorf("updating reminder lead times: %w", err)
+	}
+
+	leadTimes := reminderLeadTimes{}
+	for _, m := range minutes {
+		leadTimes = append(leadTimes, time.Duration(m)*time.Minute)
+	}
+	return leadTimes, nil
+}
+
+// reminderLoop sends reminders before appointments start, according to each
+// business' lead times. Each reminder is recorded in appointment_reminders,
+// so that it's sent at most once per appointment.
+type reminderLoop struct {
+	db sqler.DB
+}
+
+type dueReminder struct {
+	businessID    string
+	businessName  string
+	locale        locale
+	appointmentID string
+	customerLink  string
+	customerCode  int
+	start         time.Time
+	phone, email  sql.NullString
+	pushSubJS     []byte
+
+	// leadMinutes are the lead times that are due, smallest first. Only the
+	// first one is sent; the others are just too late to be useful.
+	leadMinutes []int
+}
+
+func (l *reminderLoop) run() {
+	ctx := context.Background()
+	ctx = scope(ctx, "service", "reminders")
+
+	for {
+		time.Sleep(reminderInterval)
+
+		due, err := l.fetch(ctx, now())
+		if err != nil {
+			log(ctx).Printf("%s", err)
+			continue
+		}
+
+		for _, r := range due {
+			err := l.send(scope(ctx, "appointmentID", r.appointmentID), r)
+			if err != nil {
+				log(ctx).Printf("Error sending reminder appointmentID=%s: %s", r.appointmentID, err)
+			}
+		}
+	}
+}
+
+// fetch returns the reminders due at t.
+func (l *reminderLoop) fetch(ctx context.Context, t time.Time) ([]dueReminder, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Appointments created within a lead time don't get that reminder; the
+	// customer has just booked.
+	rows, err := l.db.Query(ctx, `
+		SELECT
+			a.business_id, b.name, b.time_zone, COALESCE(a.locale, b.locale), a.id, a.customer_link, a.customer_code, a.start,
+			a.phone, CASE WHEN a.can_send_emails THEN a.email END, a.push_subscription,
+			lead.minutes
+		FROM
+			businesses b
+			CROSS JOIN LATERAL unnest(b.reminder_lead_minutes) AS lead(minutes)
+			JOIN appointments a ON a.business_id = b.id
+		WHERE
+			a.start > $1
+			AND a.start <= $1 + lead.minutes * interval '1 minute'
+			AND a.created_at < a.start - lead.minutes * interval '1 minute'
+			AND a.canceled_at IS NULL AND a.started_at IS NULL AND a.finished_at IS NULL
+			AND a.no_show_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1
+				FROM appointment_reminders r
+				WHERE
+					r.business_id = a.business_id AND r.appointment_id = a.id
+					AND r.lead_minutes = lead.minutes
+			)
+		ORDER BY a.business_id, a.id, lead.minutes
+		LIMIT 1000
+		;
+	`, t)
+	if err != nil {
+		return nil, fmt.Errorf("selecting due reminders: %w", err)
+	}
+	defer rows.Close()
+
+	var due []dueReminder
+	for rows.Next() {
+		var r dueReminder
+		var leadMinutes int
+		var timeZone string
+		err := rows.Scan(
+			&r.businessID, &r.businessName, &timeZone, &r.locale, &r.appointmentID, &r.customerLink, &r.customerCode, &r.start,
+			&r.phone, &r.email, &r.pushSubJS,
+			&leadMinutes,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("scanning due reminder: %w", err)
+		}
+		loc, err := loadTimeZone(timeZone)
+		if err != nil {
+			return nil, err
+		}
+		r.start = r.start.In(loc)
+		if n := len(due); n > 0 && due[n-1].businessID == r.businessID && due[n-1].appointmentID == r.appointmentID {
+			due[n-1].leadMinutes = append(due[n-1].leadMinutes, leadMinutes)
+			continue
+		}
+		r.leadMinutes = []int{leadMinutes}
+		due = append(due, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fetching next due reminder: %w", err)
+	}
+
+	return due, nil
+}
+
+func (l *reminderLoop) send(ctx context.Context, r dueReminder) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var channel *notificationChannel
+	switch {
+	case len(r.pushSubJS) > 0:
+		c := channelPush
+		channel = &c
+	case r.phone.Valid:
+		c := channelSMS
+		channel = &c
+	case r.email.Valid:
+		c := channelEmail
+		channel = &c
+	}
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	return useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		for i, leadMinutes := range r.leadMinutes {
+			var sentThrough *notificationChannel
+			if i == 0 {
+				sentThrough = channel
+			}
+			res, err := tx.Exec(ctx, `
+				INSERT INTO appointment_reminders
+					(business_id, appointment_id, lead_minutes, channel)
+				VALUES
+					($1, $2, $3, $4)
+				ON CONFLICT (business_id, appointment_id, lead_minutes) DO NOTHING
+				;
+			`, r.businessID, r.appointmentID, leadMinutes, sentThrough)
+			if err != nil {
+				return false, fmt.Errorf("recording reminder: %w", err)
+			}
+			if affected, err := res.RowsAffected(); i == 0 && (err != nil || affected == 0) {
+				// Already sent by someone else.
+				return false, nil
+			}
+		}
+
+		if channel == nil {
+			return true, nil
+		}
+
+		lang := r.locale
+		when := lang.when(r.start)
+		vars := newMessageVars(r.businessName, r.start, r.customerLink, r.customerCode)
+
+		switch *channel {
+		case channelPush:
+			var body string
+			body, err = renderMessage(ctx, tx, r.businessID, messageReminderPush, lang, vars)
+			if err != nil {
+				return false, err
+			}
+			err = enqueuePush(ctx, tx, r.businessID, r.appointmentID, r.pushSubJS, PushNotif{
+				Title: lang.sprintf("reminder.title"),
+				Options: PushOptions{
+					Body:               body,
+					Tag:                "reminder:" + r.customerLink,
+					RequireInteraction: true,
+					Actions: []PushAction{{
+						Action: "confirm",
+						Title:  lang.sprintf("confirmAttendance"),
+					}, {
+						Action: "go",
+						Title:  lang.sprintf("viewAppointment"),
+					}, {
+						Action: "cancel",
+						Title:  lang.sprintf("cancelAppointment"),
+					}},
+					Data: map[string]interface{}{
+						"customerLink": r.customerLink,
+					},
+				},
+			})
+		case channelSMS:
+			var sms string
+			sms, err = renderMessage(ctx, tx, r.businessID, messageReminderSMS, lang, vars)
+			if err != nil {
+				return false, err
+			}
+			err = enqueueNotification(ctx, tx, outboxMessage{
+				BusinessID:    r.businessID,
+				AppointmentID: r.appointmentID,
+				Channel:       channelSMS,
+				Recipient:     r.phone.String,
+				Payload:       smsPayload{Message: sms},
+			})
+		case channelEmail:
+			err = enqueueEmail(ctx, tx, r.businessID, r.appointmentID, &r.email.String, appointmentEmail{
+				Subject: lang.sprintf("reminder.subject", r.businessName),
+				Paragraphs: []string{
+					lang.sprintf("youHaveAppointment", r.businessName, when),
+					lang.sprintf("reminder.cancelIfAbsent"),
+				},
+				CustomerLink:   r.customerLink,
+				Unsubscribable: true,
+				Locale:         lang,
+			})
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+}
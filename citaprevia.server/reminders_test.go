@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSetRemindersRejectsBadLeadTimes(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		leadTimes []time.Duration
+	}{
+		{"too short", []time.Duration{minReminderLeadTime - time.Minute}},
+		{"too long", []time.Duration{maxReminderLeadTime + time.Minute}},
+		{"negative", []time.Duration{-time.Hour}},
+		{"one bad among good", []time.Duration{time.Hour, 24 * time.Hour, maxReminderLeadTime + time.Minute}},
+		{"too many", []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour, 5 * time.Hour}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// Rejected lead times never reach the database, so the server
+			// doesn't need one.
+			got, err := setRemindersAction{LeadTimes: c.leadTimes}.serveAction(context.Background(), server{}, "business")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := got.(badLeadTimes); !ok {
+				t.Fatalf("got %#v, want badLeadTimes", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// Customers can ask to move their appointment to other times, chosen from
+// the business' availability. The business then accepts one of them, which
+// moves the appointment, or rejects the request.
+
+const (
+	maxRescheduleSlots  = 5
+	rescheduleDaysAhead = 7
+)
+
+type rescheduleStatus string
+
+const (
+	reschedulePending   rescheduleStatus = "pending"
+	rescheduleAccepted  rescheduleStatus = "accepted"
+	rescheduleRejected  rescheduleStatus = "rejected"
+	rescheduleWithdrawn rescheduleStatus = "withdrawn"
+)
+
+type RescheduleRequest struct {
+	ID            string           `json:"id"`
+	AppointmentID string           `json:"appointmentId"`
+	Slots         []Slot           `json:"slots"`
+	Comments      *string          `json:"comments,omitempty"`
+	Status        rescheduleStatus `json:"status"`
+	CreatedAt     time.Time        `json:"createdAt"`
+
+	// The appointment as it is now.
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Number int       `json:"number"`
+	Name   *string   `json:"name,omitempty"`
+	Phone  *string   `json:"phone,omitempty"`
+	Email  *string   `json:"email,omitempty"`
+}
+
+// rescheduleDay is a day with the times a customer can move their
+// appointment to.
+type rescheduleDay struct {
+	Day   time.Time
+	Slots []Slot
+}
+
+// rescheduleOptions returns the free slots for the next days where an
+// appointment could be moved to, grouped by day in the business' time zone.
+func rescheduleOptions(ctx context.Context, db sqler.Queryer, businessID, resourceID, appointmentID string, duration time.Duration) ([]rescheduleDay, error) {
+	loc, err := businessLocation(ctx, db, businessID)
+	if err != nil {
+		return nil, err
+	}
+	y, m, d := now().In(loc).Date()
+	from := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	free, err := availableSlots(ctx, db, businessID, resourceID, Slot{
+		Start: from,
+		End:   from.AddDate(0, 0, rescheduleDaysAhead),
+	}, duration, appointmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	var days []rescheduleDay
+	for _, s := range free {
+		s.Start, s.End = s.Start.In(loc), s.End.In(loc)
+		y, m, d := s.Start.Date()
+		day := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		if len(days) == 0 || !days[len(days)-1].Day.Equal(day) {
+			days = append(days, rescheduleDay{Day: day})
+		}
+		days[len(days)-1].Slots = append(days[len(days)-1].Slots, s)
+	}
+	return days, nil
+}
+
+// requestReschedule records a request from the customer to move their
+// appointment to one of starts. If it can't, problem explains why to the
+// customer, in l.
+func (srv server) requestReschedule(ctx context.Context, l locale, customerLink string, starts []string, comments string) (problem string, err error) {
+	var businessID, appointmentID, resourceID string
+	var start, end time.Time
+	var name, businessEmail sql.NullString
+	var timeZone string
+	err = srv.db.QueryRow(ctx, `
+		SELECT
+			a.business_id, a.id, COALESCE(a.resource_id, ''), a.start, a."end", a.name, b.email, b.time_zone
+		FROM
+			appointments a
+			JOIN businesses b ON a.business_id = b.id
+		WHERE
+			a.customer_link = $1
+			AND a.started_at IS NULL AND a.canceled_at IS NULL AND a.finished_at IS NULL
+			AND a.no_show_at IS NULL
+		;
+	`, customerLink).Scan(&businessID, &appointmentID, &resourceID, &start, &end, &name, &businessEmail, &timeZone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l.sprintf("reschedule.notAvailable"), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("fetching appointment customerLink=%v: %w", customerLink, err)
+	}
+	duration := end.Sub(start)
+	loc, err := loadTimeZone(timeZone)
+	if err != nil {
+		return "", err
+	}
+	start = start.In(loc)
+
+	if len(starts) > maxRescheduleSlots {
+		return l.sprintf("reschedule.tooManySlots", maxRescheduleSlots), nil
+	}
+
+	var slots []Slot
+	seen := map[time.Time]bool{}
+	for _, s := range starts {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil || !t.After(now()) || seen[t] {
+			continue
+		}
+		seen[t] = true
+		t = t.In(loc)
+		slot := Slot{Start: t, End: t.Add(duration)}
+		notBookable, err := checkBookable(ctx, srv.db, businessID, resourceID, slot, appointmentID)
+		if err != nil {
+			return "", err
+		}
+		if notBookable == nil {
+			slots = append(slots, slot)
+		}
+	}
+	if len(slots) == 0 {
+		return l.sprintf("reschedule.noSlots"), nil
+	}
+
+	slotsJS, err := json.Marshal(slots)
+	if err != nil {
+		panic(err)
+	}
+
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		// A new request replaces the pending one.
+		_, err = tx.Exec(ctx, `
+			UPDATE reschedule_requests SET
+				status = 'withdrawn',
+				resolved_at = now()
+			WHERE
+				business_id = $1 AND appointment_id = $2 AND status = 'pending'
+			;
+		`, businessID, appointmentID)
+		if err != nil {
+			return false, fmt.Errorf("withdrawing previous request: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO reschedule_requests
+				(business_id, id, appointment_id, slots, comments)
+			VALUES
+				($1, $2, $3, $4, $5)
+			;
+		`, businessID, ulidx.New(), appointmentID, string(slotsJS), nilIfEmpty(comments))
+		if err != nil {
+			return false, fmt.Errorf("inserting reschedule request: %w", err)
+		}
+
+		customer := "Un cliente"
+		if name.Valid {
+			customer = name.String
+		}
+		paragraphs := []string{fmt.Sprintf(
+			"%s pide cambiar su cita del %s a las %d:%02d a una de estas horas:",
+			customer, start.Format("2/1"), start.Hour(), start.Minute(),
+		)}
+		for _, s := range slots {
+			paragraphs = append(paragraphs, fmt.Sprintf("%s a las %d:%02d", s.Start.Format("2/1"), s.Start.Hour(), s.Start.Minute()))
+		}
+		if comments != "" {
+			paragraphs = append(paragraphs, "Comentario: "+comments)
+		}
+		err = enqueueEmail(ctx, tx, businessID, appointmentID, nullStringPtr(businessEmail), appointmentEmail{
+			Subject:      "📆 Petición de cambio de cita",
+			Paragraphs:   paragraphs,
+			CustomerLink: customerLink,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+type listRescheduleRequestsAction struct{}
+
+type (
+	rescheduleRequests []RescheduleRequest
+)
+
+func (a listRescheduleRequestsAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	rows, err := srv.db.Query(ctx, `
+		SELECT
+			r.id, r.appointment_id, r.slots, r.comments, r.status, r.created_at,
+			a.start, a."end", a.number, a.name, a.phone, a.email
+		FROM
+			reschedule_requests r
+			JOIN appointments a ON a.business_id = r.business_id AND a.id = r.appointment_id
+		WHERE
+			r.business_id = $1 AND r.status = 'pending'
+			AND a.started_at IS NULL AND a.canceled_at IS NULL AND a.finished_at IS NULL
+			AND a.no_show_at IS NULL
+		ORDER BY r.created_at
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching reschedule requests: %w", err)
+	}
+	defer rows.Close()
+
+	rs := rescheduleRequests{}
+	for rows.Next() {
+		var r RescheduleRequest
+		var slotsJS []byte
+		err := rows.Scan(
+			&r.ID, &r.AppointmentID, &slotsJS, &r.Comments, &r.Status, &r.CreatedAt,
+			&r.Start, &r.End, &r.Number, &r.Name, &r.Phone, &r.Email,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		err = json.Unmarshal(slotsJS, &r.Slots)
+		if err != nil {
+			return nil, fmt.Errorf("decoding slots: %w", err)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	return rs, nil
+}
+
+type acceptRescheduleRequestAction struct {
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+}
+
+type (
+	// notFound
+	badSlot struct{}
+	// outsideOpeningHours
+	// slotTaken
+	// updated
+)
+
+func (a acceptRescheduleRequestAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	var appointmentID string
+	var slotsJS []byte
+	err := srv.db.QueryRow(ctx, `
+		SELECT appointment_id, slots
+		FROM reschedule_requests
+		WHERE
+			business_id = $1 AND id = $2 AND status = 'pending'
+		;
+	`, businessID, a.ID).Scan(&appointmentID, &slotsJS)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching reschedule request id=%v: %w", a.ID, err)
+	}
+
+	var app Appointment
+	row := srv.db.QueryRow(ctx, `
+		SELECT `+appointmentColumns+`
+		FROM appointments
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, appointmentID)
+	err = scanAppointment(row, &app)
+	if err != nil {
+		return nil, fmt.Errorf("fetching appointment id=%v: %w", appointmentID, err)
+	}
+
+	var slots []Slot
+	err = json.Unmarshal(slotsJS, &slots)
+	if err != nil {
+		return nil, fmt.Errorf("decoding slots: %w", err)
+	}
+	var slot *Slot
+	for i := range slots {
+		if slots[i].Start.Equal(a.Start) {
+			slot = &slots[i]
+		}
+	}
+	if slot == nil {
+		return badSlot{}, nil
+	}
+
+	update := updateAppointmentAction{
+		ID:    app.ID,
+		Start: slot.Start,
+		End:   slot.End,
+	}
+	if app.Phone != nil {
+		update.Phone = *app.Phone
+	}
+	if app.Email != nil {
+		update.Email = *app.Email
+	}
+	if app.Name != nil {
+		update.Name = *app.Name
+	}
+	if app.Comments != nil {
+		update.Comments = *app.Comments
+	}
+	if app.Service != nil {
+		update.ServiceID = app.Service.ID
+	}
+	if app.ResourceID != nil {
+		update.ResourceID = *app.ResourceID
+	}
+	update.rescheduleRequestID = a.ID
+	// This also lets the customer know.
+	return update.serveAction(ctx, srv, businessID)
+}
+
+// acceptRescheduleRequest marks the request as accepted for start, if it's
+// still pending. Otherwise, it's been resolved meanwhile and accepted is
+// false.
+func acceptRescheduleRequest(ctx context.Context, tx sqler.Tx, businessID, requestID string, start time.Time) (accepted bool, err error) {
+	res, err := tx.Exec(ctx, `
+		UPDATE reschedule_requests SET
+			status = 'accepted',
+			accepted_start = $3,
+			resolved_at = now()
+		WHERE
+			business_id = $1 AND id = $2 AND status = 'pending'
+		;
+	`, businessID, requestID, start)
+	if err != nil {
+		return false, fmt.Errorf("accepting reschedule request id=%v: %w", requestID, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("accepting reschedule request id=%v: %w", requestID, err)
+	}
+	return affected > 0, nil
+}
+
+type rejectRescheduleRequestAction struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type (
+// notFound
+// ok
+)
+
+func (a rejectRescheduleRequestAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		var appointmentID, customerLink, businessName, timeZone string
+		var l locale
+		var start time.Time
+		var email sql.NullString
+		var pushSubJS []byte
+		err = tx.QueryRow(ctx, `
+			UPDATE reschedule_requests r SET
+				status = 'rejected',
+				reason = $3,
+				resolved_at = now()
+			FROM appointments a, businesses b
+			WHERE
+				r.business_id = $1 AND r.id = $2 AND r.status = 'pending'
+				AND a.business_id = r.business_id AND a.id = r.appointment_id
+				AND b.id = r.business_id
+			RETURNING
+				a.id, a.customer_link, a.start,
+				CASE WHEN a.can_send_emails THEN a.email END, a.push_subscription,
+				b.name, b.time_zone, COALESCE(a.locale, b.locale)
+			;
+		`, businessID, a.ID, nilIfEmpty(a.Reason)).Scan(
+			&appointmentID, &customerLink, &start,
+			&email, &pushSubJS,
+			&businessName, &timeZone, &l,
+		)
+		if err != nil {
+			return false, fmt.Errorf("rejecting reschedule request id=%v: %w", a.ID, err)
+		}
+		loc, err := loadTimeZone(timeZone)
+		if err != nil {
+			return false, err
+		}
+		start = start.In(loc)
+
+		body := l.sprintf("rescheduleRejected.body", businessName, l.when(start))
+		err = enqueuePush(ctx, tx, businessID, appointmentID, pushSubJS, PushNotif{
+			Title: l.sprintf("rescheduleRejected.title"),
+			Options: PushOptions{
+				Body:               body,
+				Tag:                "reschedule:" + customerLink,
+				RequireInteraction: true,
+				Actions: []PushAction{{
+					Action: "go",
+					Title:  l.sprintf("viewAppointment"),
+				}},
+				Data: map[string]interface{}{
+					"customerLink": customerLink,
+				},
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+
+		paragraphs := []string{body}
+		if a.Reason != "" {
+			paragraphs = append(paragraphs, l.sprintf("reason", a.Reason))
+		}
+		err = enqueueEmail(ctx, tx, businessID, appointmentID, nullStringPtr(email), appointmentEmail{
+			Subject:        l.sprintf("rescheduleRejected.title"),
+			Paragraphs:     paragraphs,
+			CustomerLink:   customerLink,
+			Unsubscribable: true,
+			Locale:         l,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ok{}, nil
+}
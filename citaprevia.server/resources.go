@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// A Resource is whatever an appointment takes up while it happens: a staff
+// member, a room, a chair... Appointments for different resources can
+// happen in parallel, and delays are tracked separately for each of them.
+type Resource struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Kind    resourceKind `json:"kind"`
+	StaffID *string      `json:"staffId,omitempty"`
+}
+
+type resourceKind string
+
+const (
+	resourceStaff resourceKind = "staff"
+	resourceRoom  resourceKind = "room"
+	resourceChair resourceKind = "chair"
+)
+
+func (k resourceKind) valid() bool {
+	return k == resourceStaff || k == resourceRoom || k == resourceChair
+}
+
+const resourceColumns = `
+	id,
+	name,
+	kind,
+	staff_id
+`
+
+func scanResource(row sqler.Row, r *Resource) error {
+	return row.Scan(
+		&r.ID,
+		&r.Name,
+		&r.Kind,
+		&r.StaffID,
+	)
+}
+
+func resourceExists(ctx context.Context, db sqler.Queryer, businessID, resourceID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM resources
+			WHERE
+				business_id = $1 AND id = $2 AND deleted_at IS NULL
+		);
+	`, businessID, resourceID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("checking resourceID=%v: %w", resourceID, err)
+	}
+	return exists, nil
+}
+
+type listResourcesAction struct{}
+
+type (
+	resources []Resource
+)
+
+func (a listResourcesAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+resourceColumns+`
+		FROM resources
+		WHERE
+			business_id = $1 AND deleted_at IS NULL
+		ORDER BY name
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching resources: %w", err)
+	}
+	defer rows.Close()
+
+	rs := resources{}
+	for rows.Next() {
+		var r Resource
+		err := scanResource(rows, &r)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	return rs, nil
+}
+
+type newResourceAction struct {
+	Name    string       `json:"name"`
+	Kind    resourceKind `json:"kind"`
+	StaffID string       `json:"staffId,omitempty"`
+}
+
+type (
+	// missingName
+	badResourceKind struct{}
+	unknownStaff    struct{}
+	resource        Resource
+)
+
+func (a *newResourceAction) validate() interface{} {
+	a.Name = strings.TrimSpace(a.Name)
+
+	if a.Name == "" {
+		return missingName{}
+	}
+	if !a.Kind.valid() {
+		return badResourceKind{}
+	}
+	if a.Kind != resourceStaff {
+		a.StaffID = ""
+	}
+	return nil
+}
+
+func (a newResourceAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if invalid := a.validate(); invalid != nil {
+		return invalid, nil
+	}
+
+	row := srv.db.QueryRow(ctx, `
+		INSERT INTO resources
+			(business_id, id, name, kind, staff_id)
+		VALUES
+			($1, $2, $3, $4, $5)
+		RETURNING `+resourceColumns+`
+		;
+	`, businessID, ulidx.New(), a.Name, a.Kind, nilIfEmpty(a.StaffID))
+	var r Resource
+	err := scanResource(row, &r)
+	if isForeignKeyViolation(err) {
+		return unknownStaff{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inserting resource: %w", err)
+	}
+
+	return resource(r), nil
+}
+
+type updateResourceAction struct {
+	ID string `json:"id"`
+	newResourceAction
+}
+
+type (
+// missingName
+// badResourceKind
+// unknownStaff
+// notFound
+// resource
+)
+
+func (a updateResourceAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if invalid := a.validate(); invalid != nil {
+		return invalid, nil
+	}
+
+	row := srv.db.QueryRow(ctx, `
+		UPDATE resources SET
+			name = $3,
+			kind = $4,
+			staff_id = $5
+		WHERE
+			business_id = $1 AND id = $2 AND deleted_at IS NULL
+		RETURNING `+resourceColumns+`
+		;
+	`, businessID, a.ID, a.Name, a.Kind, nilIfEmpty(a.StaffID))
+	var r Resource
+	err := scanResource(row, &r)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if isForeignKeyViolation(err) {
+		return unknownStaff{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("updating resourceID=%v: %w", a.ID, err)
+	}
+
+	return resource(r), nil
+}
+
+type deleteResourceAction struct {
+	ID string `json:"id"`
+}
+
+type (
+// ok
+// notFound
+)
+
+func (a deleteResourceAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	// Existing appointments keep referencing the resource, so it's only
+	// marked as deleted.
+	res, err := srv.db.Exec(ctx, `
+		UPDATE resources SET
+			deleted_at = now() at time zone 'utc'
+		WHERE
+			business_id = $1 AND id = $2 AND deleted_at IS NULL
+		;
+	`, businessID, a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("deleting resourceID=%v: %w", a.ID, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return notFound{}, nil
+	}
+
+	return ok{}, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+type appointmentStatus string
+
+const (
+	statusPending  appointmentStatus = "pending"
+	statusStarted  appointmentStatus = "started"
+	statusFinished appointmentStatus = "finished"
+	statusCanceled appointmentStatus = "canceled"
+	statusNoShow   appointmentStatus = "noShow"
+)
+
+// appointmentStatusConditions are the SQL conditions for each status. They're
+// mutually exclusive.
+var appointmentStatusConditions = map[appointmentStatus]string{
+	statusPending:  "started_at IS NULL AND finished_at IS NULL AND canceled_at IS NULL AND no_show_at IS NULL",
+	statusStarted:  "started_at IS NOT NULL AND finished_at IS NULL AND canceled_at IS NULL",
+	statusFinished: "finished_at IS NOT NULL",
+	statusCanceled: "canceled_at IS NOT NULL",
+	statusNoShow:   "no_show_at IS NOT NULL",
+}
+
+type searchAppointmentsAction struct {
+	// From and To limit the appointments' start. Either may be zero.
+	From time.Time `json:"from,omitempty"`
+	To   time.Time `json:"to,omitempty"`
+	// Statuses restrict the results to appointments in any of them. Empty
+	// means any status.
+	Statuses []appointmentStatus `json:"statuses,omitempty"`
+	// Name, Phone and Email match substrings, case-insensitively.
+	Name  string `json:"name,omitempty"`
+	Phone string `json:"phone,omitempty"`
+	Email string `json:"email,omitempty"`
+	// Text matches substrings in the comments.
+	Text       string `json:"text,omitempty"`
+	ResourceID string `json:"resourceId,omitempty"`
+	CustomerID string `json:"customerId,omitempty"`
+	// Cursor is the NextCursor from a previous search with the same filters.
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type (
+	badStatus     struct{}
+	badCursor     struct{}
+	searchResults struct {
+		// Appointments are sorted by start, latest first.
+		Appointments appointments `json:"appointments"`
+		// NextCursor fetches the next page. Empty if there are no more
+		// results.
+		NextCursor string `json:"nextCursor,omitempty"`
+	}
+)
+
+// searchCursor is the position after which a search continues.
+type searchCursor struct {
+	Start time.Time `json:"s"`
+	ID    string    `json:"i"`
+}
+
+func (c searchCursor) encode() string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeSearchCursor(s string) (searchCursor, error) {
+	var c searchCursor
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(js, &c)
+	if err == nil && c.ID == "" {
+		err = fmt.Errorf("cursor without ID")
+	}
+	return c, err
+}
+
+func (a searchAppointmentsAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if a.Limit <= 0 {
+		a.Limit = defaultSearchLimit
+	}
+	if a.Limit > maxSearchLimit {
+		a.Limit = maxSearchLimit
+	}
+
+	params := []interface{}{businessID}
+	param := func(v interface{}) string {
+		params = append(params, v)
+		return fmt.Sprintf("$%d", len(params))
+	}
+	where := []string{"business_id = $1"}
+
+	if !a.From.IsZero() {
+		where = append(where, "start >= "+param(a.From))
+	}
+	if !a.To.IsZero() {
+		where = append(where, "start < "+param(a.To))
+	}
+
+	if len(a.Statuses) > 0 {
+		var statuses []string
+		for _, s := range a.Statuses {
+			cond, ok := appointmentStatusConditions[s]
+			if !ok {
+				return badStatus{}, nil
+			}
+			statuses = append(statuses, "("+cond+")")
+		}
+		where = append(where, "("+strings.Join(statuses, " OR ")+")")
+	}
+
+	if a.Name != "" {
+		where = append(where, "name ILIKE "+param(likeSubstring(a.Name)))
+	}
+	if phone := trimPhone(a.Phone); phone != "" {
+		where = append(where, "phone LIKE "+param(likeSubstring(phone)))
+	}
+	if email := strings.TrimSpace(a.Email); email != "" {
+		where = append(where, "email ILIKE "+param(likeSubstring(email)))
+	}
+	if a.Text != "" {
+		where = append(where, "comments ILIKE "+param(likeSubstring(a.Text)))
+	}
+	if a.ResourceID != "" {
+		where = append(where, "resource_id = "+param(a.ResourceID))
+	}
+	if a.CustomerID != "" {
+		where = append(where, "customer_id = "+param(a.CustomerID))
+	}
+
+	if a.Cursor != "" {
+		cursor, err := decodeSearchCursor(a.Cursor)
+		if err != nil {
+			return badCursor{}, nil
+		}
+		where = append(where, fmt.Sprintf("(start, id) < (%s, %s)", param(cursor.Start), param(cursor.ID)))
+	}
+
+	// Fetch one more to know whether there's a next page.
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+appointmentColumns+`
+		FROM appointments
+		WHERE
+			`+strings.Join(where, "\n\t\t\tAND ")+`
+		ORDER BY start DESC, id DESC
+		LIMIT `+param(a.Limit+1)+`
+		;
+	`, params...)
+	if err != nil {
+		return nil, fmt.Errorf("searching appointments for businessID=%v: %w", businessID, err)
+	}
+	defer rows.Close()
+
+	result := searchResults{Appointments: appointments{}}
+	for rows.Next() {
+		var app Appointment
+		err := scanAppointment(rows, &app)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		result.Appointments = append(result.Appointments, app)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	if len(result.Appointments) > a.Limit {
+		result.Appointments = result.Appointments[:a.Limit]
+		last := result.Appointments[a.Limit-1]
+		result.NextCursor = searchCursor{Start: last.Start, ID: last.ID}.encode()
+	}
+
+	return result, nil
+}
+
+// likeSubstring makes a LIKE pattern that matches s anywhere.
+func likeSubstring(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + s + "%"
+}
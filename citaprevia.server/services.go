@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+// defaultAppointmentDuration is used for appointments that don't have a
+// service nor an explicit end.
+const defaultAppointmentDuration = 10 * time.Minute
+
+type Service struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Duration   time.Duration `json:"duration"`
+	PriceCents *int          `json:"priceCents,omitempty"`
+	Color      *string       `json:"color,omitempty"`
+}
+
+// serviceJSONColumn is a scalar subquery, valid wherever the appointments
+// table is in scope, that returns the appointment's service as JSON.
+const serviceJSONColumn = `(
+	SELECT json_build_object(
+		'id', s.id,
+		'name', s.name,
+		'duration', (extract(epoch from s.duration) * 1000000000) :: bigint,
+		'priceCents', s.price_cents,
+		'color', s.color
+	)
+	FROM services s
+	WHERE s.business_id = appointments.business_id AND s.id = appointments.service_id
+)`
+
+const serviceColumns = `
+	id,
+	name,
+	extract(epoch from duration),
+	price_cents,
+	color
+`
+
+func scanService(row sqler.Row, s *Service) error {
+	var durationSecs float64
+	err := row.Scan(
+		&s.ID,
+		&s.Name,
+		&durationSecs,
+		&s.PriceCents,
+		&s.Color,
+	)
+	s.Duration = time.Second * time.Duration(durationSecs)
+	return err
+}
+
+func serviceDuration(ctx context.Context, db sqler.Queryer, businessID, serviceID string) (time.Duration, bool, error) {
+	var durationSecs float64
+	err := db.QueryRow(ctx, `
+		SELECT extract(epoch from duration)
+		FROM services
+		WHERE
+			business_id = $1 AND id = $2 AND deleted_at IS NULL
+		;
+	`, businessID, serviceID).Scan(&durationSecs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("fetching duration for serviceID=%v: %w", serviceID, err)
+	}
+	return time.Second * time.Duration(durationSecs), true, nil
+}
+
+func formatPrice(cents int) string {
+	return fmt.Sprintf("%d,%02d €", cents/100, cents%100)
+}
+
+var colorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type listServicesAction struct{}
+
+type (
+	services []Service
+)
+
+func (a listServicesAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+serviceColumns+`
+		FROM services
+		WHERE
+			business_id = $1 AND deleted_at IS NULL
+		ORDER BY name
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching services: %w", err)
+	}
+	defer rows.Close()
+
+	ss := services{}
+	for rows.Next() {
+		var s Service
+		err := scanService(rows, &s)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		ss = append(ss, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	return ss, nil
+}
+
+type newServiceAction struct {
+	Name       string        `json:"name"`
+	Duration   time.Duration `json:"duration"`
+	PriceCents *int          `json:"priceCents,omitempty"`
+	Color      string        `json:"color,omitempty"`
+}
+
+type (
+	// missingName struct{}
+	missingDuration struct{}
+	badPrice        struct{}
+	badColor        struct{}
+	service         Service
+)
+
+func (a *newServiceAction) validate() interface{} {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Color = strings.TrimSpace(a.Color)
+
+	if a.Name == "" {
+		return missingName{}
+	}
+	if a.Duration < time.Minute {
+		return missingDuration{}
+	}
+	if a.PriceCents != nil && *a.PriceCents < 0 {
+		return badPrice{}
+	}
+	if a.Color != "" && !colorRegexp.MatchString(a.Color) {
+		return badColor{}
+	}
+	return nil
+}
+
+func (a newServiceAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if invalid := a.validate(); invalid != nil {
+		return invalid, nil
+	}
+
+	row := srv.db.QueryRow(ctx, `
+		INSERT INTO services (
+			business_id, id,
+			name, duration,
+			price_cents, color
+		) VALUES (
+			$1, $2,
+			$3, $4 * interval '1 second',
+			$5, $6
+		)
+		RETURNING `+serviceColumns+`
+		;
+	`,
+		businessID, ulidx.New(),
+		a.Name, a.Duration.Seconds(),
+		a.PriceCents, nilIfEmpty(a.Color),
+	)
+	var s Service
+	err := scanService(row, &s)
+	if err != nil {
+		return nil, fmt.Errorf("inserting service: %w", err)
+	}
+
+	return service(s), nil
+}
+
+type updateServiceAction struct {
+	ID string `json:"id"`
+	newServiceAction
+}
+
+type (
+// missingName
+// missingDuration
+// badPrice
+// badColor
+// notFound
+// service
+)
+
+func (a updateServiceAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if invalid := a.validate(); invalid != nil {
+		return invalid, nil
+	}
+
+	row := srv.db.QueryRow(ctx, `
+		UPDATE services SET
+			name = $3,
+			duration = $4 * interval '1 second',
+			price_cents = $5,
+			color = $6
+		WHERE
+			business_id = $1 AND id = $2 AND deleted_at IS NULL
+		RETURNING `+serviceColumns+`
+		;
+	`,
+		businessID, a.ID,
+		a.Name, a.Duration.Seconds(),
+		a.PriceCents, nilIfEmpty(a.Color),
+	)
+	var s Service
+	err := scanService(row, &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("updating service serviceID=%v: %w", a.ID, err)
+	}
+
+	return service(s), nil
+}
+
+type deleteServiceAction struct {
+	ID string `json:"id"`
+}
+
+type (
+// ok
+// notFound
+)
+
+func (a deleteServiceAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	// Existing appointments keep referencing the service, so it's only
+	// marked as deleted.
+	res, err := srv.db.Exec(ctx, `
+		UPDATE services SET
+			deleted_at = now() at time zone 'utc'
+		WHERE
+			business_id = $1 AND id = $2 AND deleted_at IS NULL
+		;
+	`, businessID, a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("deleting service serviceID=%v: %w", a.ID, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return notFound{}, nil
+	}
+
+	return ok{}, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/canastic/ulidx"
+)
+
+// An SMSProvider sends SMS through some gateway.
+type SMSProvider interface {
+	// Name identifies the provider in sms_messages.
+	Name() string
+	// SendSMS sends msg to phone, in international format. If callbackURL
+	// isn't empty, the provider should report delivery status changes there.
+	// It returns the provider's ID for the message, which is what status
+	// reports refer to.
+	SendSMS(ctx context.Context, phone, msg, callbackURL string) (providerMessageID string, err error)
+	// ParseStatus parses a delivery status report sent to callbackURL.
+	ParseStatus(req *http.Request) ([]smsStatusReport, error)
+}
+
+type smsStatus string
+
+const (
+	smsSent      smsStatus = "sent"
+	smsDelivered smsStatus = "delivered"
+	smsFailed    smsStatus = "failed"
+)
+
+type smsStatusReport struct {
+	ProviderMessageID string
+	Status            smsStatus
+	Error             string
+}
+
+// newSMSProvider returns the provider chosen by CITAPREVIA_SMS_PROVIDER. If
+// not set, SMS are sent through sms.to if there's a key for it, or just
+// logged otherwise.
+func newSMSProvider() (SMSProvider, error) {
+	provider := smsProviderName
+	if provider == "" {
+		provider = "smsto"
+		if smsToKey == "" {
+			provider = "log"
+		}
+	}
+
+	switch provider {
+	case "smsto":
+		if smsToKey == "" {
+			return nil, errors.New("missing CITAPREVIA_SMSTO_KEY")
+		}
+		return smsToProvider{key: smsToKey}, nil
+	case "http":
+		if smsHTTPURL == "" {
+			return nil, errors.New("missing CITAPREVIA_SMS_HTTP_URL")
+		}
+		return httpSMSProvider{url: smsHTTPURL, authorization: smsHTTPAuthorization}, nil
+	case "log":
+		return logSMSProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", provider)
+	}
+}
+
+const maxSMSLength = 160
+
+// smsWithName formats an SMS from f, whose only verb is a %s for the name,
+// truncating the name so that the message fits in a single SMS.
+func smsWithName(f, name string) string {
+	return fmt.Sprintf(f, truncate(name, maxSMSLength-(len(f)-len(`%s`))))
+}
+
+// internationalPhone adds the default country code to phone numbers that
+// don't have one.
+func internationalPhone(phone string) string {
+	phone = trimPhone(phone)
+	switch {
+	case strings.HasPrefix(phone, "+"):
+		return phone
+	case strings.HasPrefix(phone, "00"):
+		return "+" + phone[2:]
+	default:
+		return smsDefaultCountryCode + phone
+	}
+}
+
+// smsStatusCallbackURL is where providers should report the status of the
+// messages we send, or empty if reports are disabled.
+func smsStatusCallbackURL() string {
+	if smsStatusBaseURL == "" {
+		return ""
+	}
+	return smsStatusBaseURL + "/smsStatus?token=" + url.QueryEscape(smsStatusToken)
+}
+
+type smsToProvider struct {
+	key string
+}
+
+func (smsToProvider) Name() string { return "smsto" }
+
+func (p smsToProvider) SendSMS(ctx context.Context, phone, msg, callbackURL string) (string, error) {
+	body := map[string]interface{}{
+		"message":   msg,
+		"to":        phone,
+		"sender_id": "TengoCita",
+	}
+	if callbackURL != "" {
+		body["callback_url"] = callbackURL
+	}
+
+	var resp struct {
+		Success   bool   `json:"success"`
+		MessageID string `json:"message_id"`
+	}
+	err := postJSON(ctx, "https://api.sms.to/sms/send", "Bearer "+p.key, body, &resp)
+	if err != nil {
+		return "", err
+	}
+	if !resp.Success {
+		return "", permanentError{errors.New("sms.to didn't accept the message")}
+	}
+	return resp.MessageID, nil
+}
+
+func (smsToProvider) ParseStatus(req *http.Request) ([]smsStatusReport, error) {
+	var report struct {
+		MessageID string `json:"messageId"`
+		Status    string `json:"status"`
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(req.Body).Decode(&report)
+		if err != nil {
+			return nil, fmt.Errorf("decoding sms.to report: %w", err)
+		}
+	} else {
+		req.ParseForm()
+		report.MessageID = req.Form.Get("messageId")
+		report.Status = req.Form.Get("status")
+	}
+
+	var status smsStatus
+	switch strings.ToUpper(report.Status) {
+	case "DELIVERED":
+		status = smsDelivered
+	case "FAILED", "REJECTED", "UNDELIVERED", "EXPIRED":
+		status = smsFailed
+	default:
+		status = smsSent
+	}
+	return []smsStatusReport{{
+		ProviderMessageID: report.MessageID,
+		Status:            status,
+		Error:             strings.ToLower(report.Status),
+	}}, nil
+}
+
+// httpSMSProvider posts messages as JSON to a configurable endpoint:
+//
+//	{"to": "+34600000000", "message": "...", "callbackUrl": "..."}
+//
+// which must respond with {"id": "..."}. Status reports are expected as
+//
+//	{"id": "...", "status": "delivered" | "failed", "error": "..."}
+type httpSMSProvider struct {
+	url           string
+	authorization string
+}
+
+func (httpSMSProvider) Name() string { return "http" }
+
+func (p httpSMSProvider) SendSMS(ctx context.Context, phone, msg, callbackURL string) (string, error) {
+	var resp struct {
+		ID string `json:"id"`
+	}
+	err := postJSON(ctx, p.url, p.authorization, map[string]interface{}{
+		"to":          phone,
+		"message":     msg,
+		"callbackUrl": callbackURL,
+	}, &resp)
+	return resp.ID, err
+}
+
+func (httpSMSProvider) ParseStatus(req *http.Request) ([]smsStatusReport, error) {
+	var report struct {
+		ID     string    `json:"id"`
+		Status smsStatus `json:"status"`
+		Error  string    `json:"error"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&report)
+	if err != nil {
+		return nil, fmt.Errorf("decoding report: %w", err)
+	}
+	if report.Status != smsDelivered && report.Status != smsFailed {
+		report.Status = smsSent
+	}
+	return []smsStatusReport{{
+		ProviderMessageID: report.ID,
+		Status:            report.Status,
+		Error:             report.Error,
+	}}, nil
+}
+
+// logSMSProvider doesn't send anything; it just logs the messages.
+type logSMSProvider struct{}
+
+func (logSMSProvider) Name() string { return "log" }
+
+func (logSMSProvider) SendSMS(ctx context.Context, phone, msg, callbackURL string) (string, error) {
+	log(ctx).Printf("Skipping SMS to %s: %s", phone, msg)
+	return ulidx.New(), nil
+}
+
+func (logSMSProvider) ParseStatus(req *http.Request) ([]smsStatusReport, error) {
+	return nil, nil
+}
+
+// postJSON posts body to url and decodes the response into resp. 4xx
+// responses are permanent errors.
+func postJSON(ctx context.Context, url, authorization string, body, resp interface{}) error {
+	js, err := json.Marshal(body)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(js))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode >= 400 && httpResp.StatusCode < 500 {
+		respBody, _ := ioutil.ReadAll(httpResp.Body)
+		return permanentError{fmt.Errorf("POST %s responded with %s; body: %s", url, httpResp.Status, respBody)}
+	}
+	if httpResp.StatusCode >= 500 {
+		return fmt.Errorf("POST %s responded with %s", url, httpResp.Status)
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return fmt.Errorf("decoding response from POST %s: %w", url, err)
+	}
+	return nil
+}
+
+func (l *outboxLoop) sendSMS(ctx context.Context, m claimedOutboxMessage) error {
+	var payload smsPayload
+	err := json.Unmarshal(m.Payload, &payload)
+	if err != nil {
+		return permanentError{fmt.Errorf("decoding SMS payload: %w", err)}
+	}
+
+	phone := internationalPhone(m.Recipient)
+	providerMessageID, err := l.sms.SendSMS(ctx, phone, payload.Message, smsStatusCallbackURL())
+	if err != nil {
+		return err
+	}
+
+	// The message is already sent; don't let a failure to record it cause
+	// it to be sent again.
+	_, err = l.db.Exec(ctx, `
+		INSERT INTO sms_messages (
+			id, outbox_id, business_id, appointment_id,
+			phone, provider, provider_message_id, status
+		) VALUES (
+			$1, $2, $3, $4,
+			$5, $6, $7, $8
+		);
+	`,
+		ulidx.New(), m.ID, m.BusinessID, m.AppointmentID,
+		phone, l.sms.Name(), nilIfEmpty(providerMessageID), smsSent,
+	)
+	if err != nil {
+		log(ctx).Printf("Error recording sent SMS providerMessageID=%s: %s", providerMessageID, err)
+	}
+	return nil
+}
+
+// serveSMSStatus records delivery status reports from the SMS provider.
+func (srv server) serveSMSStatus(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	token := req.URL.Query().Get("token")
+	if smsStatusToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(smsStatusToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	reports, err := srv.sms.ParseStatus(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log(ctx).Printf("Bad SMS status report: %s", err)
+		return nil
+	}
+
+	for _, r := range reports {
+		if r.ProviderMessageID == "" || r.Status == smsSent {
+			continue
+		}
+		errMsg := sql.NullString{String: r.Error, Valid: r.Status == smsFailed && r.Error != ""}
+		// Reports may arrive out of order; delivered is final.
+		_, err := srv.db.Exec(ctx, `
+			UPDATE sms_messages SET
+				status = $3,
+				error = $4,
+				updated_at = now()
+			WHERE
+				provider = $1 AND provider_message_id = $2
+				AND status <> 'delivered'
+			;
+		`, srv.sms.Name(), r.ProviderMessageID, r.Status, errMsg)
+		if err != nil {
+			return fmt.Errorf("updating SMS status providerMessageID=%s: %w", r.ProviderMessageID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -1,9 +1,10 @@
 
 CREATE TABLE "businesses" (
     "id" text NOT NULL PRIMARY KEY,
+    -- email and phone are the business' contact details. Logins use staff's,
+    -- which start as a copy of these for the owner but are kept separately.
     "email" text NULL UNIQUE,
     "phone" text NULL UNIQUE,
-    "password" text NOT NULL,
     "name" text NULL,
     "address" text NULL,
     "photo" bytea NULL,
@@ -12,15 +13,45 @@ CREATE TABLE "businesses" (
     "signup_promo_code" text NULL,
     "can_send_promo_emails" boolean NOT NULL DEFAULT true,
     "promo_emails_unsubscribe_link" text NOT NULL UNIQUE DEFAULT base64_web_encode(random_bytea(12)),
+    "slug" text NULL UNIQUE,
+    "self_booking" boolean NOT NULL DEFAULT false,
+    "reminder_lead_minutes" int[] NOT NULL DEFAULT '{1440, 120}',
+    "no_show_grace_minutes" int NULL DEFAULT 60,
+    "time_zone" text NOT NULL DEFAULT 'Europe/Madrid',
+    -- locale is the default for messages to customers: es, en or ca.
+    "locale" text NOT NULL DEFAULT 'es',
+    -- calendar_feed_token is the secret in the URL of the appointments'
+    -- iCalendar feed.
+    "calendar_feed_token" text NOT NULL UNIQUE DEFAULT base64_web_encode(random_bytea(12)),
     CHECK (NOT (("email" IS NULL) AND ("phone" IS NULL)))
 ) WITH (oids = false);
 
+CREATE TABLE "staff" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "email" text NULL UNIQUE,
+    "phone" text NULL UNIQUE,
+    "password" text NULL,
+    "name" text NULL,
+    "role" text NOT NULL,
+    "invite_token" text NULL UNIQUE,
+    "disabled_at" timestamptz NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "last_login" timestamptz NULL,
+    PRIMARY KEY ("business_id", "id"),
+    CHECK ("role" IN ('owner', 'receptionist', 'practitioner')),
+    CHECK (NOT (("email" IS NULL) AND ("phone" IS NULL))),
+    CHECK (NOT (("password" IS NULL) AND ("invite_token" IS NULL)))
+) WITH (oids = false);
+
 CREATE TABLE "business_sessions" (
     "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "staff_id" text NOT NULL,
     "id" TEXT NOT NULL,
     "created_at" timestamptz NOT NULL DEFAULT now(),
     "last_used" timestamptz DEFAULT now(),
-    PRIMARY KEY ("business_id", "id")
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "staff_id") REFERENCES "staff" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
 ) WITH (oids = false);
 
 CREATE OR REPLACE FUNCTION random_bytea(bytea_length integer)
@@ -41,43 +72,330 @@ LANGUAGE 'sql'
 VOLATILE
 SET search_path = 'pg_catalog';
 
+-- random_customer_code is four random digits from 1 to 9.
+CREATE OR REPLACE FUNCTION random_customer_code()
+RETURNS int AS $body$
+    SELECT 0 +
+        width_bucket(random(), 0, 1, 9) * 1 +
+        width_bucket(random(), 0, 1, 9) * 10 +
+        width_bucket(random(), 0, 1, 9) * 100 +
+        width_bucket(random(), 0, 1, 9) * 1000;
+$body$
+LANGUAGE sql
+VOLATILE;
+
 CREATE OR REPLACE FUNCTION timestamptz_to_date(timestamptz) 
   RETURNS date AS
 $func$
 SELECT ($1 AT TIME ZONE 'UTC') :: date
 $func$ LANGUAGE sql IMMUTABLE;
 
+-- business_day is the date of t in the business' time zone. Appointments are
+-- bucketed into days with it.
+CREATE OR REPLACE FUNCTION business_day(business_id text, t timestamptz)
+RETURNS date AS $body$
+    SELECT (t AT TIME ZONE b.time_zone) :: date FROM businesses b WHERE b.id = business_id;
+$body$
+LANGUAGE sql
+STABLE;
+
+CREATE TABLE "opening_hours" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "weekday" int NOT NULL,
+    "opens" time NOT NULL,
+    "closes" time NOT NULL,
+    PRIMARY KEY ("business_id", "weekday", "opens"),
+    CHECK ("weekday" BETWEEN 0 AND 6),
+    CHECK ("opens" < "closes")
+) WITH (oids = false);
+
+CREATE TABLE "opening_exceptions" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "day" date NOT NULL,
+    "opens" time NULL,
+    "closes" time NULL,
+    "reason" text NULL,
+    PRIMARY KEY ("business_id", "id"),
+    CHECK (("opens" IS NULL) = ("closes" IS NULL)),
+    CHECK ("opens" < "closes")
+) WITH (oids = false);
+
+CREATE INDEX ON opening_exceptions ("business_id", "day");
+
+CREATE TABLE "services" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NOT NULL,
+    "duration" interval NOT NULL,
+    "price_cents" int NULL,
+    "color" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "deleted_at" timestamptz NULL,
+    PRIMARY KEY ("business_id", "id"),
+    CHECK ("duration" > interval '0'),
+    CHECK ("price_cents" >= 0)
+) WITH (oids = false);
+
+CREATE TABLE "resources" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NOT NULL,
+    "kind" text NOT NULL,
+    "staff_id" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "deleted_at" timestamptz NULL,
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "staff_id") REFERENCES "staff" ("business_id", "id") ON UPDATE CASCADE,
+    CHECK ("kind" IN ('staff', 'room', 'chair')),
+    CHECK (NOT (("staff_id" IS NOT NULL) AND ("kind" <> 'staff')))
+) WITH (oids = false);
+
+-- phone is in international format and email in lowercase, so that
+-- appointments can be matched to customers.
+CREATE TABLE "customers" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NULL,
+    "phone" text NULL,
+    "email" text NULL,
+    "notes" text NOT NULL DEFAULT '',
+    "tags" text[] NOT NULL DEFAULT '{}',
+    "marketing_consent_at" timestamptz NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "id")
+) WITH (oids = false);
+
+CREATE UNIQUE INDEX ON customers ("business_id", "phone");
+CREATE UNIQUE INDEX ON customers ("business_id", "email");
+CREATE INDEX ON customers ("business_id", (COALESCE("name", '')), "id");
+
+-- until and count are as requested; the appointments are created upfront.
+CREATE TABLE "appointment_series" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "frequency" text NOT NULL,
+    "interval" int NOT NULL,
+    "until" timestamptz NULL,
+    "count" int NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "id"),
+    CHECK ("frequency" IN ('weekly', 'monthly'))
+) WITH (oids = false);
+
 CREATE TABLE "appointments" (
     "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
     "id" text NOT NULL,
     "customer_link" text NOT NULL UNIQUE DEFAULT base64_web_encode(random_bytea(9)),
-    "customer_code" int NOT NULL DEFAULT 0 +
-        width_bucket(random(), 0, 1, 9) * 1 +
-        width_bucket(random(), 0, 1, 9) * 10 +
-        width_bucket(random(), 0, 1, 9) * 100 +
-        width_bucket(random(), 0, 1, 9) * 1000,
+    "customer_code" int NOT NULL DEFAULT random_customer_code(),
     "number" int NOT NULL,
     "start" timestamptz NOT NULL,
+    -- day is the business_day of start, set by the appointment_day trigger.
+    "day" date NOT NULL,
     "end" timestamptz NOT NULL,
     "phone" text,
     "email" text,
     "name" text,
     "comments" text,
     "started_at" timestamptz,
+    "no_show_at" timestamptz,
+    -- no_show_cleared_at is when the business undid a no-show mark; the
+    -- appointment isn't marked again automatically after that.
+    "no_show_cleared_at" timestamptz,
+    "confirmed_at" timestamptz,
     "finished_at" timestamptz,
     "canceled_at" timestamptz,
     "cancel_reason" text,
     "created_at" timestamptz NOT NULL DEFAULT now(),
     "push_subscription" json,
+    "can_send_emails" boolean NOT NULL DEFAULT true,
+    "service_id" text NULL,
+    "resource_id" text NULL,
+    "customer_id" text NULL,
+    "series_id" text NULL,
+    -- Walk-ins are queued by number instead of booked at a fixed time; their
+    -- start is the time they arrived.
+    "walk_in" boolean NOT NULL DEFAULT false,
+    -- locale, if set, overrides the business' one for messages to the
+    -- customer.
+    "locale" text NULL,
+    -- calendar_sequence is the SEQUENCE of the appointment's .ics file, set by
+    -- the appointment_calendar_sequence trigger.
+    "calendar_sequence" int NOT NULL DEFAULT 0,
     PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "service_id") REFERENCES "services" ("business_id", "id") ON UPDATE CASCADE,
+    FOREIGN KEY ("business_id", "resource_id") REFERENCES "resources" ("business_id", "id") ON UPDATE CASCADE,
+    FOREIGN KEY ("business_id", "customer_id") REFERENCES "customers" ("business_id", "id") ON UPDATE CASCADE,
+    FOREIGN KEY ("business_id", "series_id") REFERENCES "appointment_series" ("business_id", "id") ON UPDATE CASCADE,
     CHECK (NOT (("email" IS NULL) AND ("phone" IS NULL))),
     CHECK (NOT (("finished_at" IS NOT NULL) AND ("canceled_at" IS NOT NULL))),
     CHECK (NOT (("finished_at" IS NOT NULL) AND ("started_at" IS NULL))),
-    CHECK (NOT (("cancel_reason" IS NOT NULL) AND ("canceled_at" IS NULL)))
+    CHECK (NOT (("cancel_reason" IS NOT NULL) AND ("canceled_at" IS NULL))),
+    CHECK (NOT (("no_show_at" IS NOT NULL) AND (("started_at" IS NOT NULL) OR ("canceled_at" IS NOT NULL))))
 ) WITH (oids = false);
 
 CREATE INDEX ON appointments ("business_id", "end", "start");
-CREATE UNIQUE INDEX ON appointments ("business_id", (("start" AT TIME ZONE 'UTC') :: date), "customer_code");
+CREATE INDEX ON appointments ("business_id", "resource_id", "start");
+CREATE INDEX ON appointments ("business_id", "start", "id");
+CREATE INDEX ON appointments ("business_id", "customer_id", "start");
+CREATE INDEX ON appointments ("business_id", "series_id", "start");
+CREATE UNIQUE INDEX appointments_business_id_day_customer_code_idx ON appointments ("business_id", "day", "customer_code");
+
+CREATE OR REPLACE FUNCTION set_appointment_day()
+RETURNS trigger AS $body$
+BEGIN
+    NEW.day := business_day(NEW.business_id, NEW.start);
+    RETURN NEW;
+END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER appointment_day
+BEFORE INSERT OR UPDATE OF start ON appointments
+FOR EACH ROW EXECUTE PROCEDURE set_appointment_day();
+
+-- Calendar apps only replace a saved event if its SEQUENCE is higher. Both the
+-- customer's .ics and the business' feed use it, so it changes with anything
+-- either of them shows.
+CREATE OR REPLACE FUNCTION increment_appointment_calendar_sequence()
+RETURNS trigger AS $body$
+BEGIN
+    NEW.calendar_sequence := OLD.calendar_sequence + 1;
+    RETURN NEW;
+END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER appointment_calendar_sequence
+BEFORE UPDATE OF
+    start, "end", canceled_at, no_show_at, finished_at, service_id,
+    number, name, phone, email, comments, cancel_reason
+ON appointments
+FOR EACH ROW
+WHEN (
+    (NEW.start, NEW."end", NEW.canceled_at, NEW.no_show_at, NEW.finished_at, NEW.service_id,
+        NEW.number, NEW.name, NEW.phone, NEW.email, NEW.comments, NEW.cancel_reason)
+    IS DISTINCT FROM
+    (OLD.start, OLD."end", OLD.canceled_at, OLD.no_show_at, OLD.finished_at, OLD.service_id,
+        OLD.number, OLD.name, OLD.phone, OLD.email, OLD.comments, OLD.cancel_reason)
+)
+EXECUTE PROCEDURE increment_appointment_calendar_sequence();
+
+-- Changes to appointments are notified on the appointment_events channel, so
+-- that every server instance can stream them to the business app. Changes only
+-- to how the customer is notified aren't interesting for the business.
+-- Transactions that change many appointments at once set
+-- tengocita.quiet_appointment_events and notify a single resync event instead.
+CREATE OR REPLACE FUNCTION notify_appointment_event()
+RETURNS trigger AS $body$
+DECLARE
+    event text;
+BEGIN
+    IF current_setting('tengocita.quiet_appointment_events', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'INSERT' THEN
+        event := 'created';
+    ELSIF to_jsonb(NEW) - 'push_subscription' - 'can_send_emails' - 'locale' = to_jsonb(OLD) - 'push_subscription' - 'can_send_emails' - 'locale' THEN
+        RETURN NULL;
+    ELSIF NEW.canceled_at IS NOT NULL AND OLD.canceled_at IS NULL THEN
+        event := 'canceled';
+    ELSIF NEW.finished_at IS NOT NULL AND OLD.finished_at IS NULL THEN
+        event := 'finished';
+    ELSIF NEW.started_at IS NOT NULL AND OLD.started_at IS NULL THEN
+        event := 'started';
+    ELSE
+        event := 'updated';
+    END IF;
+    PERFORM pg_notify('appointment_events', json_build_object(
+        'businessId', NEW.business_id,
+        'appointmentId', NEW.id,
+        'event', event
+    ) :: text);
+    RETURN NULL;
+END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER appointment_events
+AFTER INSERT OR UPDATE ON appointments
+FOR EACH ROW EXECUTE PROCEDURE notify_appointment_event();
+
+-- channel is NULL for reminders that were due at the same time as a
+-- shorter one, and so weren't sent.
+CREATE TABLE "appointment_reminders" (
+    "business_id" text NOT NULL,
+    "appointment_id" text NOT NULL,
+    "lead_minutes" int NOT NULL,
+    "channel" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "appointment_id", "lead_minutes"),
+    FOREIGN KEY ("business_id", "appointment_id") REFERENCES "appointments" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
+) WITH (oids = false);
+
+-- slots is a JSON array of {"start", "end"} objects.
+CREATE TABLE "reschedule_requests" (
+    "business_id" text NOT NULL,
+    "id" text NOT NULL,
+    "appointment_id" text NOT NULL,
+    "slots" json NOT NULL,
+    "comments" text,
+    "status" text NOT NULL DEFAULT 'pending' CHECK ("status" IN ('pending', 'accepted', 'rejected', 'withdrawn')),
+    "reason" text,
+    "accepted_start" timestamptz,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "resolved_at" timestamptz,
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "appointment_id") REFERENCES "appointments" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
+) WITH (oids = false);
+
+CREATE INDEX ON reschedule_requests ("business_id", "appointment_id", "created_at");
+CREATE UNIQUE INDEX ON reschedule_requests ("business_id", "appointment_id") WHERE "status" = 'pending';
+
+CREATE TABLE "waitlist_entries" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "id" text NOT NULL,
+    "name" text NULL,
+    "phone" text NULL,
+    "email" text NULL,
+    "service_id" text NULL,
+    "resource_id" text NULL,
+    "from" timestamptz NOT NULL,
+    "to" timestamptz NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "claimed_at" timestamptz NULL,
+    "removed_at" timestamptz NULL,
+    "locale" text NULL,
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "service_id") REFERENCES "services" ("business_id", "id") ON UPDATE CASCADE,
+    FOREIGN KEY ("business_id", "resource_id") REFERENCES "resources" ("business_id", "id") ON UPDATE CASCADE,
+    CHECK (NOT (("email" IS NULL) AND ("phone" IS NULL))),
+    CHECK ("from" < "to")
+) WITH (oids = false);
+
+CREATE INDEX ON waitlist_entries ("business_id", "created_at") WHERE "claimed_at" IS NULL AND "removed_at" IS NULL;
+
+-- resource_id is '' for slots without resource. Only one offer per slot can be
+-- pending at a time.
+CREATE TABLE "waitlist_offers" (
+    "business_id" text NOT NULL,
+    "id" text NOT NULL,
+    "entry_id" text NOT NULL,
+    "token" text NOT NULL UNIQUE DEFAULT base64_web_encode(random_bytea(9)),
+    "start" timestamptz NOT NULL,
+    "end" timestamptz NOT NULL,
+    "resource_id" text NOT NULL DEFAULT '',
+    "service_id" text NULL,
+    "status" text NOT NULL DEFAULT 'pending' CHECK ("status" IN ('pending', 'claimed', 'expired', 'unavailable')),
+    "expires_at" timestamptz NOT NULL,
+    "appointment_id" text NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "id"),
+    FOREIGN KEY ("business_id", "entry_id") REFERENCES "waitlist_entries" ("business_id", "id") ON DELETE CASCADE ON UPDATE CASCADE
+) WITH (oids = false);
+
+CREATE UNIQUE INDEX ON waitlist_offers ("business_id", "resource_id", "start") WHERE "status" = 'pending';
+CREATE INDEX ON waitlist_offers ("expires_at") WHERE "status" = 'pending';
 
 CREATE TABLE "last_appointment_number_for_day" (
     "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
@@ -86,10 +404,60 @@ CREATE TABLE "last_appointment_number_for_day" (
     PRIMARY KEY ("business_id", "day")
 )  WITH (oids = false);
 
+-- resource_id is '' for appointments without resource.
 CREATE TABLE "delay_alerts" (
     "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "resource_id" text NOT NULL DEFAULT '',
     "checking_started" timestamptz,
     "last_delay" interval,
     "last_start_cutoff" timestamptz,
-    PRIMARY KEY ("business_id")
+    PRIMARY KEY ("business_id", "resource_id")
+) WITH (oids = false);
+
+CREATE TABLE "outbox" (
+    "id" text NOT NULL PRIMARY KEY,
+    "business_id" text NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "appointment_id" text NULL,
+    "channel" text NOT NULL CHECK ("channel" IN ('push', 'sms', 'email')),
+    "recipient" text NOT NULL,
+    "payload" json NOT NULL,
+    "status" text NOT NULL DEFAULT 'pending' CHECK ("status" IN ('pending', 'sent', 'dead')),
+    "attempts" int NOT NULL DEFAULT 0,
+    "max_attempts" int NOT NULL,
+    "next_attempt_at" timestamptz NOT NULL DEFAULT now(),
+    "locked_until" timestamptz,
+    "last_error" text,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "sent_at" timestamptz
+) WITH (oids = false);
+
+CREATE INDEX ON outbox ("channel", "next_attempt_at") WHERE "status" = 'pending';
+
+CREATE TABLE "sms_messages" (
+    "id" text NOT NULL PRIMARY KEY,
+    "outbox_id" text NOT NULL REFERENCES "outbox" ("id") ON DELETE CASCADE,
+    "business_id" text NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "appointment_id" text NULL,
+    "phone" text NOT NULL,
+    "provider" text NOT NULL,
+    "provider_message_id" text NULL,
+    "status" text NOT NULL CHECK ("status" IN ('sent', 'delivered', 'failed')),
+    "error" text,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "updated_at" timestamptz NOT NULL DEFAULT now(),
+    UNIQUE ("provider", "provider_message_id")
+) WITH (oids = false);
+
+CREATE INDEX ON sms_messages ("business_id", "appointment_id", "created_at");
+
+-- template is a text/template over messageVars that replaces the default text
+-- of a kind of message to customers.
+-- Templates are per locale, as each customer gets messages in theirs.
+CREATE TABLE "message_templates" (
+    "business_id" text NOT NULL REFERENCES "businesses" ("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    "kind" text NOT NULL,
+    "locale" text NOT NULL,
+    "template" text NOT NULL,
+    "updated_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("business_id", "kind", "locale")
 ) WITH (oids = false);
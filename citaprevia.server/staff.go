@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+type staffRole string
+
+const (
+	roleOwner        staffRole = "owner"
+	roleReceptionist staffRole = "receptionist"
+	rolePractitioner staffRole = "practitioner"
+)
+
+var ownerOnly = []staffRole{roleOwner}
+
+func (r staffRole) valid() bool {
+	return r.in([]staffRole{roleOwner, roleReceptionist, rolePractitioner})
+}
+
+// in returns whether r is one of roles. Any role is in an empty list.
+func (r staffRole) in(roles []staffRole) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type StaffMember struct {
+	ID       string    `json:"id"`
+	Name     *string   `json:"name,omitempty"`
+	Email    *string   `json:"email,omitempty"`
+	Phone    *string   `json:"phone,omitempty"`
+	Role     staffRole `json:"role"`
+	Disabled bool      `json:"disabled,omitempty"`
+	Invited  bool      `json:"invited,omitempty"`
+}
+
+// staffColumns are the columns scanStaff expects, in order. They're qualified
+// so that they can be used in joins with the staff table aliased as s.
+const staffColumns = `
+	s.id,
+	s.name,
+	s.email,
+	s.phone,
+	s.role,
+	s.disabled_at IS NOT NULL,
+	s.password IS NULL
+`
+
+func scanStaff(row sqler.Row, s *StaffMember) error {
+	return row.Scan(
+		&s.ID,
+		&s.Name,
+		&s.Email,
+		&s.Phone,
+		&s.Role,
+		&s.Disabled,
+		&s.Invited,
+	)
+}
+
+type staffCtxKey struct{}
+
+func withStaff(ctx context.Context, s StaffMember) context.Context {
+	return context.WithValue(ctx, staffCtxKey{}, s)
+}
+
+// staffFromContext returns the staff member performing a business action, as
+// set by withBusinessAuth.
+func staffFromContext(ctx context.Context) StaffMember {
+	s, _ := ctx.Value(staffCtxKey{}).(StaffMember)
+	return s
+}
+
+type listStaffAction struct{}
+
+type (
+	staffMembers []StaffMember
+)
+
+func (a listStaffAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+staffColumns+`
+		FROM staff s
+		WHERE
+			s.business_id = $1
+		ORDER BY s.created_at
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching staff: %w", err)
+	}
+	defer rows.Close()
+
+	ss := staffMembers{}
+	for rows.Next() {
+		var s StaffMember
+		err := scanStaff(rows, &s)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		ss = append(ss, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	return ss, nil
+}
+
+type inviteStaffAction struct {
+	EmailOrPhone string    `json:"emailOrPhone"`
+	Name         string    `json:"name,omitempty"`
+	Role         staffRole `json:"role"`
+}
+
+type (
+	// missingEmailOrPhone
+	// emailOrPhoneTaken
+	badRole      struct{}
+	staffInvited struct {
+		Staff         StaffMember `json:"staff"`
+		InviteToken   string      `json:"inviteToken"`
+		InviteMessage string      `json:"inviteMessage"`
+	}
+)
+
+func (a inviteStaffAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.EmailOrPhone = strings.TrimSpace(a.EmailOrPhone)
+	a.Name = strings.TrimSpace(a.Name)
+
+	if a.EmailOrPhone == "" {
+		return missingEmailOrPhone{}, nil
+	}
+	if !a.Role.valid() {
+		return badRole{}, nil
+	}
+
+	s := StaffMember{
+		ID:      ulidx.New(),
+		Name:    nilIfEmpty(a.Name),
+		Role:    a.Role,
+		Invited: true,
+	}
+	if strings.Contains(a.EmailOrPhone, "@") {
+		s.Email = &a.EmailOrPhone
+	} else {
+		phone := trimPhone(a.EmailOrPhone)
+		s.Phone = &phone
+	}
+
+	var businessName string
+	var inviteToken string
+	err := srv.db.QueryRow(ctx, `
+		WITH inserted AS (
+			INSERT INTO staff
+				(business_id, id, email, phone, name, role, invite_token)
+			VALUES
+				($1, $2, $3, $4, $5, $6, base64_web_encode(random_bytea(12)))
+			RETURNING invite_token
+		)
+		SELECT b.name, inserted.invite_token
+		FROM businesses b, inserted
+		WHERE b.id = $1
+		;
+	`, businessID, s.ID, s.Email, s.Phone, s.Name, s.Role).Scan(&businessName, &inviteToken)
+	if isUniqueViolation(err) {
+		return emailOrPhoneTaken{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inserting staff: %w", err)
+	}
+
+	return staffInvited{
+		Staff:       s,
+		InviteToken: inviteToken,
+		InviteMessage: fmt.Sprintf(
+			`Te han invitado a gestionar las citas de %s en TengoCita. Acepta la invitación aquí: https://web.tengocita.app/?invite=%s`,
+			businessName, inviteToken,
+		),
+	}, nil
+}
+
+type acceptStaffInviteAction struct {
+	InviteToken string `json:"inviteToken"`
+	Password    string `json:"password"`
+}
+
+type (
+// missingPassword
+// notFound
+// loggedIn
+)
+
+func (a acceptStaffInviteAction) serveAction(ctx context.Context, srv server) (interface{}, error) {
+	a.Password = strings.TrimSpace(a.Password)
+	if a.Password == "" {
+		return missingPassword{}, nil
+	}
+
+	hashedPassword, err := argon2id.CreateHash(a.Password, argon2id.DefaultParams)
+	if err != nil {
+		return nil, err
+	}
+
+	var businessID string
+	var staff StaffMember
+	row := srv.db.QueryRow(ctx, `
+		UPDATE staff s SET
+			password = $2,
+			invite_token = NULL
+		WHERE
+			invite_token = $1 AND disabled_at IS NULL
+		RETURNING s.business_id, `+staffColumns+`
+		;
+	`, a.InviteToken, hashedPassword)
+	err = row.Scan(
+		&businessID,
+		&staff.ID, &staff.Name, &staff.Email, &staff.Phone, &staff.Role, &staff.Disabled, &staff.Invited,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accepting invite: %w", err)
+	}
+
+	ctx = scope(ctx, "businessID", businessID)
+	log(ctx).Printf("Accepted invite staffID=%s", staff.ID)
+
+	business, err := fetchLoggedInBusiness(ctx, srv.db, businessID)
+	if err != nil {
+		return nil, err
+	}
+
+	authToken, err := srv.newSession(ctx, businessID, staff.ID)
+	if err != nil {
+		return nil, fmt.Errorf("creating session: %w", err)
+	}
+
+	return loggedIn{
+		AuthToken: authToken,
+		Business:  business,
+		Staff:     staff,
+	}, nil
+}
+
+type updateStaffAction struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name,omitempty"`
+	Role staffRole `json:"role"`
+}
+
+type (
+	// badRole
+	// notFound
+	cannotChangeSelf struct{}
+	staffMember      StaffMember
+)
+
+func (a updateStaffAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Name = strings.TrimSpace(a.Name)
+
+	if !a.Role.valid() {
+		return badRole{}, nil
+	}
+	// Owners can't demote themselves, so that there's always an owner left.
+	if a.ID == staffFromContext(ctx).ID && a.Role != roleOwner {
+		return cannotChangeSelf{}, nil
+	}
+
+	var s StaffMember
+	row := srv.db.QueryRow(ctx, `
+		UPDATE staff s SET
+			name = $3,
+			role = $4
+		WHERE
+			business_id = $1 AND id = $2
+		RETURNING `+staffColumns+`
+		;
+	`, businessID, a.ID, nilIfEmpty(a.Name), a.Role)
+	err := scanStaff(row, &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("updating staffID=%v: %w", a.ID, err)
+	}
+
+	return staffMember(s), nil
+}
+
+type disableStaffAction struct {
+	ID       string `json:"id"`
+	Disabled bool   `json:"disabled"`
+}
+
+type (
+// cannotChangeSelf
+// notFound
+// staffMember
+)
+
+func (a disableStaffAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if a.ID == staffFromContext(ctx).ID {
+		return cannotChangeSelf{}, nil
+	}
+
+	var s StaffMember
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		row := tx.QueryRow(ctx, `
+			UPDATE staff s SET
+				disabled_at = CASE WHEN $3 THEN COALESCE(disabled_at, now() at time zone 'utc') END
+			WHERE
+				business_id = $1 AND id = $2
+			RETURNING `+staffColumns+`
+			;
+		`, businessID, a.ID, a.Disabled)
+		err = scanStaff(row, &s)
+		if err != nil {
+			return false, fmt.Errorf("disabling staffID=%v: %w", a.ID, err)
+		}
+
+		_, err = tx.Exec(ctx, `
+			DELETE FROM business_sessions
+			WHERE
+				business_id = $1 AND staff_id = $2 AND $3
+			;
+		`, businessID, a.ID, a.Disabled)
+		if err != nil {
+			return false, fmt.Errorf("deleting sessions for staffID=%v: %w", a.ID, err)
+		}
+
+		return true, nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return staffMember(s), nil
+}
+
+type removeStaffAction struct {
+	ID string `json:"id"`
+}
+
+type (
+// cannotChangeSelf
+// notFound
+// ok
+)
+
+func (a removeStaffAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	if a.ID == staffFromContext(ctx).ID {
+		return cannotChangeSelf{}, nil
+	}
+
+	var found bool
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	err = useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		_, err = tx.Exec(ctx, `
+			UPDATE resources SET
+				staff_id = NULL
+			WHERE
+				business_id = $1 AND staff_id = $2
+			;
+		`, businessID, a.ID)
+		if err != nil {
+			return false, fmt.Errorf("unlinking resources from staffID=%v: %w", a.ID, err)
+		}
+
+		// Sessions are deleted by cascade.
+		res, err := tx.Exec(ctx, `
+			DELETE FROM staff
+			WHERE
+				business_id = $1 AND id = $2
+			;
+		`, businessID, a.ID)
+		if err != nil {
+			return false, fmt.Errorf("removing staffID=%v: %w", a.ID, err)
+		}
+		affected, err := res.RowsAffected()
+		found = err == nil && affected > 0
+		return found, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return notFound{}, nil
+	}
+
+	return ok{}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tcard/sqler"
+)
+
+// Each business has an IANA time zone. Appointments are bucketed into days in
+// it (see business_day in sql.sql), and times shown to customers are
+// formatted in it.
+
+// loadTimeZone loads a time zone as stored for a business.
+func loadTimeZone(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("loading time zone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// validTimeZone reports whether name is an IANA time zone that can be set for
+// a business.
+func validTimeZone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+func businessLocation(ctx context.Context, db sqler.Queryer, businessID string) (*time.Location, error) {
+	_, loc, err := fetchBusinessNameAndLocation(ctx, db, businessID)
+	return loc, err
+}
+
+// fetchBusinessNameAndLocation fetches what messages to the business'
+// customers need.
+func fetchBusinessNameAndLocation(ctx context.Context, db sqler.Queryer, businessID string) (name string, loc *time.Location, err error) {
+	var timeZone string
+	err = db.QueryRow(ctx, `
+		SELECT name, time_zone FROM businesses WHERE id = $1;
+	`, businessID).Scan(&name, &timeZone)
+	if err != nil {
+		return "", nil, fmt.Errorf("fetching business name and time zone: %w", err)
+	}
+	loc, err = loadTimeZone(timeZone)
+	return name, loc, err
+}
+
+// sameDay reports whether a and b are on the same day in loc.
+func sameDay(a, b time.Time, loc *time.Location) bool {
+	ay, am, ad := a.In(loc).Date()
+	by, bm, bd := b.In(loc).Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// calendarDays is the number of days from a's date to b's, in their
+// locations.
+func calendarDays(a, b time.Time) int {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return int(time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC).Sub(time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC)) / (24 * time.Hour))
+}
+
+// clockTime is how far t's wall clock is from midnight.
+func clockTime(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+}
+
+// rebucketAppointments moves the business' upcoming appointments to the days
+// they fall on in its current time zone, after it changes. Past ones keep the
+// day they happened on.
+//
+// A moved appointment gets the next number on its new day, as if it had been
+// moved there by hand, and a new customer code if its own is already taken
+// there. The customer page always shows the current ones.
+//
+// Instead of an event per moved appointment, the business app is told to
+// fetch everything again.
+func rebucketAppointments(ctx context.Context, tx sqler.Tx, businessID string) error {
+	rows, err := tx.Query(ctx, `
+		SELECT id, start
+		FROM appointments
+		WHERE
+			business_id = $1 AND start >= now()
+			AND day <> business_day(business_id, start)
+		ORDER BY start, id
+		;
+	`, businessID)
+	if err != nil {
+		return fmt.Errorf("fetching appointments to move to another day: %w", err)
+	}
+	type moved struct {
+		id    string
+		start time.Time
+	}
+	var apps []moved
+	for rows.Next() {
+		var m moved
+		err := rows.Scan(&m.id, &m.start)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning row: %w", err)
+		}
+		apps = append(apps, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scanning rows: %w", err)
+	}
+	if len(apps) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, `SELECT set_config('tengocita.quiet_appointment_events', 'on', true);`)
+	if err != nil {
+		return fmt.Errorf("silencing appointment events: %w", err)
+	}
+
+	for _, m := range apps {
+		var number int64
+		err := tx.QueryRow(ctx, `
+			INSERT INTO last_appointment_number_for_day
+				(business_id, day)
+			VALUES
+				($1, business_day($1, $2))
+			ON CONFLICT (business_id, day) DO UPDATE SET
+				number = last_appointment_number_for_day.number + 1
+			RETURNING
+				number
+			;
+		`, businessID, m.start).Scan(&number)
+		if err != nil {
+			return fmt.Errorf("fetching appointment number: %w", err)
+		}
+
+		err = retryCustomerCodeConflicts(ctx, tx, func(regenerate bool) error {
+			_, err := tx.Exec(ctx, `
+				UPDATE appointments SET
+					day = business_day(business_id, start),
+					number = $3,
+					customer_code = CASE WHEN $4 THEN random_customer_code() ELSE customer_code END
+				WHERE
+					business_id = $1 AND id = $2
+				;
+			`, businessID, m.id, number, regenerate)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("moving appointmentID=%v to another day: %w", m.id, err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		SELECT
+			set_config('tengocita.quiet_appointment_events', 'off', true),
+			pg_notify('appointment_events', json_build_object(
+				'businessId', $1 :: text,
+				'event', 'resync'
+			) :: text)
+		;
+	`, businessID)
+	if err != nil {
+		return fmt.Errorf("notifying resync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/canastic/ulidx"
+	"github.com/tcard/sqler"
+)
+
+const (
+	waitlistInterval = time.Minute
+	// waitlistOfferTTL is how long a customer has to claim a freed slot
+	// before it's offered to the next one.
+	waitlistOfferTTL = 30 * time.Minute
+)
+
+// A WaitlistEntry is a customer waiting for a slot to free up between From
+// and To.
+type WaitlistEntry struct {
+	ID         string    `json:"id"`
+	Name       *string   `json:"name,omitempty"`
+	Phone      *string   `json:"phone,omitempty"`
+	Email      *string   `json:"email,omitempty"`
+	ServiceID  *string   `json:"serviceId,omitempty"`
+	ResourceID *string   `json:"resourceId,omitempty"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// OfferExpiresAt is set while the customer has a slot on offer.
+	OfferExpiresAt *time.Time `json:"offerExpiresAt,omitempty"`
+}
+
+const waitlistEntryColumns = `
+	e.id,
+	e.name,
+	e.phone,
+	e.email,
+	e.service_id,
+	e.resource_id,
+	e."from",
+	e."to",
+	e.created_at,
+	(
+		SELECT o.expires_at
+		FROM waitlist_offers o
+		WHERE o.business_id = e.business_id AND o.entry_id = e.id AND o.status = 'pending'
+	)
+`
+
+func scanWaitlistEntry(row sqler.Row, e *WaitlistEntry) error {
+	return row.Scan(
+		&e.ID,
+		&e.Name,
+		&e.Phone,
+		&e.Email,
+		&e.ServiceID,
+		&e.ResourceID,
+		&e.From,
+		&e.To,
+		&e.CreatedAt,
+		&e.OfferExpiresAt,
+	)
+}
+
+type addToWaitlistAction struct {
+	Name       string    `json:"name,omitempty"`
+	Phone      string    `json:"phone,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	ServiceID  string    `json:"serviceId,omitempty"`
+	ResourceID string    `json:"resourceId,omitempty"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	// Locale is the language of the offers to the customer. Defaults to the
+	// business' one.
+	Locale locale `json:"locale,omitempty"`
+}
+
+type (
+	// missingEmailOrPhone
+	// unknownService
+	// unknownResource
+	// badLocale
+	badRange      struct{}
+	waitlistEntry WaitlistEntry
+)
+
+func (a addToWaitlistAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Phone = trimPhone(a.Phone)
+	a.Email = strings.TrimSpace(a.Email)
+	if a.Phone == "" && a.Email == "" {
+		return missingEmailOrPhone{}, nil
+	}
+	if a.From.IsZero() || !a.From.Before(a.To) || a.To.Before(now()) {
+		return badRange{}, nil
+	}
+	if a.Locale != "" && !a.Locale.valid() {
+		return badLocale{}, nil
+	}
+	if a.ServiceID != "" {
+		_, ok, err := serviceDuration(ctx, srv.db, businessID, a.ServiceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownService{}, nil
+		}
+	}
+	if a.ResourceID != "" {
+		ok, err := resourceExists(ctx, srv.db, businessID, a.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return unknownResource{}, nil
+		}
+	}
+
+	var e WaitlistEntry
+	row := srv.db.QueryRow(ctx, `
+		WITH e AS (
+			INSERT INTO waitlist_entries (
+				business_id, id,
+				name, phone, email,
+				service_id, resource_id,
+				"from", "to",
+				locale
+			) VALUES (
+				$1, $2,
+				$3, $4, $5,
+				$6, $7,
+				$8, $9,
+				$10
+			)
+			RETURNING *
+		)
+		SELECT `+waitlistEntryColumns+`
+		FROM e
+		;
+	`,
+		businessID, ulidx.New(),
+		nilIfEmpty(a.Name), nilIfEmpty(a.Phone), nilIfEmpty(a.Email),
+		nilIfEmpty(a.ServiceID), nilIfEmpty(a.ResourceID),
+		a.From, a.To,
+		nilIfEmpty(string(a.Locale)),
+	)
+	err := scanWaitlistEntry(row, &e)
+	if err != nil {
+		return nil, fmt.Errorf("inserting waitlist entry: %w", err)
+	}
+
+	return waitlistEntry(e), nil
+}
+
+type listWaitlistAction struct{}
+
+type (
+	waitlist []WaitlistEntry
+)
+
+func (a listWaitlistAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	rows, err := srv.db.Query(ctx, `
+		SELECT `+waitlistEntryColumns+`
+		FROM waitlist_entries e
+		WHERE
+			e.business_id = $1 AND e."to" > now()
+			AND e.claimed_at IS NULL AND e.removed_at IS NULL
+		ORDER BY e.created_at
+		;
+	`, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching waitlist: %w", err)
+	}
+	defer rows.Close()
+
+	entries := waitlist{}
+	for rows.Next() {
+		var e WaitlistEntry
+		err := scanWaitlistEntry(rows, &e)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+
+	return entries, nil
+}
+
+type removeFromWaitlistAction struct {
+	ID string `json:"id"`
+}
+
+type (
+// ok
+// notFound
+)
+
+func (a removeFromWaitlistAction) serveAction(ctx context.Context, srv server, businessID string) (interface{}, error) {
+	res, err := srv.db.Exec(ctx, `
+		UPDATE waitlist_entries SET
+			removed_at = now()
+		WHERE
+			business_id = $1 AND id = $2 AND claimed_at IS NULL AND removed_at IS NULL
+		;
+	`, businessID, a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("removing waitlist entry id=%v: %w", a.ID, err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return notFound{}, nil
+	}
+	return ok{}, nil
+}
+
+// offerFreedSlot offers the slot of a just canceled appointment to the
+// waitlist. It's meant to be called within the transaction that cancels it.
+func offerFreedSlot(ctx context.Context, tx sqler.Tx, businessID, appointmentID string) error {
+	var slot Slot
+	var resourceID, serviceID string
+	err := tx.QueryRow(ctx, `
+		SELECT start, "end", COALESCE(resource_id, ''), COALESCE(service_id, '')
+		FROM appointments
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, appointmentID).Scan(&slot.Start, &slot.End, &resourceID, &serviceID)
+	if err != nil {
+		return fmt.Errorf("fetching freed slot appointmentID=%v: %w", appointmentID, err)
+	}
+	return offerSlot(ctx, tx, businessID, slot, resourceID, serviceID)
+}
+
+// offerSlot offers slot to the first customer in the waitlist that wants it
+// and hasn't been offered it already, if it's still free. The offer is sent by
+// SMS, or email if there's no phone.
+func offerSlot(ctx context.Context, tx sqler.Tx, businessID string, slot Slot, resourceID, serviceID string) error {
+	t := now()
+	if !slot.Start.After(t) {
+		return nil
+	}
+	notBookable, err := checkBookable(ctx, tx, businessID, resourceID, slot, "")
+	if err != nil {
+		return err
+	}
+	if notBookable != nil {
+		return nil
+	}
+
+	var entryID string
+	var phone, email sql.NullString
+	var l locale
+	err = tx.QueryRow(ctx, `
+		SELECT
+			e.id, e.phone, e.email,
+			COALESCE(e.locale, (SELECT b.locale FROM businesses b WHERE b.id = e.business_id))
+		FROM waitlist_entries e
+		WHERE
+			e.business_id = $1
+			AND e.claimed_at IS NULL AND e.removed_at IS NULL
+			AND e."from" <= $2 AND e."to" >= $3
+			AND (e.resource_id IS NULL OR e.resource_id = $4)
+			AND (e.service_id IS NULL OR e.service_id = $5)
+			AND NOT EXISTS (
+				SELECT 1
+				FROM waitlist_offers o
+				WHERE
+					o.business_id = e.business_id AND o.entry_id = e.id
+					AND (o.status = 'pending' OR (o.start = $2 AND o.resource_id = $4))
+			)
+		ORDER BY e.created_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+		;
+	`, businessID, slot.Start, slot.End, resourceID, serviceID).Scan(&entryID, &phone, &email, &l)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching next in waitlist: %w", err)
+	}
+
+	expiresAt := t.Add(waitlistOfferTTL)
+	if expiresAt.After(slot.Start) {
+		expiresAt = slot.Start
+	}
+
+	offerID := ulidx.New()
+	var token string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO waitlist_offers (
+			business_id, id, entry_id,
+			start, "end", resource_id, service_id,
+			expires_at
+		) VALUES (
+			$1, $2, $3,
+			$4, $5, $6, $7,
+			$8
+		)
+		ON CONFLICT (business_id, resource_id, start) WHERE status = 'pending' DO NOTHING
+		RETURNING token
+		;
+	`,
+		businessID, offerID, entryID,
+		slot.Start, slot.End, resourceID, nilIfEmpty(serviceID),
+		expiresAt,
+	).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Already on offer to someone else.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("inserting waitlist offer: %w", err)
+	}
+
+	businessName, loc, err := fetchBusinessNameAndLocation(ctx, tx, businessID)
+	if err != nil {
+		return err
+	}
+
+	start, expiresAt := slot.Start.In(loc), expiresAt.In(loc)
+	when := l.when(start)
+	deadline := fmt.Sprintf("%d:%02d", expiresAt.Hour(), expiresAt.Minute())
+	link := "https://tengocita.app/w/" + token
+
+	log(ctx).Printf("Offering slot start=%v resourceID=%q to waitlist entryID=%s", slot.Start, resourceID, entryID)
+
+	if phone.Valid {
+		vars := newMessageVars(businessName, start, "", 0)
+		vars.Link = link
+		vars.Code = 0
+		vars.Deadline = deadline
+		sms, err := renderMessage(ctx, tx, businessID, messageOfferSMS, l, vars)
+		if err != nil {
+			return err
+		}
+		return enqueueNotification(ctx, tx, outboxMessage{
+			BusinessID: businessID,
+			Channel:    channelSMS,
+			Recipient:  phone.String,
+			Payload:    smsPayload{Message: sms},
+		})
+	}
+	return enqueueEmail(ctx, tx, businessID, "", nullStringPtr(email), appointmentEmail{
+		Subject: l.sprintf("offer.subject", businessName),
+		Paragraphs: []string{
+			l.sprintf("offer.body", businessName, when),
+			l.sprintf("offer.deadline", deadline),
+		},
+		Link:     link,
+		LinkText: l.sprintf("offer.book"),
+		Locale:   l,
+	})
+}
+
+// claimWaitlistOffer marks the offer as claimed by appointmentID, and its
+// entry as done. It's meant to be called within the transaction that creates
+// the appointment, so that both happen or neither does.
+func claimWaitlistOffer(ctx context.Context, tx sqler.Tx, businessID, offerID, appointmentID string) (claimed bool, err error) {
+	var entryID string
+	err = tx.QueryRow(ctx, `
+		UPDATE waitlist_offers SET
+			status = 'claimed',
+			appointment_id = $3
+		WHERE
+			business_id = $1 AND id = $2
+			AND status = 'pending' AND expires_at > now()
+		RETURNING entry_id
+		;
+	`, businessID, offerID, appointmentID).Scan(&entryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("claiming waitlist offer id=%v: %w", offerID, err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE waitlist_entries SET
+			claimed_at = now()
+		WHERE
+			business_id = $1 AND id = $2
+		;
+	`, businessID, entryID)
+	if err != nil {
+		return false, fmt.Errorf("updating waitlist entry id=%v: %w", entryID, err)
+	}
+	return true, nil
+}
+
+// serveWaitlistOffer serves the page from which customers claim a slot
+// offered to them.
+func (srv server) serveWaitlistOffer(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+	token := strings.TrimPrefix(req.URL.Path, "/w/")
+
+	var page struct {
+		BusinessName string
+		Start        time.Time
+		ExpiresAt    time.Time
+		Pending      bool
+		Error        string
+		Locale       locale
+	}
+
+	var businessID, offerID string
+	var end time.Time
+	var resourceID string
+	var serviceID, name, phone, email sql.NullString
+	var status string
+	var timeZone string
+	var entryLocale *locale
+	var fallback locale
+	err := srv.db.QueryRow(ctx, `
+		SELECT
+			o.business_id, o.id, b.name, b.time_zone, b.locale,
+			o.start, o."end", o.resource_id, o.service_id,
+			o.status, o.expires_at,
+			e.name, e.phone, e.email, e.locale
+		FROM
+			waitlist_offers o
+			JOIN businesses b ON b.id = o.business_id
+			JOIN waitlist_entries e ON e.business_id = o.business_id AND e.id = o.entry_id
+		WHERE
+			o.token = $1
+		;
+	`, token).Scan(
+		&businessID, &offerID, &page.BusinessName, &timeZone, &fallback,
+		&page.Start, &end, &resourceID, &serviceID,
+		&status, &page.ExpiresAt,
+		&name, &phone, &email, &entryLocale,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Redirect(w, req, "https://tengocita.app", http.StatusSeeOther)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching waitlist offer: %w", err)
+	}
+	loc, err := loadTimeZone(timeZone)
+	if err != nil {
+		return err
+	}
+	page.Start, page.ExpiresAt = page.Start.In(loc), page.ExpiresAt.In(loc)
+	page.Pending = status == "pending" && page.ExpiresAt.After(now())
+	page.Locale = pageLocale(req, entryLocale, fallback)
+
+	if req.Method == "POST" && page.Pending {
+		result, err := newAppointmentAction{
+			Start:           page.Start,
+			End:             end,
+			Phone:           phone.String,
+			Email:           email.String,
+			Name:            name.String,
+			ServiceID:       serviceID.String,
+			ResourceID:      resourceID,
+			Locale:          page.Locale,
+			waitlistOfferID: offerID,
+		}.serveAction(ctx, srv, businessID)
+		if err != nil {
+			return err
+		}
+
+		log(ctx).Printf("Waitlist claim offerID=%s result=%T", offerID, result)
+
+		switch result := result.(type) {
+		case created:
+			http.Redirect(w, req, "https://tengocita.app/c/"+result.CustomerLink, http.StatusSeeOther)
+			return nil
+		case outsideOpeningHours, slotTaken:
+			_, err := srv.db.Exec(ctx, `
+				UPDATE waitlist_offers SET
+					status = 'unavailable'
+				WHERE
+					business_id = $1 AND id = $2 AND status = 'pending'
+				;
+			`, businessID, offerID)
+			if err != nil {
+				return fmt.Errorf("marking waitlist offer id=%v unavailable: %w", offerID, err)
+			}
+			page.Error = page.Locale.sprintf("offer.taken")
+		default:
+			page.Error = page.Locale.sprintf("offer.failed")
+		}
+		page.Pending = false
+	} else if !page.Pending && status != "claimed" {
+		page.Error = page.Locale.sprintf("offer.expired")
+	}
+
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	return waitlistOfferTpl.Execute(w, page)
+}
+
+var waitlistOfferTpl = template.Must(template.New("").Funcs(localeFuncs).Parse(`
+<html lang="{{.Locale}}">
+
+<head>
+<title>{{t .Locale "offer.title" .BusinessName}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style type="text/css">
+body {
+	font-family: sans-serif;
+	text-align: center;
+}
+
+.alert {
+	background-color: #ffffaa;
+	padding: 20px;
+}
+
+button, input[type=submit] {
+	padding: 10;
+	font-weight: bold;
+	font-size: 1em;
+}
+</style>
+</head>
+
+<body>
+
+<h1>{{t .Locale "offer.title" .BusinessName}}</h1>
+
+<h2>📆 {{when .Locale .Start}}</h2>
+
+{{with .Error}}
+<p class="alert">⚠️ {{.}}</p>
+{{end}}
+
+{{if .Pending}}
+<p>{{t .Locale "offer.bookBefore" (.ExpiresAt.Format "15:04")}}</p>
+
+<form method="post" action="">
+<p><input type="submit" value="{{t .Locale "offer.book"}}"></p>
+</form>
+{{end}}
+
+</body>
+
+</html>
+`))
+
+// waitlistLoop moves expired offers on to the next customer in the waitlist.
+type waitlistLoop struct {
+	db sqler.DB
+}
+
+func (l *waitlistLoop) run() {
+	ctx := context.Background()
+	ctx = scope(ctx, "service", "waitlist")
+
+	for {
+		time.Sleep(waitlistInterval)
+
+		err := l.expire(ctx, now())
+		if err != nil {
+			log(ctx).Printf("%s", err)
+		}
+	}
+}
+
+// expire expires the offers that are due at t, and offers their slots to the
+// next in the waitlist.
+func (l *waitlistLoop) expire(ctx context.Context, t time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	return useTx(tx, func(tx sqler.Tx) (commit bool, err error) {
+		rows, err := tx.Query(ctx, `
+			UPDATE waitlist_offers SET
+				status = 'expired'
+			WHERE
+				status = 'pending' AND expires_at <= $1
+			RETURNING
+				business_id, start, "end", resource_id, COALESCE(service_id, '')
+			;
+		`, t)
+		if err != nil {
+			return false, fmt.Errorf("expiring waitlist offers: %w", err)
+		}
+
+		type expiredOffer struct {
+			businessID, resourceID, serviceID string
+			slot                              Slot
+		}
+		var expired []expiredOffer
+		for rows.Next() {
+			var o expiredOffer
+			err := rows.Scan(&o.businessID, &o.slot.Start, &o.slot.End, &o.resourceID, &o.serviceID)
+			if err != nil {
+				rows.Close()
+				return false, fmt.Errorf("scanning row: %w", err)
+			}
+			expired = append(expired, o)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return false, fmt.Errorf("scanning rows: %w", err)
+		}
+
+		for _, o := range expired {
+			err := offerSlot(scope(ctx, "businessID", o.businessID), tx, o.businessID, o.slot, o.resourceID, o.serviceID)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	})
+}